@@ -1,18 +1,73 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
 	"github.com/NYTimes/gizmo/server"
 	"github.com/Sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
 
 	"github.com/tsuru/riakapi/config"
 	"github.com/tsuru/riakapi/service"
 	"github.com/tsuru/riakapi/service/client"
+	"github.com/tsuru/riakapi/utils"
 )
 
 func main() {
+	migratePasswords := flag.Bool("migrate-passwords", false, "Encrypt the stored user passwords with the current key, rotate the ones derived from the app host, print the instances to bind again and exit")
+	rotateCredentials := flag.String("rotate-credentials", "", "Rotate the password of the app `host` user, print the instances to bind again and exit")
+	grace := flag.Bool("grace", false, "Keep the previous password valid until the rotation is confirmed")
+	confirmRotation := flag.String("confirm-rotation", "", "Invalidate the previous password of the app `host` user rotated with grace and exit")
+	hashSecret := flag.Bool("hash-secret", false, "Print the bcrypt hash of the API credential secret read from stdin (RIAKAPI_CREDENTIALS) and exit")
+	flag.Parse()
+
+	if *hashSecret {
+		secret, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			logrus.Fatalf("Error reading secret: %v", err)
+		}
+		hash, err := bcrypt.GenerateFromPassword(bytes.TrimRight(secret, "\r\n"), bcrypt.DefaultCost)
+		if err != nil {
+			logrus.Fatalf("Error hashing secret: %v", err)
+		}
+		fmt.Println(string(hash))
+		return
+	}
+
 	// Load configuration
 	cfg := config.NewServiceConfig()
 
+	if *migratePasswords {
+		res, err := client.NewRiakWithoutPurger(cfg).MigratePasswords(context.Background())
+		if err != nil {
+			logrus.Fatalf("Error migrating passwords: %v", err)
+		}
+		json.NewEncoder(os.Stdout).Encode(res)
+		return
+	}
+
+	if *rotateCredentials != "" {
+		res, err := client.NewRiakWithoutPurger(cfg).RotateUserPassword(context.Background(), utils.GenerateUsername(*rotateCredentials), *grace)
+		if err != nil {
+			logrus.Fatalf("Error rotating credentials: %v", err)
+		}
+		json.NewEncoder(os.Stdout).Encode(res)
+		return
+	}
+
+	if *confirmRotation != "" {
+		if err := client.NewRiakWithoutPurger(cfg).ConfirmUserRotation(context.Background(), utils.GenerateUsername(*confirmRotation)); err != nil {
+			logrus.Fatalf("Error confirming credentials rotation: %v", err)
+		}
+		return
+	}
+
 	logrus.Info("Starting Riak API service...")
 
 	server.Init("riak-api", cfg.Server)
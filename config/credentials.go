@@ -0,0 +1,120 @@
+package config
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Credential scopes, the APIs a credential can access
+const (
+	// ScopeTsuru is the tsuru service API (instances and bindings)
+	ScopeTsuru = "tsuru"
+	// ScopeAdmin is the riakapi admin API (instances listing and users)
+	ScopeAdmin = "admin"
+)
+
+// validScopes are the scopes a credential can have
+var validScopes = map[string]bool{
+	ScopeTsuru: true,
+	ScopeAdmin: true,
+}
+
+// Credential is a service API user, for example one for each tsuru installation
+type Credential struct {
+	// Name is the basic auth user
+	Name string `json:"name"`
+	// Hash is the bcrypt hash of the credential secret (basic auth password)
+	Hash string `json:"hash"`
+	// Scopes are the APIs the credential can access, tsuru if not set
+	Scopes []string `json:"scopes,omitempty"`
+
+	// password is the plain secret of the RIAKAPI_USERNAME credential
+	password string
+}
+
+// HasScope checks if the credential can access the scope API
+func (c *Credential) HasScope(scope string) bool {
+	for _, s := range c.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSecret compares the secret in constant time
+func (c *Credential) checkSecret(secret string) bool {
+	if c.Hash != "" {
+		return bcrypt.CompareHashAndPassword([]byte(c.Hash), []byte(secret)) == nil
+	}
+	// Hashed so the comparison doesn't depend on the length
+	want, got := sha256.Sum256([]byte(c.password)), sha256.Sum256([]byte(secret))
+	return subtle.ConstantTimeCompare(want[:], got[:]) == 1
+}
+
+// Credentials are the service API users
+type Credentials []*Credential
+
+// Authenticate returns the credential of the name and secret, nil if not valid.
+// The secret is checked even if the name is wrong, so the time doesn't tell the
+// valid names
+func (cs Credentials) Authenticate(name, secret string) *Credential {
+	var found *Credential
+	for _, c := range cs {
+		if subtle.ConstantTimeCompare([]byte(c.Name), []byte(name)) == 1 {
+			found = c
+		}
+	}
+	if found == nil {
+		if len(cs) > 0 {
+			cs[0].checkSecret(secret)
+		}
+		return nil
+	}
+	if !found.checkSecret(secret) {
+		return nil
+	}
+	return found
+}
+
+// parseCredentials decodes and validates a json array of credentials
+func parseCredentials(data []byte) (Credentials, error) {
+	var creds Credentials
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return nil, err
+	}
+
+	names := map[string]bool{}
+	for _, c := range creds {
+		if c.Name == "" {
+			return nil, errors.New("credential name is required")
+		}
+		if strings.Contains(c.Name, ":") {
+			return nil, fmt.Errorf("credential '%s' name can't have ':'", c.Name)
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("credential '%s' is duplicated", c.Name)
+		}
+		names[c.Name] = true
+
+		if _, err := bcrypt.Cost([]byte(c.Hash)); err != nil {
+			return nil, fmt.Errorf("credential '%s' hash is not a bcrypt hash: %v", c.Name, err)
+		}
+
+		if len(c.Scopes) == 0 {
+			c.Scopes = []string{ScopeTsuru}
+		}
+		for _, s := range c.Scopes {
+			if !validScopes[s] {
+				return nil, fmt.Errorf("credential '%s' has a not valid scope '%s'", c.Name, s)
+			}
+		}
+	}
+	return creds, nil
+}
@@ -0,0 +1,87 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestParseCredentials(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+
+	tests := []struct {
+		givenCredentials string
+
+		wantScopes map[string][]string
+		wantError  bool
+	}{
+		{
+			givenCredentials: `[{"name": "tsuru-prod", "hash": "` + string(hash) + `"}, {"name": "ops", "hash": "` + string(hash) + `", "scopes": ["admin"]}]`,
+			wantScopes:       map[string][]string{"tsuru-prod": {ScopeTsuru}, "ops": {ScopeAdmin}},
+		},
+		{givenCredentials: `[]`, wantScopes: map[string][]string{}},
+		{givenCredentials: `{"name": "ops"}`, wantError: true},
+		{givenCredentials: `[{"hash": "` + string(hash) + `"}]`, wantError: true},
+		{givenCredentials: `[{"name": "o:ps", "hash": "` + string(hash) + `"}]`, wantError: true},
+		{givenCredentials: `[{"name": "ops", "hash": "secret"}]`, wantError: true},
+		{givenCredentials: `[{"name": "ops", "hash": "` + string(hash) + `", "scopes": ["root"]}]`, wantError: true},
+		{givenCredentials: `[{"name": "ops", "hash": "` + string(hash) + `"}, {"name": "ops", "hash": "` + string(hash) + `"}]`, wantError: true},
+	}
+
+	for _, test := range tests {
+		got, err := parseCredentials([]byte(test.givenCredentials))
+		if test.wantError {
+			if err == nil {
+				t.Errorf("Expected error parsing %s", test.givenCredentials)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Error parsing %s: %v", test.givenCredentials, err)
+			continue
+		}
+		scopes := map[string][]string{}
+		for _, c := range got {
+			scopes[c.Name] = c.Scopes
+		}
+		if !reflect.DeepEqual(scopes, test.wantScopes) {
+			t.Errorf("Expected scopes %v; got: %v", test.wantScopes, scopes)
+		}
+	}
+}
+
+func TestCredentialsAuthenticate(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	creds := Credentials{
+		{Name: "tsuru-prod", Hash: string(hash), Scopes: []string{ScopeTsuru}},
+		{Name: "legacy", password: "plain", Scopes: []string{ScopeTsuru, ScopeAdmin}},
+	}
+
+	tests := []struct {
+		givenName   string
+		givenSecret string
+
+		wantName string
+	}{
+		{givenName: "tsuru-prod", givenSecret: "secret", wantName: "tsuru-prod"},
+		{givenName: "tsuru-prod", givenSecret: "plain", wantName: ""},
+		{givenName: "legacy", givenSecret: "plain", wantName: "legacy"},
+		{givenName: "legacy", givenSecret: "plai", wantName: ""},
+		{givenName: "legacy", givenSecret: "", wantName: ""},
+		{givenName: "unknown", givenSecret: "secret", wantName: ""},
+	}
+
+	for _, test := range tests {
+		got := creds.Authenticate(test.givenName, test.givenSecret)
+		if test.wantName == "" {
+			if got != nil {
+				t.Errorf("Expected '%s' not authenticated; got: %s", test.givenName, got.Name)
+			}
+			continue
+		}
+		if got == nil || got.Name != test.wantName {
+			t.Errorf("Expected '%s' authenticated; got: %v", test.wantName, got)
+		}
+	}
+}
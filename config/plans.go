@@ -0,0 +1,108 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// Plan is a tsuru plan, translated to riak a bucket type with its properties
+type Plan struct {
+	// Name is the plan name, also the bucket type name
+	Name string `json:"name"`
+	// Description is the plan description shown on tsuru
+	Description string `json:"description"`
+	// DataType is the riak data type of the bucket type (counter, set, map...),
+	// blank for plain key/value bucket types
+	DataType string `json:"datatype,omitempty"`
+	// Props are the bucket type properties, for example n_val, backend, consistent
+	// or write_once. The bucket type is created with exactly these properties
+	Props map[string]interface{} `json:"props,omitempty"`
+	// Parameters are the bucket properties that can be set on instance creation
+	// (for example n_val or r), not listed properties are rejected
+	Parameters []string `json:"parameters,omitempty"`
+	// AllowedCIDRs are the networks the bound apps can connect from until their
+	// units are registered (tsuru bind-unit events), 0.0.0.0/0 if not set
+	AllowedCIDRs []string `json:"allowed_cidrs,omitempty"`
+}
+
+// validDataTypes are the riak data types a plan can have
+var validDataTypes = map[string]bool{
+	"":        true,
+	"counter": true,
+	"set":     true,
+	"map":     true,
+	"hll":     true,
+	"gset":    true,
+}
+
+// defaultPlanParameters are the instance parameters allowed on the default plans,
+// allow_mult and last_write_wins are left out because data types need siblings
+var defaultPlanParameters = []string{"n_val", "r", "pr", "w", "pw", "dw", "rw", "basic_quorum", "notfound_ok"}
+
+// DefaultPlans are the plans used when no plans are configured, one plan for
+// each of the main riak data types
+var DefaultPlans = []*Plan{
+	{
+		Name:        "tsuru-counter",
+		Description: "Bucket type of counter data type",
+		DataType:    "counter",
+		Props:       map[string]interface{}{"allow_mult": true},
+		Parameters:  defaultPlanParameters,
+	},
+	{
+		Name:        "tsuru-set",
+		Description: "Bucket type of set data type",
+		DataType:    "set",
+		Props:       map[string]interface{}{"allow_mult": true},
+		Parameters:  defaultPlanParameters,
+	},
+	{
+		Name:        "tsuru-map",
+		Description: "Bucket type of map data type",
+		DataType:    "map",
+		Props:       map[string]interface{}{"allow_mult": true},
+		Parameters:  defaultPlanParameters,
+	},
+}
+
+// parsePlans decodes and validates a json array of plans
+func parsePlans(data []byte) ([]*Plan, error) {
+	var plans []*Plan
+	if err := json.Unmarshal(data, &plans); err != nil {
+		return nil, err
+	}
+
+	if len(plans) == 0 {
+		return nil, errors.New("at least one plan is required")
+	}
+
+	names := map[string]bool{}
+	for _, p := range plans {
+		if p.Name == "" {
+			return nil, errors.New("plan name is required")
+		}
+		if names[p.Name] {
+			return nil, fmt.Errorf("plan '%s' is duplicated", p.Name)
+		}
+		names[p.Name] = true
+
+		if !validDataTypes[p.DataType] {
+			return nil, fmt.Errorf("plan '%s' has a not valid datatype '%s'", p.Name, p.DataType)
+		}
+		if _, ok := p.Props["datatype"]; ok {
+			return nil, fmt.Errorf("plan '%s' datatype should be set on 'datatype' not on 'props'", p.Name)
+		}
+
+		// Riak shows the sources with the network address, the same is used
+		for i, c := range p.AllowedCIDRs {
+			_, network, err := net.ParseCIDR(c)
+			if err != nil {
+				return nil, fmt.Errorf("plan '%s' has a not valid allowed cidr '%s'", p.Name, c)
+			}
+			p.AllowedCIDRs[i] = network.String()
+		}
+	}
+	return plans, nil
+}
@@ -0,0 +1,55 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePlans(t *testing.T) {
+	tests := []struct {
+		givenPlans string
+
+		wantPlans []*Plan
+		wantError bool
+	}{
+		{
+			givenPlans: `[
+				{"name": "tsuru-counter", "description": "counters", "datatype": "counter", "props": {"n_val": 5}},
+				{"name": "tsuru-kv", "description": "key/value", "props": {"backend": "leveldb_mult"}}
+			]`,
+			wantPlans: []*Plan{
+				{Name: "tsuru-counter", Description: "counters", DataType: "counter", Props: map[string]interface{}{"n_val": float64(5)}},
+				{Name: "tsuru-kv", Description: "key/value", Props: map[string]interface{}{"backend": "leveldb_mult"}},
+			},
+		},
+		{
+			givenPlans: `[{"name": "tsuru-set", "datatype": "set", "allowed_cidrs": ["10.0.0.0/8", "192.168.1.7/24"]}]`,
+			wantPlans: []*Plan{
+				{Name: "tsuru-set", DataType: "set", AllowedCIDRs: []string{"10.0.0.0/8", "192.168.1.0/24"}},
+			},
+		},
+		{givenPlans: `not json`, wantError: true},
+		{givenPlans: `[]`, wantError: true},
+		{givenPlans: `[{"description": "no name"}]`, wantError: true},
+		{givenPlans: `[{"name": "a"}, {"name": "a"}]`, wantError: true},
+		{givenPlans: `[{"name": "a", "datatype": "hashmap"}]`, wantError: true},
+		{givenPlans: `[{"name": "a", "props": {"datatype": "set"}}]`, wantError: true},
+		{givenPlans: `[{"name": "a", "allowed_cidrs": ["10.0.0.1"]}]`, wantError: true},
+	}
+
+	for _, test := range tests {
+		got, err := parsePlans([]byte(test.givenPlans))
+		if test.wantError {
+			if err == nil {
+				t.Errorf("Expected error parsing %s", test.givenPlans)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Error parsing plans: %v", err)
+		}
+		if !reflect.DeepEqual(got, test.wantPlans) {
+			t.Errorf("Expected plans %#v;\ngot: %#v", test.wantPlans, got)
+		}
+	}
+}
@@ -12,6 +12,10 @@ import (
 type RiakHost struct {
 	Host       string `json:"host"`
 	ServerName string `json:"server_name,omitempty"`
+	// SSHHost and SSHPort override the ssh address of the node for riak-admin
+	// commands, host and SSH_PORT are used if blank
+	SSHHost string `json:"ssh_host,omitempty"`
+	SSHPort int    `json:"ssh_port,omitempty"`
 }
 
 // Riak holds riak configuration
@@ -25,7 +29,9 @@ type Riak struct {
 	//		  "server_name": "c1"
 	//		},
 	//		{
-	//		  "host": "c2.test.org"
+	//		  "host": "c2.test.org",
+	//		  "ssh_host": "c2-admin.test.org",
+	//		  "ssh_port": 2222
 	//		}
 	//	]
 	RiakHosts string `envconfig:"RIAK_HOSTS"`
@@ -1,6 +1,11 @@
 package config
 
 import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
 	"github.com/NYTimes/gizmo/config"
 	"github.com/Sirupsen/logrus"
 )
@@ -13,21 +18,322 @@ type RiakAPI struct {
 	// RiakAPIPassword is the password used to authenticate against the API service
 	RiakAPIPassword string `envconfig:"RIAKAPI_PASSWORD"`
 
-	// RiakAPISalt is the salt used for the password creation
-	RiakAPISalt string `envconfig:"RIAKAPI_SALT"`
+	// RiakAPICredentials is a json array with the service API users (see
+	// Credential), they are added to RIAKAPI_USERNAME (all the scopes)
+	// Example:
+	//	[
+	//		{"name": "tsuru-prod", "hash": "$2a$10$...", "scopes": ["tsuru"]},
+	//		{"name": "ops", "hash": "$2a$10$...", "scopes": ["admin"]}
+	//	]
+	RiakAPICredentials string `envconfig:"RIAKAPI_CREDENTIALS"`
+	// RiakAPICredentialsPath path to the credentials json file (alternative to
+	// RIAKAPI_CREDENTIALS)
+	RiakAPICredentialsPath string `envconfig:"RIAKAPI_CREDENTIALS_PATH"`
+
+	// RiakAPIPasswordKeys are the keys the stored user passwords are encrypted
+	// with, comma separated 'id:base64 key' (32 bytes AES-256 keys). The first
+	// one encrypts, all of them decrypt (key rotation)
+	RiakAPIPasswordKeys string `envconfig:"RIAKAPI_PASSWORD_KEYS"`
+	// RiakAPIPasswordKeysPath path to the password keys file (alternative to
+	// RIAKAPI_PASSWORD_KEYS), one key per line
+	RiakAPIPasswordKeysPath string `envconfig:"RIAKAPI_PASSWORD_KEYS_PATH"`
+	// RiakAPIPasswordPlaintext allows storing the user passwords unencrypted
+	// when there aren't password keys, the service doesn't start otherwise
+	RiakAPIPasswordPlaintext bool `envconfig:"RIAKAPI_PASSWORD_PLAINTEXT"`
+
+	// RiakAPIClientCA is the CA certificate (PEM) the app client certificates are
+	// signed with, riak has to trust it. If set the apps authenticate with
+	// certificates instead of passwords
+	RiakAPIClientCA string `envconfig:"RIAKAPI_CLIENT_CA"`
+	// RiakAPIClientCAPath path to the client CA certificate (alternative to
+	// RIAKAPI_CLIENT_CA)
+	RiakAPIClientCAPath string `envconfig:"RIAKAPI_CLIENT_CA_PATH"`
+	// RiakAPIClientCAKey is the private key (PEM) of the client CA
+	RiakAPIClientCAKey string `envconfig:"RIAKAPI_CLIENT_CA_KEY"`
+	// RiakAPIClientCAKeyPath path to the client CA private key (alternative to
+	// RIAKAPI_CLIENT_CA_KEY)
+	RiakAPIClientCAKeyPath string `envconfig:"RIAKAPI_CLIENT_CA_KEY_PATH"`
+	// RiakAPIClientCertTTL is the number of days the client certificates are
+	// valid. default 365
+	RiakAPIClientCertTTL int `envconfig:"RIAKAPI_CLIENT_CERT_TTL"`
+	// RiakAPICRLURL is the URL of the riakapi '/crl' endpoint, set on the client
+	// certificates so riak checks the revoked certificates
+	RiakAPICRLURL string `envconfig:"RIAKAPI_CRL_URL"`
+
+	// RiakAPIPurgeBatchSize is the number of keys deleted on each batch when purging a removed instance
+	RiakAPIPurgeBatchSize int `envconfig:"RIAKAPI_PURGE_BATCH_SIZE"`
+
+	// RiakAPIPurgeBatchInterval is the time in milliseconds to wait between purge batches
+	RiakAPIPurgeBatchInterval int `envconfig:"RIAKAPI_PURGE_BATCH_INTERVAL"`
+
+	// RiakAPIAdminExecutor selects where riak-admin commands are run: 'ssh' (on
+	// SSH_HOST), 'local' (riakapi running on a riak node) or 'memory' (not run,
+	// only recorded). default 'ssh'
+	RiakAPIAdminExecutor string `envconfig:"RIAKAPI_ADMIN_EXECUTOR"`
+
+	// RiakAPIRequestTimeout is the maximum number of seconds a service API request
+	// takes, the riak operations in progress are cancelled after it. default 60
+	RiakAPIRequestTimeout int `envconfig:"RIAKAPI_REQUEST_TIMEOUT"`
+	// RiakAPIAdminTimeout is the maximum number of seconds a riak-admin command
+	// takes, the command is killed after it. default 30
+	RiakAPIAdminTimeout int `envconfig:"RIAKAPI_ADMIN_TIMEOUT"`
+	// RiakAPIRiakTimeout is the maximum number of seconds a riak key/value operation
+	// takes. default 5
+	RiakAPIRiakTimeout int `envconfig:"RIAKAPI_RIAK_TIMEOUT"`
+	// RiakAPIListTimeout is the maximum number of seconds listing keys takes
+	// (listing instances and counting bucket keys). default 10
+	RiakAPIListTimeout int `envconfig:"RIAKAPI_LIST_TIMEOUT"`
+
+	// RiakAPIRetryAttempts is the number of times a riak or riak-admin operation
+	// is tried when it fails with a transient error, 1 doesn't retry. default 3
+	RiakAPIRetryAttempts int `envconfig:"RIAKAPI_RETRY_ATTEMPTS"`
+	// RiakAPIRetryBackoff is the time in milliseconds to wait after the first
+	// failed attempt, doubled on each retry. default 100
+	RiakAPIRetryBackoff int `envconfig:"RIAKAPI_RETRY_BACKOFF"`
+	// RiakAPIRetryMaxBackoff is the maximum time in milliseconds to wait between
+	// attempts. default 2000
+	RiakAPIRetryMaxBackoff int `envconfig:"RIAKAPI_RETRY_MAX_BACKOFF"`
+	// RiakAPIRetryJitter is the percentage of the wait between attempts that is
+	// randomized. default 20
+	RiakAPIRetryJitter int `envconfig:"RIAKAPI_RETRY_JITTER"`
+
+	// RiakAPILockTTL is the number of seconds a user or bucket lock lasts if
+	// the replica holding it crashes. default 60
+	RiakAPILockTTL int `envconfig:"RIAKAPI_LOCK_TTL"`
+	// RiakAPILockBucketType is the bucket type of the locks bucket, a strongly
+	// consistent one makes the locks exclusive. default the default bucket type
+	RiakAPILockBucketType string `envconfig:"RIAKAPI_LOCK_BUCKET_TYPE"`
+
+	// RiakAPIPlans is a json array with the available plans (see Plan)
+	// Example:
+	//	[
+	//		{
+	//		  "name": "tsuru-counter",
+	//		  "description": "Counters replicated 5 times",
+	//		  "datatype": "counter",
+	//		  "props": {"n_val": 5, "allow_mult": true}
+	//		},
+	//		{
+	//		  "name": "tsuru-kv",
+	//		  "description": "Key/value with bitcask backend",
+	//		  "props": {"backend": "bitcask_mult", "write_once": true}
+	//		}
+	//	]
+	RiakAPIPlans string `envconfig:"RIAKAPI_PLANS"`
+	// RiakAPIPlansPath path to the plans json file (alternative to RIAKAPI_PLANS)
+	RiakAPIPlansPath string `envconfig:"RIAKAPI_PLANS_PATH"`
+
+	// Plans is a custom attr with the plans loaded from the configuration
+	Plans []*Plan
+
+	// PasswordKeys is a custom attr with the password keys loaded from the
+	// configuration
+	PasswordKeys []*PasswordKey
+
+	// Credentials is a custom attr with the service API users loaded from the
+	// configuration, the service security is disabled without them
+	Credentials Credentials
+}
+
+// PasswordKey is a key of the stored passwords encryption
+type PasswordKey struct {
+	// ID identifies the key a password was encrypted with
+	ID string
+	// Key is the AES-256 key
+	Key []byte
 }
 
 // LoadRiakAPIConfigFromEnv loads the riakapi service configuration from the env
 func (r *RiakAPI) LoadRiakAPIConfigFromEnv(riakCfg *Riak) {
 	config.LoadEnvConfig(r)
 
-	// Warn if salt is disabled
-	if r.RiakAPISalt == "" {
-		logrus.Warning("'RIAKAPI_SALT' not set, not salting the passwords")
+	if r.RiakAPIAdminExecutor == "" {
+		r.RiakAPIAdminExecutor = "ssh"
+	}
+
+	if r.RiakAPIPurgeBatchSize <= 0 {
+		r.RiakAPIPurgeBatchSize = 100
+	}
+
+	if r.RiakAPIPurgeBatchInterval <= 0 {
+		r.RiakAPIPurgeBatchInterval = 1000
+	}
+
+	if r.RiakAPIRequestTimeout <= 0 {
+		r.RiakAPIRequestTimeout = 60
+	}
+
+	if r.RiakAPIAdminTimeout <= 0 {
+		r.RiakAPIAdminTimeout = 30
+	}
+
+	if r.RiakAPIRiakTimeout <= 0 {
+		r.RiakAPIRiakTimeout = 5
+	}
+
+	if r.RiakAPIListTimeout <= 0 {
+		r.RiakAPIListTimeout = 10
+	}
+
+	if r.RiakAPIRetryAttempts <= 0 {
+		r.RiakAPIRetryAttempts = 3
+	}
+
+	if r.RiakAPIRetryBackoff <= 0 {
+		r.RiakAPIRetryBackoff = 100
+	}
+
+	if r.RiakAPIRetryMaxBackoff <= 0 {
+		r.RiakAPIRetryMaxBackoff = 2000
+	}
+
+	if r.RiakAPIRetryJitter <= 0 || r.RiakAPIRetryJitter > 100 {
+		r.RiakAPIRetryJitter = 20
+	}
+
+	if r.RiakAPILockTTL <= 0 {
+		r.RiakAPILockTTL = 60
+	}
+
+	if r.RiakAPIPlansPath != "" {
+		data, err := ioutil.ReadFile(r.RiakAPIPlansPath)
+		if err != nil {
+			logrus.Fatalf("Error reading plans: %v", err)
+		}
+		r.RiakAPIPlans = string(data)
+	}
+
+	if r.RiakAPIPlans == "" {
+		logrus.Info("'RIAKAPI_PLANS' not set, using default plans")
+		r.Plans = DefaultPlans
+	} else {
+		plans, err := parsePlans([]byte(r.RiakAPIPlans))
+		if err != nil {
+			logrus.Fatalf("Wrong RIAKAPI_PLANS format: %v", err)
+		}
+		r.Plans = plans
+	}
+
+	if r.RiakAPIPasswordKeysPath != "" {
+		data, err := ioutil.ReadFile(r.RiakAPIPasswordKeysPath)
+		if err != nil {
+			logrus.Fatalf("Error reading password keys: %v", err)
+		}
+		r.RiakAPIPasswordKeys = string(data)
+	}
+
+	keys, err := loadPasswordKeys(r.RiakAPIPasswordKeys, r.RiakAPIPasswordPlaintext)
+	if err != nil {
+		logrus.Fatalf("Wrong RIAKAPI_PASSWORD_KEYS: %v", err)
+	}
+	r.PasswordKeys = keys
+	if len(keys) == 0 {
+		logrus.Warning("'RIAKAPI_PASSWORD_PLAINTEXT' set, user passwords are stored unencrypted")
+	}
+
+	if r.RiakAPIClientCAPath != "" {
+		data, err := ioutil.ReadFile(r.RiakAPIClientCAPath)
+		if err != nil {
+			logrus.Fatalf("Error reading client CA: %v", err)
+		}
+		r.RiakAPIClientCA = string(data)
+	}
+
+	if r.RiakAPIClientCAKeyPath != "" {
+		data, err := ioutil.ReadFile(r.RiakAPIClientCAKeyPath)
+		if err != nil {
+			logrus.Fatalf("Error reading client CA key: %v", err)
+		}
+		r.RiakAPIClientCAKey = string(data)
+	}
+
+	if r.RiakAPIClientCertTTL <= 0 {
+		r.RiakAPIClientCertTTL = 365
+	}
+
+	if r.RiakAPIClientCA != "" && r.RiakAPICRLURL == "" {
+		logrus.Warning("'RIAKAPI_CRL_URL' not set, riak can't check the revoked client certificates")
+	}
+
+	if r.RiakAPICredentialsPath != "" {
+		data, err := ioutil.ReadFile(r.RiakAPICredentialsPath)
+		if err != nil {
+			logrus.Fatalf("Error reading credentials: %v", err)
+		}
+		r.RiakAPICredentials = string(data)
+	}
+
+	r.Credentials = Credentials{}
+	if r.RiakAPICredentials != "" {
+		creds, err := parseCredentials([]byte(r.RiakAPICredentials))
+		if err != nil {
+			logrus.Fatalf("Wrong RIAKAPI_CREDENTIALS format: %v", err)
+		}
+		r.Credentials = creds
+	}
+
+	// The legacy credential can access all the APIs
+	if r.RiakAPIPassword != "" {
+		for _, c := range r.Credentials {
+			if c.Name == r.RiakAPIUsername {
+				logrus.Fatalf("Credential '%s' is duplicated on RIAKAPI_USERNAME and RIAKAPI_CREDENTIALS", c.Name)
+			}
+		}
+		r.Credentials = append(r.Credentials, &Credential{
+			Name:     r.RiakAPIUsername,
+			Scopes:   []string{ScopeTsuru, ScopeAdmin},
+			password: r.RiakAPIPassword,
+		})
 	}
 
 	// Warn if security is disabled
-	if r.RiakAPIPassword == "" {
-		logrus.Warning("'RIAKAPI_PASSWORD' not set, service security is disabled")
+	if len(r.Credentials) == 0 {
+		logrus.Warning("'RIAKAPI_PASSWORD' and 'RIAKAPI_CREDENTIALS' not set, service security is disabled")
+	}
+}
+
+// loadPasswordKeys parses the password keys, without keys the passwords would
+// be stored unencrypted so they are required unless plaintext is allowed
+func loadPasswordKeys(s string, plaintext bool) ([]*PasswordKey, error) {
+	keys, err := parsePasswordKeys(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 && !plaintext {
+		return nil, fmt.Errorf("not set, set 'RIAKAPI_PASSWORD_PLAINTEXT=true' to store the user passwords unencrypted")
+	}
+	return keys, nil
+}
+
+// parsePasswordKeys parses the 'id:base64 key' keys separated by commas or new
+// lines, the ids can't be repeated
+func parsePasswordKeys(s string) ([]*PasswordKey, error) {
+	keys := []*PasswordKey{}
+	ids := map[string]bool{}
+	for _, k := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '\n' }) {
+		if k = strings.TrimSpace(k); k == "" {
+			continue
+		}
+
+		parts := strings.SplitN(k, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("key should be 'id:base64 key'")
+		}
+		id := parts[0]
+		if ids[id] {
+			return nil, fmt.Errorf("repeated key id '%s'", id)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("key '%s' is not base64: %v", id, err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("key '%s' should be 32 bytes, it's %d", id, len(key))
+		}
+
+		ids[id] = true
+		keys = append(keys, &PasswordKey{ID: id, Key: key})
 	}
+	return keys, nil
 }
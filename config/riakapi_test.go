@@ -0,0 +1,92 @@
+package config
+
+import (
+	"bytes"
+	"encoding/base64"
+	"reflect"
+	"testing"
+)
+
+func TestParsePasswordKeys(t *testing.T) {
+	key1 := bytes.Repeat([]byte{1}, 32)
+	key2 := bytes.Repeat([]byte{2}, 32)
+	b64 := base64.StdEncoding.EncodeToString
+
+	tests := []struct {
+		givenKeys string
+
+		wantKeys  []*PasswordKey
+		wantError bool
+	}{
+		{givenKeys: "", wantKeys: []*PasswordKey{}},
+		{
+			givenKeys: "k2:" + b64(key2) + ",k1:" + b64(key1),
+			wantKeys:  []*PasswordKey{{ID: "k2", Key: key2}, {ID: "k1", Key: key1}},
+		},
+		{ // Keys file, one per line
+			givenKeys: "k2:" + b64(key2) + "\n k1:" + b64(key1) + "\n",
+			wantKeys:  []*PasswordKey{{ID: "k2", Key: key2}, {ID: "k1", Key: key1}},
+		},
+		{givenKeys: b64(key1), wantError: true},
+		{givenKeys: ":" + b64(key1), wantError: true},
+		{givenKeys: "k1:not base64!", wantError: true},
+		{givenKeys: "k1:" + b64(key1[:16]), wantError: true},
+		{givenKeys: "k1:" + b64(key1) + ",k1:" + b64(key2), wantError: true},
+	}
+
+	for _, test := range tests {
+		got, err := parsePasswordKeys(test.givenKeys)
+		if test.wantError {
+			if err == nil {
+				t.Errorf("Expected error parsing %s", test.givenKeys)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Error parsing %s: %v", test.givenKeys, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.wantKeys) {
+			t.Errorf("Expected keys %#v;\ngot: %#v", test.wantKeys, got)
+		}
+	}
+}
+
+func TestLoadPasswordKeys(t *testing.T) {
+	key1 := bytes.Repeat([]byte{1}, 32)
+	b64 := base64.StdEncoding.EncodeToString
+
+	tests := []struct {
+		givenKeys      string
+		givenPlaintext bool
+
+		wantKeys  []*PasswordKey
+		wantError bool
+	}{
+		{givenKeys: "k1:" + b64(key1), wantKeys: []*PasswordKey{{ID: "k1", Key: key1}}},
+		{givenKeys: "k1:" + b64(key1), givenPlaintext: true, wantKeys: []*PasswordKey{{ID: "k1", Key: key1}}},
+		{givenKeys: "", givenPlaintext: true, wantKeys: []*PasswordKey{}},
+		{ // Plaintext passwords need the explicit opt-out
+			givenKeys: "",
+			wantError: true,
+		},
+		{givenKeys: "k1:not base64!", givenPlaintext: true, wantError: true},
+	}
+
+	for _, test := range tests {
+		got, err := loadPasswordKeys(test.givenKeys, test.givenPlaintext)
+		if test.wantError {
+			if err == nil {
+				t.Errorf("Expected error loading '%s' (plaintext %t)", test.givenKeys, test.givenPlaintext)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Error loading '%s': %v", test.givenKeys, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.wantKeys) {
+			t.Errorf("Expected keys %#v;\ngot: %#v", test.wantKeys, got)
+		}
+	}
+}
@@ -1,12 +1,26 @@
 package config
 
 import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 
 	"github.com/NYTimes/gizmo/config"
 	"github.com/Sirupsen/logrus"
 )
 
+// SSHNode is a node where riak-admin commands can be run through ssh
+type SSHNode struct {
+	Host string
+	Port int
+}
+
 // SSH holds SSH configuration
 type SSH struct {
 	// SSHHost is the host where ssh will connect to execute riak-admin commands
@@ -20,8 +34,35 @@ type SSH struct {
 	// SSHPrivateKey is the private key which ssh will connect to execute riak-admin commands
 	SSHPrivateKey string `envconfig:"SSH_PRIVATE_KEY"`
 
+	// SSHKnownHostsPath is the path of a known_hosts file with the riak nodes host keys
+	SSHKnownHostsPath string `envconfig:"SSH_KNOWN_HOSTS_PATH"`
+	// SSHKnownHosts known_hosts content (alternative to SSH_KNOWN_HOSTS_PATH)
+	SSHKnownHosts string `envconfig:"SSH_KNOWN_HOSTS"`
+	// SSHHostKeyFingerprints comma separated list of the accepted host keys
+	// fingerprints (SHA256:... as ssh-keygen -l shows them)
+	SSHHostKeyFingerprints string `envconfig:"SSH_HOST_KEY_FINGERPRINTS"`
+	// SSHInsecureHostKey accepts any host key (we should be sure no MitM attacks are possible)
+	SSHInsecureHostKey int `envconfig:"SSH_INSECURE_HOST_KEY"`
+
+	// SSHKeepaliveInterval is the number of seconds between keepalives, they
+	// detect broken connections so they are dialed again. default 30
+	SSHKeepaliveInterval int `envconfig:"SSH_KEEPALIVE_INTERVAL"`
+	// SSHMaxSessions is the maximum of concurrent riak-admin commands, should be
+	// below the ssh server MaxSessions. default 8
+	SSHMaxSessions int `envconfig:"SSH_MAX_SESSIONS"`
+	// SSHDialAttempts is the number of connection attempts (with backoff) before
+	// failing a riak-admin command. default 3
+	SSHDialAttempts int `envconfig:"SSH_DIAL_ATTEMPTS"`
+
+	// SSHNodes internal variable with the nodes where riak-admin can be run, in
+	// failover order: SSH_HOST (if set) and the cluster hosts
+	SSHNodes []*SSHNode
+
 	// SSHAuthMethods internal variable with the ssh auth methods prepared based on the settings provided
 	SSHAuthMethods []ssh.AuthMethod
+	// SSHHostKeyCallback internal variable with the host key verification prepared
+	// based on the known hosts and fingerprints provided
+	SSHHostKeyCallback ssh.HostKeyCallback
 }
 
 // getAuthMethods returns the correct auth methods based on the password or private key
@@ -49,6 +90,7 @@ func (s *SSH) getAuthMethods() []ssh.AuthMethod {
 // LoadSSHConfigFromEnv Loads SSH env and populates to default ones
 func (s *SSH) LoadSSHConfigFromEnv(riakCfg *Riak) {
 	config.LoadEnvConfig(s)
+	explicitHost := s.SSHHost
 	if s.SSHHost == "" {
 		// if no host then use the first riak host, if not then localhost
 		if len(riakCfg.RiakClusterHosts) > 0 {
@@ -60,5 +102,132 @@ func (s *SSH) LoadSSHConfigFromEnv(riakCfg *Riak) {
 	if s.SSHPort == 0 {
 		s.SSHPort = 22
 	}
+	if s.SSHKeepaliveInterval <= 0 {
+		s.SSHKeepaliveInterval = 30
+	}
+	if s.SSHMaxSessions <= 0 {
+		s.SSHMaxSessions = 8
+	}
+	if s.SSHDialAttempts <= 0 {
+		s.SSHDialAttempts = 3
+	}
+	s.SSHNodes = sshNodes(explicitHost, s.SSHHost, s.SSHPort, riakCfg.RiakClusterHosts)
 	s.SSHAuthMethods = s.getAuthMethods()
+
+	callback, err := s.getHostKeyCallback()
+	if err != nil {
+		logrus.Fatalf("Error loading ssh host keys: %v", err)
+	}
+	s.SSHHostKeyCallback = callback
+}
+
+// getHostKeyCallback returns the host key verification based on the known hosts
+// and the pinned fingerprints, a host key is accepted if any of them accepts it.
+// Without host keys every connection is rejected unless SSH_INSECURE_HOST_KEY is set
+func (s *SSH) getHostKeyCallback() (ssh.HostKeyCallback, error) {
+	if s.SSHInsecureHostKey != 0 {
+		logrus.Warning("SSH host keys will not be verified")
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+
+	var callbacks []ssh.HostKeyCallback
+	if s.SSHKnownHostsPath != "" || s.SSHKnownHosts != "" {
+		callback, err := knownHostsCallback(s.SSHKnownHostsPath, s.SSHKnownHosts)
+		if err != nil {
+			return nil, err
+		}
+		callbacks = append(callbacks, callback)
+	}
+	if s.SSHHostKeyFingerprints != "" {
+		callbacks = append(callbacks, fingerprintsCallback(strings.Split(s.SSHHostKeyFingerprints, ",")))
+	}
+
+	if len(callbacks) == 0 {
+		logrus.Warning("No ssh host keys present, ssh connections will be rejected")
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if len(callbacks) == 0 {
+			return errors.New("ssh host key not verified, no known hosts nor fingerprints configured")
+		}
+		var err error
+		for _, c := range callbacks {
+			if err = c(hostname, remote, key); err == nil {
+				return nil
+			}
+		}
+		return err
+	}, nil
+}
+
+// knownHostsCallback verifies the host keys with the known_hosts file and content
+func knownHostsCallback(path, content string) (ssh.HostKeyCallback, error) {
+	files := []string{}
+	if path != "" {
+		files = append(files, path)
+	}
+
+	// knownhosts only reads files, the content is read from a temporary one
+	if content != "" {
+		f, err := ioutil.TempFile("", "riakapi-known-hosts")
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(f.Name())
+		_, err = f.WriteString(content)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f.Name())
+	}
+	return knownhosts.New(files...)
+}
+
+// fingerprintsCallback verifies the host keys with the pinned fingerprints
+func fingerprintsCallback(fingerprints []string) ssh.HostKeyCallback {
+	pinned := map[string]bool{}
+	for _, f := range fingerprints {
+		if f = strings.TrimSpace(f); f != "" {
+			pinned[f] = true
+		}
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		fingerprint := ssh.FingerprintSHA256(key)
+		if !pinned[fingerprint] {
+			return fmt.Errorf("ssh host key %s of '%s' is not pinned", fingerprint, hostname)
+		}
+		return nil
+	}
+}
+
+// sshNodes returns the riak-admin nodes in failover order, the explicit ssh host
+// first and then all the cluster nodes (with their ssh overrides)
+func sshNodes(explicitHost, defaultHost string, port int, cluster []*RiakHost) []*SSHNode {
+	nodes := []*SSHNode{}
+	present := map[SSHNode]bool{}
+	add := func(n SSHNode) {
+		if !present[n] {
+			present[n] = true
+			nodes = append(nodes, &n)
+		}
+	}
+
+	if explicitHost != "" {
+		add(SSHNode{Host: explicitHost, Port: port})
+	}
+	for _, h := range cluster {
+		n := SSHNode{Host: h.Host, Port: port}
+		if h.SSHHost != "" {
+			n.Host = h.SSHHost
+		}
+		if h.SSHPort != 0 {
+			n.Port = h.SSHPort
+		}
+		add(n)
+	}
+	if len(nodes) == 0 {
+		add(SSHNode{Host: defaultHost, Port: port})
+	}
+	return nodes
 }
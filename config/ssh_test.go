@@ -0,0 +1,92 @@
+package config
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSHNodes(t *testing.T) {
+	tests := []struct {
+		givenExplicitHost string
+		givenCluster      []*RiakHost
+
+		wantNodes []*SSHNode
+	}{
+		{
+			givenCluster: []*RiakHost{{Host: "c1.test.org"}, {Host: "c2.test.org", SSHHost: "c2-admin.test.org", SSHPort: 2222}},
+			wantNodes:    []*SSHNode{{Host: "c1.test.org", Port: 22}, {Host: "c2-admin.test.org", Port: 2222}},
+		},
+		{
+			givenExplicitHost: "admin.test.org",
+			givenCluster:      []*RiakHost{{Host: "c1.test.org"}, {Host: "admin.test.org"}},
+			wantNodes:         []*SSHNode{{Host: "admin.test.org", Port: 22}, {Host: "c1.test.org", Port: 22}},
+		},
+		{
+			wantNodes: []*SSHNode{{Host: "127.0.0.1", Port: 22}},
+		},
+	}
+
+	for _, test := range tests {
+		got := sshNodes(test.givenExplicitHost, "127.0.0.1", 22, test.givenCluster)
+		if !reflect.DeepEqual(got, test.wantNodes) {
+			t.Errorf("Expected nodes %v;\ngot: %v", test.wantNodes, got)
+		}
+	}
+}
+
+func TestHostKeyCallback(t *testing.T) {
+	newKey := func() ssh.PublicKey {
+		pub, _, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatalf("Error generating key: %v", err)
+		}
+		key, err := ssh.NewPublicKey(pub)
+		if err != nil {
+			t.Fatalf("Error generating key: %v", err)
+		}
+		return key
+	}
+	known, pinned, other := newKey(), newKey(), newKey()
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22}
+	knownHosts := fmt.Sprintf("c1.test.org %s", ssh.MarshalAuthorizedKey(known))
+
+	tests := []struct {
+		givenSSH *SSH
+		givenKey ssh.PublicKey
+
+		wantError bool
+	}{
+		{givenSSH: &SSH{SSHKnownHosts: knownHosts}, givenKey: known},
+		{givenSSH: &SSH{SSHKnownHosts: knownHosts}, givenKey: other, wantError: true},
+		{givenSSH: &SSH{SSHHostKeyFingerprints: "SHA256:x, " + ssh.FingerprintSHA256(pinned)}, givenKey: pinned},
+		{givenSSH: &SSH{SSHHostKeyFingerprints: ssh.FingerprintSHA256(pinned)}, givenKey: other, wantError: true},
+		{givenSSH: &SSH{SSHKnownHosts: knownHosts, SSHHostKeyFingerprints: ssh.FingerprintSHA256(pinned)}, givenKey: pinned},
+		{givenSSH: &SSH{}, givenKey: known, wantError: true},
+		{givenSSH: &SSH{SSHInsecureHostKey: 1}, givenKey: other},
+	}
+
+	for _, test := range tests {
+		callback, err := test.givenSSH.getHostKeyCallback()
+		if err != nil {
+			t.Errorf("Error creating host key callback: %v", err)
+			continue
+		}
+		err = callback("c1.test.org:22", addr, test.givenKey)
+		if test.wantError && err == nil {
+			t.Errorf("Expected host key rejected with %+v", test.givenSSH)
+		}
+		if !test.wantError && err != nil {
+			t.Errorf("Expected host key accepted with %+v; got: %v", test.givenSSH, err)
+		}
+	}
+
+	if _, err := (&SSH{SSHKnownHostsPath: "/not/present/known_hosts"}).getHostKeyCallback(); err == nil {
+		t.Errorf("Expected error with missing known_hosts file")
+	}
+}
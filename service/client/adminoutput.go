@@ -0,0 +1,378 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+)
+
+// BucketTypeState is a bucket type of the riak-admin bucket-type list output
+type BucketTypeState struct {
+	Name   string
+	Active bool
+}
+
+// BucketTypeStatus is the riak-admin bucket-type status output
+type BucketTypeStatus struct {
+	Name   string
+	Active bool
+	// Props are the bucket type properties as riak-admin prints them
+	Props map[string]string
+}
+
+// SecurityUser is a user of the riak-admin security print-users output
+type SecurityUser struct {
+	Name     string
+	MemberOf []string
+	Options  string
+}
+
+// SecurityGrant is a permissions row of the riak-admin security print-grants output
+type SecurityGrant struct {
+	// Role is the group the permissions are inherited from, blank on dedicated
+	// and cumulative permissions
+	Role        string
+	BucketType  string
+	Bucket      string
+	Permissions []string
+}
+
+// UserGrants is the riak-admin security print-grants output
+type UserGrants struct {
+	// Inherited are the permissions of the user groups
+	Inherited []*SecurityGrant
+	// Dedicated are the permissions granted to the user
+	Dedicated []*SecurityGrant
+	// Cumulative are all the permissions the user has
+	Cumulative []*SecurityGrant
+}
+
+// SecuritySource is a source of the riak-admin security print-sources output
+type SecuritySource struct {
+	Users   []string
+	CIDR    string
+	Source  string
+	Options string
+}
+
+// ClusterMember is a node of the riak-admin member-status output
+type ClusterMember struct {
+	Node    string
+	Status  string
+	Ring    string
+	Pending string
+}
+
+// adminTable is a table of the riak-admin output, title is the text line above it
+type adminTable struct {
+	title  string
+	header []string
+	rows   [][]string
+}
+
+// parseAdminTables parses the ascii tables of the riak-admin security commands.
+// Long cells are wrapped on rows with the first cell blank, they are joined to
+// the previous row
+func parseAdminTables(out []byte) []*adminTable {
+	tables := []*adminTable{}
+	var table *adminTable
+	title := ""
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "+"):
+			if table == nil {
+				table = &adminTable{title: title}
+				tables = append(tables, table)
+			}
+		case strings.HasPrefix(line, "|") && table != nil:
+			cells := strings.Split(strings.Trim(line, "|"), "|")
+			for i, c := range cells {
+				cells[i] = strings.TrimSpace(c)
+			}
+
+			switch {
+			case table.header == nil:
+				table.header = cells
+			case cells[0] == "" && len(table.rows) > 0:
+				prev := table.rows[len(table.rows)-1]
+				for i := 0; i < len(cells) && i < len(prev); i++ {
+					prev[i] += cells[i]
+				}
+			default:
+				table.rows = append(table.rows, cells)
+			}
+		default:
+			title = line
+			table = nil
+		}
+	}
+	return tables
+}
+
+// column returns the row cell of the header column, blank if missing
+func (t *adminTable) column(row []string, name string) string {
+	for i, h := range t.header {
+		if h == name && i < len(row) {
+			return row[i]
+		}
+	}
+	return ""
+}
+
+// splitList splits the comma separated cells
+func splitList(cell string) []string {
+	items := []string{}
+	for _, i := range strings.Split(cell, ",") {
+		if i = strings.TrimSpace(i); i != "" {
+			items = append(items, i)
+		}
+	}
+	return items
+}
+
+// parseBucketTypeList parses the bucket-type list output, one 'name (active)'
+// or 'name (not active)' line per bucket type
+func parseBucketTypeList(out []byte) ([]*BucketTypeState, error) {
+	types := []*BucketTypeState{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		i := strings.LastIndex(line, " (")
+		if i <= 0 || !strings.HasSuffix(line, ")") {
+			return nil, fmt.Errorf("unexpected bucket-type list line: %s", line)
+		}
+		types = append(types, &BucketTypeState{
+			Name:   line[:i],
+			Active: line[i+2:len(line)-1] == "active",
+		})
+	}
+	return types, nil
+}
+
+// parseBucketTypeStatus parses the bucket-type status output, a 'name is active'
+// or 'name is not active' line followed by 'prop: value' lines
+func parseBucketTypeStatus(out []byte) (*BucketTypeStatus, error) {
+	status := &BucketTypeStatus{Props: map[string]string{}}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if status.Name == "" {
+			switch {
+			case strings.HasSuffix(line, " is not active"):
+				status.Name = strings.TrimSuffix(line, " is not active")
+			case strings.HasSuffix(line, " is active"):
+				status.Name = strings.TrimSuffix(line, " is active")
+				status.Active = true
+			default:
+				return nil, fmt.Errorf("unexpected bucket-type status: %s", line)
+			}
+			continue
+		}
+
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("unexpected bucket-type property: %s", line)
+		}
+		status.Props[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+
+	if status.Name == "" {
+		return nil, fmt.Errorf("empty bucket-type status")
+	}
+	return status, nil
+}
+
+// parsePrintUsers parses the security print-users output
+func parsePrintUsers(out []byte) []*SecurityUser {
+	users := []*SecurityUser{}
+	for _, t := range parseAdminTables(out) {
+		for _, r := range t.rows {
+			users = append(users, &SecurityUser{
+				Name:     t.column(r, "username"),
+				MemberOf: splitList(t.column(r, "member of")),
+				Options:  t.column(r, "options"),
+			})
+		}
+	}
+	return users
+}
+
+// parsePrintGrants parses the security print-grants output, a table for each of
+// the inherited, dedicated and cumulative permissions (missing if empty)
+func parsePrintGrants(out []byte) *UserGrants {
+	grants := &UserGrants{}
+	for _, t := range parseAdminTables(out) {
+		var section *[]*SecurityGrant
+		switch {
+		case strings.HasPrefix(t.title, "Inherited"):
+			section = &grants.Inherited
+		case strings.HasPrefix(t.title, "Dedicated"):
+			section = &grants.Dedicated
+		case strings.HasPrefix(t.title, "Cumulative"):
+			section = &grants.Cumulative
+		default:
+			continue
+		}
+
+		for _, r := range t.rows {
+			*section = append(*section, &SecurityGrant{
+				Role:        t.column(r, "role"),
+				BucketType:  t.column(r, "type"),
+				Bucket:      t.column(r, "bucket"),
+				Permissions: splitList(t.column(r, "grants")),
+			})
+		}
+	}
+	return grants
+}
+
+// parsePrintSources parses the security print-sources output
+func parsePrintSources(out []byte) []*SecuritySource {
+	sources := []*SecuritySource{}
+	for _, t := range parseAdminTables(out) {
+		for _, r := range t.rows {
+			sources = append(sources, &SecuritySource{
+				Users:   splitList(t.column(r, "users")),
+				CIDR:    t.column(r, "cidr"),
+				Source:  t.column(r, "source"),
+				Options: t.column(r, "options"),
+			})
+		}
+	}
+	return sources
+}
+
+// parseMemberStatus parses the member-status output, the node rows are the ones
+// between the column names and the summary lines
+func parseMemberStatus(out []byte) ([]*ClusterMember, error) {
+	members := []*ClusterMember{}
+	inTable := false
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "Status"):
+			inTable = true
+		case !inTable, line == "", strings.HasPrefix(line, "-"), strings.HasPrefix(line, "="):
+		case strings.HasPrefix(line, "Valid:"):
+			inTable = false
+		default:
+			fields := strings.Fields(line)
+			if len(fields) != 4 {
+				return nil, fmt.Errorf("unexpected member-status line: %s", line)
+			}
+			members = append(members, &ClusterMember{
+				Status:  fields[0],
+				Ring:    fields[1],
+				Pending: fields[2],
+				Node:    strings.Trim(fields[3], "'"),
+			})
+		}
+	}
+
+	if len(members) == 0 {
+		return nil, fmt.Errorf("no members on member-status output")
+	}
+	return members, nil
+}
+
+// hasSource checks the user has the source on the cidr
+func (s *SecuritySource) hasSource(username, cidr, source string) bool {
+	if s.CIDR != cidr || s.Source != source {
+		return false
+	}
+	for _, u := range s.Users {
+		if u == username {
+			return true
+		}
+	}
+	return false
+}
+
+// bucketTypeState returns the bucket type of the bucket-type list, nil if the
+// bucket type doesn't exist
+func (c *Riak) bucketTypeState(ctx context.Context, bucketType string) (*BucketTypeState, error) {
+	out, err := c.admin(ctx, listBucketTypesCmd)
+	if err != nil {
+		return nil, err
+	}
+	types, err := parseBucketTypeList(out)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range types {
+		if t.Name == bucketType {
+			return t, nil
+		}
+	}
+	return nil, nil
+}
+
+// bucketTypeStatus returns the bucket type status and properties
+func (c *Riak) bucketTypeStatus(ctx context.Context, bucketType string) (*BucketTypeStatus, error) {
+	out, err := c.admin(ctx, adminCmd(bucketTypeStatusCmd, bucketType))
+	if err != nil {
+		return nil, err
+	}
+	return parseBucketTypeStatus(out)
+}
+
+// securityUserPresent checks the user exists on riak
+func (c *Riak) securityUserPresent(ctx context.Context, username string) (bool, error) {
+	out, err := c.admin(ctx, printUsersCmd)
+	if err != nil {
+		return false, err
+	}
+	for _, u := range parsePrintUsers(out) {
+		if u.Name == username {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// userGrants returns the user permissions
+func (c *Riak) userGrants(ctx context.Context, username string) (*UserGrants, error) {
+	out, err := c.admin(ctx, adminCmd(printGrantsCmd, username))
+	if err != nil {
+		return nil, err
+	}
+	return parsePrintGrants(out), nil
+}
+
+// securitySourcePresent checks the user has the source on the cidr
+func (c *Riak) securitySourcePresent(ctx context.Context, username, cidr, source string) (bool, error) {
+	out, err := c.admin(ctx, printSourcesCmd)
+	if err != nil {
+		return false, err
+	}
+	for _, s := range parsePrintSources(out) {
+		if s.hasSource(username, cidr, source) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ClusterMembers returns the riak cluster nodes and their membership status
+func (c *Riak) ClusterMembers(ctx context.Context) ([]*ClusterMember, error) {
+	out, err := c.admin(ctx, memberStatusCmd)
+	if err != nil {
+		return nil, err
+	}
+	return parseMemberStatus(out)
+}
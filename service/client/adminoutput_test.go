@@ -0,0 +1,176 @@
+package client
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseBucketTypeList(t *testing.T) {
+	out := "default (active)\ntsuru-counter (active)\ntsuru-set (not active)\n"
+	want := []*BucketTypeState{
+		{Name: "default", Active: true},
+		{Name: "tsuru-counter", Active: true},
+		{Name: "tsuru-set", Active: false},
+	}
+
+	got, err := parseBucketTypeList([]byte(out))
+	if err != nil {
+		t.Errorf("Error parsing bucket types: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected bucket types %v;\ngot: %v", want, got)
+	}
+
+	if _, err := parseBucketTypeList([]byte("Node is not running!\n")); err == nil {
+		t.Errorf("Expected error parsing unknown output")
+	}
+}
+
+func TestParseBucketTypeStatus(t *testing.T) {
+	out := `tsuru-counter is active
+
+young_vclock: 20
+allow_mult: true
+chash_keyfun: {riak_core_util,chash_std_keyfun}
+datatype: counter
+`
+	want := &BucketTypeStatus{
+		Name:   "tsuru-counter",
+		Active: true,
+		Props: map[string]string{
+			"young_vclock": "20",
+			"allow_mult":   "true",
+			"chash_keyfun": "{riak_core_util,chash_std_keyfun}",
+			"datatype":     "counter",
+		},
+	}
+
+	got, err := parseBucketTypeStatus([]byte(out))
+	if err != nil {
+		t.Errorf("Error parsing bucket type status: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected bucket type status %+v;\ngot: %+v", want, got)
+	}
+
+	if _, err := parseBucketTypeStatus([]byte("tsuru-kv is not an existing bucket type\n")); err == nil {
+		t.Errorf("Expected error parsing missing bucket type")
+	}
+}
+
+func TestParsePrintUsers(t *testing.T) {
+	out := `
++--------------------+---------------+----------------------------------------+------------------------------+
+|      username      |   member of   |                password                |           options            |
++--------------------+---------------+----------------------------------------+------------------------------+
+|      riakapi       |     admins    |983e8ae1421574b8733824d4d2ba4e0ab3d8e6f4|              []              |
+|tsuru_myapp.tsuru.io|               |1e05b3ce4d0d2a4b0b4c31f0d6c0f5a6e8b1c9d7|              []              |
++--------------------+---------------+----------------------------------------+------------------------------+
+`
+	want := []*SecurityUser{
+		{Name: "riakapi", MemberOf: []string{"admins"}, Options: "[]"},
+		{Name: "tsuru_myapp.tsuru.io", MemberOf: []string{}, Options: "[]"},
+	}
+
+	if got := parsePrintUsers([]byte(out)); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected users %v;\ngot: %v", want, got)
+	}
+}
+
+func TestParsePrintGrants(t *testing.T) {
+	out := `
+Inherited permissions (user/tsuru_myapp.tsuru.io)
+
++----------+-------------+----------+----------------------------------------+
+|   role   |    type     |  bucket  |                 grants                 |
++----------+-------------+----------+----------------------------------------+
+|  readers |   default   |    *     |              riak_kv.get               |
++----------+-------------+----------+----------------------------------------+
+
+Dedicated permissions (user/tsuru_myapp.tsuru.io)
+
++-------------+----------+----------------------------------------+
+|    type     |  bucket  |                 grants                 |
++-------------+----------+----------------------------------------+
+|tsuru-counter|instance-b|riak_kv.get, riak_kv.put, riak_kv.delete|
+|             |          |, riak_kv.index                         |
++-------------+----------+----------------------------------------+
+
+Cumulative permissions (user/tsuru_myapp.tsuru.io)
+
++-------------+----------+----------------------------------------+
+|    type     |  bucket  |                 grants                 |
++-------------+----------+----------------------------------------+
+|   default   |    *     |              riak_kv.get               |
++-------------+----------+----------------------------------------+
+`
+	want := &UserGrants{
+		Inherited: []*SecurityGrant{
+			{Role: "readers", BucketType: "default", Bucket: "*", Permissions: []string{"riak_kv.get"}},
+		},
+		Dedicated: []*SecurityGrant{
+			{BucketType: "tsuru-counter", Bucket: "instance-b", Permissions: []string{"riak_kv.get", "riak_kv.put", "riak_kv.delete", "riak_kv.index"}},
+		},
+		Cumulative: []*SecurityGrant{
+			{BucketType: "default", Bucket: "*", Permissions: []string{"riak_kv.get"}},
+		},
+	}
+
+	if got := parsePrintGrants([]byte(out)); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected grants %+v;\ngot: %+v", want, got)
+	}
+
+	if got := parsePrintGrants([]byte("")); len(got.Dedicated) != 0 {
+		t.Errorf("Expected no grants; got: %+v", got)
+	}
+}
+
+func TestParsePrintSources(t *testing.T) {
+	out := `
++--------------------------------+------------+----------+----------+
+|             users              |    cidr    |  source  | options  |
++--------------------------------+------------+----------+----------+
+|tsuru_a.tsuru.io, riakapi       | 0.0.0.0/0  | password |    []    |
+|              all               |127.0.0.1/32|  trust   |    []    |
++--------------------------------+------------+----------+----------+
+`
+	want := []*SecuritySource{
+		{Users: []string{"tsuru_a.tsuru.io", "riakapi"}, CIDR: "0.0.0.0/0", Source: "password", Options: "[]"},
+		{Users: []string{"all"}, CIDR: "127.0.0.1/32", Source: "trust", Options: "[]"},
+	}
+
+	got := parsePrintSources([]byte(out))
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected sources %v;\ngot: %v", want, got)
+	}
+	if !got[0].hasSource("riakapi", "0.0.0.0/0", "password") || got[1].hasSource("riakapi", "127.0.0.1/32", "trust") {
+		t.Errorf("Wrong user sources")
+	}
+}
+
+func TestParseMemberStatus(t *testing.T) {
+	out := `================================= Membership ==================================
+Status     Ring    Pending    Node
+-------------------------------------------------------------------------------
+valid      50.0%      --      'riak@10.0.0.1'
+down       50.0%      --      'riak@10.0.0.2'
+-------------------------------------------------------------------------------
+Valid:1 / Leaving:0 / Exiting:0 / Joining:0 / Down:1
+`
+	want := []*ClusterMember{
+		{Node: "riak@10.0.0.1", Status: "valid", Ring: "50.0%", Pending: "--"},
+		{Node: "riak@10.0.0.2", Status: "down", Ring: "50.0%", Pending: "--"},
+	}
+
+	got, err := parseMemberStatus([]byte(out))
+	if err != nil {
+		t.Errorf("Error parsing member status: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected members %v;\ngot: %v", want, got)
+	}
+
+	if _, err := parseMemberStatus([]byte("Node is not running!\n")); err == nil {
+		t.Errorf("Expected error parsing unknown output")
+	}
+}
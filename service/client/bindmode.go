@@ -0,0 +1,124 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	riak "github.com/basho/riak-go-client"
+)
+
+// RiakBindingModesInfoBucket holds the mode of each binding, so the unbinding
+// revokes exactly what was granted
+const RiakBindingModesInfoBucket = "tsuru-binding-modes"
+
+// BindMode is the kind of access an app gets on the instance bucket
+type BindMode string
+
+// Available binding modes
+const (
+	// BindModeReadWrite grants full access to the bucket (default)
+	BindModeReadWrite BindMode = "read-write"
+	// BindModeReadOnly grants only reading the bucket keys
+	BindModeReadOnly BindMode = "read-only"
+	// BindModeAppendOnly grants only storing keys, not deleting nor reading them
+	BindModeAppendOnly BindMode = "append-only"
+)
+
+// bindModePermissions are the riak permissions granted on each binding mode
+var bindModePermissions = map[BindMode][]string{
+	BindModeReadWrite:  {"riak_kv.get", "riak_kv.put", "riak_kv.delete", "riak_kv.index", "riak_kv.list_keys", "riak_kv.list_buckets"},
+	BindModeReadOnly:   {"riak_kv.get", "riak_kv.index", "riak_kv.list_keys"},
+	BindModeAppendOnly: {"riak_kv.put"},
+}
+
+// ParseBindMode returns the binding mode, blank mode is the default read-write
+// mode, not known modes return ErrInvalidParameter
+func ParseBindMode(mode string) (BindMode, error) {
+	if mode == "" {
+		return BindModeReadWrite, nil
+	}
+	m := BindMode(mode)
+	if _, ok := bindModePermissions[m]; !ok {
+		return "", fmt.Errorf("%w: '%s' is not a valid bind mode", ErrInvalidParameter, mode)
+	}
+	return m, nil
+}
+
+// Permissions returns the riak permissions of the mode in riak-admin format
+func (m BindMode) Permissions() string {
+	return strings.Join(bindModePermissions[m], ",")
+}
+
+// bindingModeKey is the key of the binding on the binding modes bucket
+func bindingModeKey(username, bucketName string) string {
+	return fmt.Sprintf("%s/%s", bucketName, username)
+}
+
+// getBindingMode returns the stored mode of a binding, bindings made before the
+// modes were stored are read-write bindings
+func (c *Riak) getBindingMode(ctx context.Context, username, bucketName string) (BindMode, error) {
+	cmd, err := riak.NewFetchValueCommandBuilder().
+		WithBucket(RiakBindingModesInfoBucket).
+		WithKey(bindingModeKey(username, bucketName)).
+		Build()
+	if err != nil {
+		return "", err
+	}
+
+	if err = c.execute(ctx, cmd); err != nil {
+		return "", err
+	}
+
+	fvc, ok := cmd.(*riak.FetchValueCommand)
+	if !ok {
+		return "", errors.New("Could not fetch any value")
+	}
+	if len(fvc.Response.Values) == 0 {
+		return BindModeReadWrite, nil
+	}
+	return ParseBindMode(string(fvc.Response.Values[0].Value))
+}
+
+// saveBindingMode stores the mode of a binding
+func (c *Riak) saveBindingMode(ctx context.Context, username, bucketName string, mode BindMode) error {
+	obj := &riak.Object{
+		ContentType:     "text/plain",
+		Charset:         "utf-8",
+		ContentEncoding: "utf-8",
+		Value:           []byte(mode),
+	}
+
+	cmd, err := riak.NewStoreValueCommandBuilder().
+		WithBucket(RiakBindingModesInfoBucket).
+		WithKey(bindingModeKey(username, bucketName)).
+		WithContent(obj).
+		Build()
+	if err != nil {
+		return fmt.Errorf("Could not store binding mode: %w", err)
+	}
+
+	if err = c.execute(ctx, cmd); err != nil {
+		return fmt.Errorf("Could not store binding mode: %w", err)
+	}
+	logrus.Debugf("User '%s' binding mode on '%s' stored: %s", username, bucketName, mode)
+	return nil
+}
+
+// deleteBindingMode removes the mode of a binding
+func (c *Riak) deleteBindingMode(ctx context.Context, username, bucketName string) error {
+	cmd, err := riak.NewDeleteValueCommandBuilder().
+		WithBucket(RiakBindingModesInfoBucket).
+		WithKey(bindingModeKey(username, bucketName)).
+		Build()
+	if err != nil {
+		return fmt.Errorf("Could not delete binding mode: %w", err)
+	}
+
+	if err = c.execute(ctx, cmd); err != nil {
+		return fmt.Errorf("Could not delete binding mode: %w", err)
+	}
+	return nil
+}
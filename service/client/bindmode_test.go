@@ -0,0 +1,41 @@
+package client
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseBindMode(t *testing.T) {
+	tests := []struct {
+		givenMode string
+
+		wantMode        BindMode
+		wantPermissions string
+		wantError       error
+	}{
+		{givenMode: "", wantMode: BindModeReadWrite, wantPermissions: "riak_kv.get,riak_kv.put,riak_kv.delete,riak_kv.index,riak_kv.list_keys,riak_kv.list_buckets"},
+		{givenMode: "read-write", wantMode: BindModeReadWrite, wantPermissions: "riak_kv.get,riak_kv.put,riak_kv.delete,riak_kv.index,riak_kv.list_keys,riak_kv.list_buckets"},
+		{givenMode: "read-only", wantMode: BindModeReadOnly, wantPermissions: "riak_kv.get,riak_kv.index,riak_kv.list_keys"},
+		{givenMode: "append-only", wantMode: BindModeAppendOnly, wantPermissions: "riak_kv.put"},
+		{givenMode: "write", wantError: ErrInvalidParameter},
+	}
+
+	for _, test := range tests {
+		mode, err := ParseBindMode(test.givenMode)
+		if test.wantError != nil {
+			if !errors.Is(err, test.wantError) {
+				t.Errorf("Expected error %v parsing '%s'; got: %v", test.wantError, test.givenMode, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error parsing '%s': %v", test.givenMode, err)
+		}
+		if mode != test.wantMode {
+			t.Errorf("Expected mode %s; got: %s", test.wantMode, mode)
+		}
+		if mode.Permissions() != test.wantPermissions {
+			t.Errorf("Expected permissions %s; got: %s", test.wantPermissions, mode.Permissions())
+		}
+	}
+}
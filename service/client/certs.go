@@ -0,0 +1,354 @@
+package client
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	riak "github.com/basho/riak-go-client"
+)
+
+// RiakCertsInfoBucket holds the client certificates issued on each binding and
+// the revoked ones
+const RiakCertsInfoBucket = "tsuru-certs"
+
+// revokedCertsKey is the key of the revoked certificates on the certs bucket
+const revokedCertsKey = "revoked"
+
+// revokedCertsLockKey locks the revoked certificates, acquired after the user
+// and bucket locks
+const revokedCertsLockKey = "~certs/revoked"
+
+// Client certificates
+const (
+	certificateSource = "certificate"
+	clientKeyBits     = 2048
+	// crlValidity is the time riak caches the revocation list, a revoked
+	// certificate could be used until then
+	crlValidity = time.Hour
+	// certClockSkew is the time the certificates are valid before issued, so
+	// the nodes with late clocks accept them
+	certClockSkew = 5 * time.Minute
+)
+
+// ErrCertificatesDisabled is returned when the client CA is not configured
+var ErrCertificatesDisabled = errors.New("client certificates not enabled")
+
+// IssuedCert is a client certificate issued to a riak login
+type IssuedCert struct {
+	Serial    string    `json:"serial"`
+	Login     string    `json:"login"`
+	Expires   time.Time `json:"expires"`
+	RevokedAt time.Time `json:"revoked_at,omitempty"`
+}
+
+// CertIssuer issues the client certificates of the riak users, signed by a CA
+// riak trusts. A nil issuer doesn't issue certificates (password auth)
+type CertIssuer struct {
+	ca  *x509.Certificate
+	key crypto.Signer
+	// TTL is the validity of the issued certificates
+	TTL time.Duration
+	// CRLURL is the revocation list distribution point of the certificates
+	CRLURL string
+}
+
+// NewCertIssuer creates the issuer of the CA certificate and key (PEM), nil if
+// there isn't CA
+func NewCertIssuer(caPEM, keyPEM string, ttl time.Duration, crlURL string) (*CertIssuer, error) {
+	if caPEM == "" {
+		return nil, nil
+	}
+
+	block, _ := pem.Decode([]byte(caPEM))
+	if block == nil {
+		return nil, errors.New("Wrong client CA: not PEM")
+	}
+	ca, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Wrong client CA: %v", err)
+	}
+	if !ca.IsCA {
+		return nil, errors.New("Wrong client CA: not a CA certificate")
+	}
+
+	key, err := parsePrivateKey(keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("Wrong client CA key: %v", err)
+	}
+	return &CertIssuer{ca: ca, key: key, TTL: ttl, CRLURL: crlURL}, nil
+}
+
+// parsePrivateKey decodes a PKCS1, EC or PKCS8 PEM private key
+func parsePrivateKey(keyPEM string) (crypto.Signer, error) {
+	block, _ := pem.Decode([]byte(keyPEM))
+	if block == nil {
+		return nil, errors.New("not PEM")
+	}
+	if k, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return k, nil
+	}
+	if k, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return k, nil
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key := k.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case *ecdsa.PrivateKey:
+		return key, nil
+	}
+	return nil, errors.New("not supported key type")
+}
+
+// Issue creates a client certificate of the login (the certificate common
+// name), returns the certificate and its key PEMs
+func (i *CertIssuer) Issue(login string) (certPEM, keyPEM string, cert *IssuedCert, err error) {
+	key, err := rsa.GenerateKey(rand.Reader, clientKeyBits)
+	if err != nil {
+		return "", "", nil, fmt.Errorf("Could not generate certificate key: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", "", nil, fmt.Errorf("Could not generate certificate serial: %w", err)
+	}
+
+	now := time.Now().UTC()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: login},
+		NotBefore:    now.Add(-certClockSkew),
+		NotAfter:     now.Add(i.TTL),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if i.CRLURL != "" {
+		template.CRLDistributionPoints = []string{i.CRLURL}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, i.ca, &key.PublicKey, i.key)
+	if err != nil {
+		return "", "", nil, fmt.Errorf("Could not sign certificate: %w", err)
+	}
+
+	certPEM = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	keyPEM = string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+	return certPEM, keyPEM, &IssuedCert{Serial: serial.Text(16), Login: login, Expires: template.NotAfter}, nil
+}
+
+// CRL returns the revocation list (DER) of the revoked certificates
+func (i *CertIssuer) CRL(revoked []*IssuedCert) ([]byte, error) {
+	now := time.Now().UTC()
+	entries := []pkix.RevokedCertificate{}
+	for _, r := range revoked {
+		serial, ok := new(big.Int).SetString(r.Serial, 16)
+		if !ok {
+			logrus.Errorf("Wrong revoked certificate serial '%s'", r.Serial)
+			continue
+		}
+		entries = append(entries, pkix.RevokedCertificate{SerialNumber: serial, RevocationTime: r.RevokedAt})
+	}
+
+	template := &x509.RevocationList{
+		RevokedCertificates: entries,
+		Number:              big.NewInt(now.Unix()),
+		ThisUpdate:          now,
+		NextUpdate:          now.Add(crlValidity),
+	}
+	crl, err := x509.CreateRevocationList(rand.Reader, template, i.ca, i.key)
+	if err != nil {
+		return nil, fmt.Errorf("Could not sign revocation list: %w", err)
+	}
+	return crl, nil
+}
+
+// sourceType returns the riak source of the users, certificate if the client
+// certificates are enabled
+func (c *Riak) sourceType() string {
+	if c.Certs != nil {
+		return certificateSource
+	}
+	return passwordSource
+}
+
+// issueBindingCert issues a client certificate to the login and stores it on
+// the user binding, the previous certificates are kept. Returns blank
+// certificate and key if the client certificates are not enabled. The binding
+// is locked by the caller
+func (c *Riak) issueBindingCert(ctx context.Context, username, login, bucketName string) (certPEM, keyPEM string, cert *IssuedCert, err error) {
+	if c.Certs == nil {
+		return "", "", nil, nil
+	}
+
+	certPEM, keyPEM, cert, err = c.Certs.Issue(login)
+	if err != nil {
+		logrus.Errorf("Could not issue user '%s' certificate: %v", username, err)
+		return "", "", nil, err
+	}
+
+	key := bindingCertsKey(username, bucketName)
+	prev, err := c.getIssuedCerts(ctx, key)
+	if err != nil {
+		return "", "", nil, err
+	}
+	if err := c.storeIssuedCerts(ctx, key, append(prev, cert)); err != nil {
+		logrus.Errorf("Could not issue user '%s' certificate: %v", username, err)
+		return "", "", nil, err
+	}
+
+	logrus.Infof("Certificate '%s' issued to '%s' on '%s'", cert.Serial, login, bucketName)
+	return certPEM, keyPEM, cert, nil
+}
+
+// CertificateRevocationList returns the revocation list of the client
+// certificates, ErrCertificatesDisabled if they are not enabled
+func (c *Riak) CertificateRevocationList(ctx context.Context) ([]byte, error) {
+	if c.Certs == nil {
+		return nil, ErrCertificatesDisabled
+	}
+	revoked, err := c.getIssuedCerts(ctx, revokedCertsKey)
+	if err != nil {
+		return nil, err
+	}
+	return c.Certs.CRL(revoked)
+}
+
+// bindingCertsKey is the key of the binding certificates on the certs bucket
+func bindingCertsKey(username, bucketName string) string {
+	return "binding/" + bindingModeKey(username, bucketName)
+}
+
+// revokeBindingCerts revokes the certificates of the binding selected by the
+// filter (all if nil), the binding and the revoked list are locked by the caller
+func (c *Riak) revokeBindingCerts(ctx context.Context, username, bucketName string, filter func(*IssuedCert) bool) error {
+	key := bindingCertsKey(username, bucketName)
+	certs, err := c.getIssuedCerts(ctx, key)
+	if err != nil || len(certs) == 0 {
+		return err
+	}
+
+	kept, revoked := []*IssuedCert{}, []*IssuedCert{}
+	for _, ic := range certs {
+		if filter == nil || filter(ic) {
+			revoked = append(revoked, ic)
+		} else {
+			kept = append(kept, ic)
+		}
+	}
+	if len(revoked) == 0 {
+		return nil
+	}
+
+	if err := c.addRevokedCerts(ctx, revoked); err != nil {
+		return err
+	}
+	return c.storeIssuedCerts(ctx, key, kept)
+}
+
+// addRevokedCerts adds the certificates to the revoked list, the expired ones
+// are removed (riak rejects them anyway)
+func (c *Riak) addRevokedCerts(ctx context.Context, certs []*IssuedCert) error {
+	unlock, err := c.Locker.Lock(ctx, revokedCertsLockKey)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	revoked, err := c.getIssuedCerts(ctx, revokedCertsKey)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	list := []*IssuedCert{}
+	for _, r := range revoked {
+		if r.Expires.After(now) {
+			list = append(list, r)
+		}
+	}
+	for _, ic := range certs {
+		ic.RevokedAt = now
+		list = append(list, ic)
+		logrus.Infof("Certificate '%s' of '%s' revoked", ic.Serial, ic.Login)
+	}
+	return c.storeIssuedCerts(ctx, revokedCertsKey, list)
+}
+
+// getIssuedCerts returns the certificates stored on the key
+func (c *Riak) getIssuedCerts(ctx context.Context, key string) ([]*IssuedCert, error) {
+	cmd, err := riak.NewFetchValueCommandBuilder().
+		WithBucket(RiakCertsInfoBucket).
+		WithKey(key).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = c.execute(ctx, cmd); err != nil {
+		return nil, err
+	}
+
+	fvc, ok := cmd.(*riak.FetchValueCommand)
+	if !ok {
+		return nil, errors.New("Could not fetch any value")
+	}
+	certs := []*IssuedCert{}
+	if len(fvc.Response.Values) == 0 {
+		return certs, nil
+	}
+	if err := json.Unmarshal(fvc.Response.Values[0].Value, &certs); err != nil {
+		return nil, fmt.Errorf("Could not decode certificates '%s': %w", key, err)
+	}
+	return certs, nil
+}
+
+// storeIssuedCerts stores the certificates on the key, deleted if empty
+func (c *Riak) storeIssuedCerts(ctx context.Context, key string, certs []*IssuedCert) error {
+	var cmd riak.Command
+	var err error
+
+	if len(certs) == 0 {
+		cmd, err = riak.NewDeleteValueCommandBuilder().
+			WithBucket(RiakCertsInfoBucket).
+			WithKey(key).
+			Build()
+	} else {
+		var value []byte
+		if value, err = json.Marshal(certs); err != nil {
+			return fmt.Errorf("Could not store certificates '%s': %w", key, err)
+		}
+		obj := &riak.Object{
+			ContentType:     "application/json",
+			Charset:         "utf-8",
+			ContentEncoding: "utf-8",
+			Value:           value,
+		}
+		cmd, err = riak.NewStoreValueCommandBuilder().
+			WithBucket(RiakCertsInfoBucket).
+			WithKey(key).
+			WithContent(obj).
+			Build()
+	}
+	if err != nil {
+		return fmt.Errorf("Could not store certificates '%s': %w", key, err)
+	}
+
+	if err = c.execute(ctx, cmd); err != nil {
+		return fmt.Errorf("Could not store certificates '%s': %w", key, err)
+	}
+	return nil
+}
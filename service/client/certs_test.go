@@ -0,0 +1,184 @@
+package client
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestCA creates a self signed CA, returns its certificate and key PEMs
+func newTestCA(t *testing.T, isCA bool) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating CA key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "riakapi test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Error creating CA: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Error encoding CA key: %v", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+}
+
+func TestNewCertIssuer(t *testing.T) {
+	caPEM, keyPEM := newTestCA(t, true)
+	notCAPEM, notCAKeyPEM := newTestCA(t, false)
+
+	tests := []struct {
+		givenCA  string
+		givenKey string
+
+		wantIssuer bool
+		wantError  bool
+	}{
+		{givenCA: "", givenKey: "", wantIssuer: false},
+		{givenCA: caPEM, givenKey: keyPEM, wantIssuer: true},
+		{givenCA: "not a pem", givenKey: keyPEM, wantError: true},
+		{givenCA: notCAPEM, givenKey: notCAKeyPEM, wantError: true},
+		{givenCA: caPEM, givenKey: "", wantError: true},
+	}
+
+	for _, test := range tests {
+		got, err := NewCertIssuer(test.givenCA, test.givenKey, time.Hour, "")
+		if test.wantError {
+			if err == nil {
+				t.Errorf("Expected error creating the issuer; got none")
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Error creating the issuer: %v", err)
+		}
+		if (got != nil) != test.wantIssuer {
+			t.Errorf("Expected issuer %t; got: %v", test.wantIssuer, got)
+		}
+	}
+}
+
+func TestCertIssuerIssue(t *testing.T) {
+	caPEM, keyPEM := newTestCA(t, true)
+	issuer, err := NewCertIssuer(caPEM, keyPEM, 24*time.Hour, "http://riakapi.tsuru.io/crl")
+	if err != nil {
+		t.Fatalf("Error creating the issuer: %v", err)
+	}
+
+	certPEM, certKeyPEM, issued, err := issuer.Issue("tsuru_myapp.tsuru.io")
+	if err != nil {
+		t.Fatalf("Error issuing certificate: %v", err)
+	}
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil {
+		t.Fatalf("Expected PEM certificate; got: %s", certPEM)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("Error parsing certificate: %v", err)
+	}
+	if _, err := parsePrivateKey(certKeyPEM); err != nil {
+		t.Errorf("Error parsing certificate key: %v", err)
+	}
+
+	if cert.Subject.CommonName != "tsuru_myapp.tsuru.io" {
+		t.Errorf("Expected certificate of 'tsuru_myapp.tsuru.io'; got: '%s'", cert.Subject.CommonName)
+	}
+	if !reflect.DeepEqual(cert.ExtKeyUsage, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}) {
+		t.Errorf("Expected client auth certificate; got: %v", cert.ExtKeyUsage)
+	}
+	if want := []string{"http://riakapi.tsuru.io/crl"}; !reflect.DeepEqual(cert.CRLDistributionPoints, want) {
+		t.Errorf("Expected distribution points %v; got: %v", want, cert.CRLDistributionPoints)
+	}
+	if err := cert.CheckSignatureFrom(issuer.ca); err != nil {
+		t.Errorf("Expected certificate signed by the CA: %v", err)
+	}
+	if issued.Serial != cert.SerialNumber.Text(16) || issued.Login != "tsuru_myapp.tsuru.io" {
+		t.Errorf("Wrong issued certificate: %#v", issued)
+	}
+	if !cert.NotAfter.Equal(issued.Expires.Truncate(time.Second)) {
+		t.Errorf("Expected certificate expiration %s; got: %s", issued.Expires, cert.NotAfter)
+	}
+}
+
+func TestCertIssuerCRL(t *testing.T) {
+	caPEM, keyPEM := newTestCA(t, true)
+	issuer, err := NewCertIssuer(caPEM, keyPEM, time.Hour, "")
+	if err != nil {
+		t.Fatalf("Error creating the issuer: %v", err)
+	}
+
+	revoked := []*IssuedCert{
+		{Serial: "1f", Login: "tsuru_myapp.tsuru.io", RevokedAt: time.Now().UTC()},
+		{Serial: "wrong", Login: "tsuru_other.tsuru.io", RevokedAt: time.Now().UTC()},
+	}
+	der, err := issuer.CRL(revoked)
+	if err != nil {
+		t.Fatalf("Error creating revocation list: %v", err)
+	}
+	crl, err := x509.ParseRevocationList(der)
+	if err != nil {
+		t.Fatalf("Error parsing revocation list: %v", err)
+	}
+	if err := crl.CheckSignatureFrom(issuer.ca); err != nil {
+		t.Errorf("Expected revocation list signed by the CA: %v", err)
+	}
+
+	got := []string{}
+	for _, r := range crl.RevokedCertificateEntries {
+		got = append(got, r.SerialNumber.Text(16))
+	}
+	if want := []string{"1f"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected revoked serials %v; got: %v", want, got)
+	}
+}
+
+func TestRiakSyncLoginSourcesCertificates(t *testing.T) {
+	caPEM, keyPEM := newTestCA(t, true)
+	issuer, err := NewCertIssuer(caPEM, keyPEM, time.Hour, "")
+	if err != nil {
+		t.Fatalf("Error creating the issuer: %v", err)
+	}
+	user := "tsuru_myapp.tsuru.io"
+
+	admin := NewMemoryExecutor(func(cmd string) ([]byte, error) {
+		if strings.Contains(cmd, "print-sources") {
+			return []byte(testPrintSourcesOutput), nil
+		}
+		return []byte{}, nil
+	})
+	c := &Riak{Admin: admin, Certs: issuer}
+
+	// The password sources are replaced by certificate ones, the trust source
+	// is not managed by riakapi
+	if err := c.syncLoginSources(context.Background(), []string{user}, []string{"10.0.0.5/32"}); err != nil {
+		t.Errorf("Error syncing sources: %v", err)
+	}
+	want := []string{
+		printSourcesCmd,
+		adminCmd(grantSourceCmd, user, "10.0.0.5/32", certificateSource),
+		adminCmd(revokeSourceCmd, user, "0.0.0.0/0"),
+	}
+	if got := admin.Commands(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected commands %#v;\ngot: %#v", want, got)
+	}
+}
@@ -1,11 +1,18 @@
-/*Package client will respond to tsuru events creating by default one
-bucket type for each data type (counter, set and map). Having these bucket types
-for each new service instance the client will create a bucket, and for each app
+/*Package client will respond to tsuru events creating one bucket type for each
+configured plan (by default one for each data type: counter, set and map). Having
+these bucket types for each new service instance the client will create a bucket, and for each app
 binding to this instance the riak client will create a user and an ACL to access
 to this bucket.
 */
 package client
 
+import (
+	"context"
+	"time"
+
+	"github.com/tsuru/riakapi/config"
+)
+
 const (
 	//BucketTypeCounter is a counter data type bucket type
 	BucketTypeCounter = "tsuru-counter"
@@ -15,31 +22,86 @@ const (
 	BucketTypeMap = "tsuru-map"
 )
 
-// NameBucketTypeMapping maps bucket types to data types
-var NameBucketTypeMapping = map[string]string{
-	BucketTypeCounter: "counter",
-	BucketTypeSet:     "set",
-	BucketTypeMap:     "map",
+// BucketInfo holds the registered information of a bucket (the instance record)
+type BucketInfo struct {
+	Name       string    `json:"name"`
+	BucketType string    `json:"bucket_type"`
+	Team       string    `json:"team"`
+	Creator    string    `json:"creator"`
+	CreatedAt  time.Time `json:"created_at"`
+	// Parameters are the bucket properties set on instance creation
+	Parameters map[string]string `json:"parameters,omitempty"`
+	Tags       []string          `json:"tags,omitempty"`
+
+	// DataType is taken from the plan, it's not stored on the record
+	DataType string `json:"-"`
+}
+
+// matches checks the bucket belongs to the team and plan, blank filters match all
+func (b *BucketInfo) matches(team, plan string) bool {
+	return (team == "" || b.Team == team) && (plan == "" || b.BucketType == plan)
+}
+
+// bucketsByName sorts the buckets by name
+type bucketsByName []*BucketInfo
+
+func (b bucketsByName) Len() int           { return len(b) }
+func (b bucketsByName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b bucketsByName) Less(i, j int) bool { return b[i].Name < b[j].Name }
+
+// Plans are the available plans (bucket types) of the service
+type Plans []*config.Plan
+
+// Get returns the plan with the name, nil if not present
+func (p Plans) Get(name string) *config.Plan {
+	for _, plan := range p {
+		if plan.Name == name {
+			return plan
+		}
+	}
+	return nil
+}
+
+// DataType returns the data type of the plan, blank if it's a plain key/value
+// plan or the plan is not present
+func (p Plans) DataType(name string) string {
+	if plan := p.Get(name); plan != nil {
+		return plan.DataType
+	}
+	return ""
 }
 
-// BucketTypes lists all the bucket types available
-var BucketTypes = map[string]string{
-	BucketTypeCounter: "Bucket type of counter data type",
-	BucketTypeSet:     "Bucket type of set data type",
-	BucketTypeMap:     "Bucket type of map data type",
+// AllowedCIDRs returns the networks the apps bound to the plan instances can
+// connect from when their units are not registered, any network if not set
+func (p Plans) AllowedCIDRs(name string) []string {
+	if plan := p.Get(name); plan != nil && len(plan.AllowedCIDRs) > 0 {
+		return plan.AllowedCIDRs
+	}
+	return []string{defaultSourceCIDR}
 }
 
-// Client is the interface to the storer
+// Client is the interface to the storer, the context cancels the riak and
+// riak-admin operations in progress (for example when the request times out)
 type Client interface {
-	GetBucketType(bucketName string) string
-	GetBucketTypes() ([]map[string]string, error)
-	CreateBucket(bucketName, bucketType string) error
-	DeleteBucket(bucketName, bucketType string) error
-	EnsureUserPresent(word string) (user, pass string, err error)
-	DeleteUser(username string) error
-	GrantUserAccess(username, bucketName string) error
-	RevokeUserAccess(username, bucketName string) error
-	IsAlive(bucketName string) (alive bool, err error)
+	GetBucketType(ctx context.Context, bucketName string) string
+	GetBucketTypes(ctx context.Context) ([]map[string]string, error)
+	GetBucketInfo(ctx context.Context, bucketName string) (*BucketInfo, error)
+	GetBucketUsers(ctx context.Context, bucketName string) ([]string, error)
+	CountBucketKeys(ctx context.Context, bucketName string) (int, error)
+	ListBuckets(ctx context.Context, team, plan string) ([]*BucketInfo, error)
+	CreateBucket(ctx context.Context, info *BucketInfo) error
+	DeleteBucket(ctx context.Context, bucketName, bucketType string) error
+	EnsureUserPresent(ctx context.Context, word string) (user, pass string, err error)
+	GetUserBuckets(ctx context.Context, username string) ([]string, error)
+	DeleteUser(ctx context.Context, username string) error
+	GrantUserAccess(ctx context.Context, username, bucketName string, mode BindMode) (certPEM, keyPEM string, err error)
+	RevokeUserAccess(ctx context.Context, username, bucketName string) error
+	RotateUserPassword(ctx context.Context, username string, grace bool) (*RotationResult, error)
+	ConfirmUserRotation(ctx context.Context, username string) error
+	BindUnit(ctx context.Context, username, bucketName, unitHost string) error
+	UnbindUnit(ctx context.Context, username, bucketName, unitHost string) error
+	CertificateRevocationList(ctx context.Context) ([]byte, error)
+	IsAlive(ctx context.Context, bucketName string) (alive bool, err error)
 }
 
 // Nil implements client interface doing nothing
@@ -51,12 +113,46 @@ func NewNil() *Nil {
 	return &Nil{}
 }
 
-func (c *Nil) GetBucketType(bucketName string) string                       { return "" }
-func (c *Nil) GetBucketTypes() ([]map[string]string, error)                 { return []map[string]string{}, nil }
-func (c *Nil) CreateBucket(bucketName, bucketType string) error             { return nil }
-func (c *Nil) DeleteBucket(bucketName, bucketType string) error             { return nil }
-func (c *Nil) EnsureUserPresent(word string) (user, pass string, err error) { return "", "", nil }
-func (c *Nil) DeleteUser(username string) error                             { return nil }
-func (c *Nil) GrantUserAccess(username, bucketName string) error            { return nil }
-func (c *Nil) RevokeUserAccess(username, bucketName string) error           { return nil }
-func (c *Nil) IsAlive(bucketName string) (alive bool, err error)            { return false, nil }
+func (c *Nil) GetBucketType(ctx context.Context, bucketName string) string { return "" }
+func (c *Nil) GetBucketTypes(ctx context.Context) ([]map[string]string, error) {
+	return []map[string]string{}, nil
+}
+func (c *Nil) GetBucketInfo(ctx context.Context, bucketName string) (*BucketInfo, error) {
+	return &BucketInfo{}, nil
+}
+func (c *Nil) GetBucketUsers(ctx context.Context, bucketName string) ([]string, error) {
+	return []string{}, nil
+}
+func (c *Nil) CountBucketKeys(ctx context.Context, bucketName string) (int, error) { return 0, nil }
+func (c *Nil) ListBuckets(ctx context.Context, team, plan string) ([]*BucketInfo, error) {
+	return []*BucketInfo{}, nil
+}
+func (c *Nil) CreateBucket(ctx context.Context, info *BucketInfo) error              { return nil }
+func (c *Nil) DeleteBucket(ctx context.Context, bucketName, bucketType string) error { return nil }
+func (c *Nil) EnsureUserPresent(ctx context.Context, word string) (user, pass string, err error) {
+	return "", "", nil
+}
+func (c *Nil) GetUserBuckets(ctx context.Context, username string) ([]string, error) {
+	return []string{}, nil
+}
+func (c *Nil) DeleteUser(ctx context.Context, username string) error { return nil }
+func (c *Nil) GrantUserAccess(ctx context.Context, username, bucketName string, mode BindMode) (certPEM, keyPEM string, err error) {
+	return "", "", nil
+}
+func (c *Nil) RevokeUserAccess(ctx context.Context, username, bucketName string) error { return nil }
+func (c *Nil) RotateUserPassword(ctx context.Context, username string, grace bool) (*RotationResult, error) {
+	return &RotationResult{}, nil
+}
+func (c *Nil) ConfirmUserRotation(ctx context.Context, username string) error { return nil }
+func (c *Nil) BindUnit(ctx context.Context, username, bucketName, unitHost string) error {
+	return nil
+}
+func (c *Nil) UnbindUnit(ctx context.Context, username, bucketName, unitHost string) error {
+	return nil
+}
+func (c *Nil) CertificateRevocationList(ctx context.Context) ([]byte, error) {
+	return nil, ErrCertificatesDisabled
+}
+func (c *Nil) IsAlive(ctx context.Context, bucketName string) (alive bool, err error) {
+	return false, nil
+}
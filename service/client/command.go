@@ -0,0 +1,67 @@
+package client
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// maxNameLength is the maximum length of the instance and user names
+const maxNameLength = 255
+
+// validName is the charset riak-admin accepts on bucket, bucket type and user
+// names without quoting issues
+var validName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
+// reservedNames are riak-admin security keywords and the names that clash with
+// the service routes (/resources/plans), they can't be used as names
+var reservedNames = map[string]bool{
+	"all":   true,
+	"any":   true,
+	"on":    true,
+	"to":    true,
+	"from":  true,
+	"group": true,
+	"plans": true,
+}
+
+// ValidateName checks the name can be used as a riak bucket, bucket type or
+// user name, returns ErrInvalidName if not
+func ValidateName(name string) error {
+	if len(name) > maxNameLength {
+		return fmt.Errorf("%w: '%.20s...' is longer than %d characters", ErrInvalidName, name, maxNameLength)
+	}
+	if !validName.MatchString(name) {
+		return fmt.Errorf("%w: '%s' should start with a letter or number and only have letters, numbers, '.', '_' and '-'", ErrInvalidName, name)
+	}
+	if reservedNames[strings.ToLower(name)] {
+		return fmt.Errorf("%w: '%s' is a reserved word", ErrInvalidName, name)
+	}
+	return nil
+}
+
+// shellQuote quotes the argument for the shell, single quotes only need the
+// single quotes escaped
+func shellQuote(arg string) string {
+	return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+}
+
+// adminCmd builds a riak-admin command line from the command format, all the
+// arguments are shell quoted so they are passed as is to riak-admin
+func adminCmd(cmdFmt string, args ...string) string {
+	quoted := make([]interface{}, len(args))
+	for i, a := range args {
+		quoted[i] = shellQuote(a)
+	}
+	return fmt.Sprintf(cmdFmt, quoted...)
+}
+
+// quotedPasswordArg matches the shell quoted password arguments of the user
+// commands (add-user, alter-user)
+var quotedPasswordArg = regexp.MustCompile(`'password=(?:[^']|'\\'')*'`)
+
+// redactCommand hides the passwords of a riak-admin command line so it can be
+// logged
+func redactCommand(cmd string) string {
+	return quotedPasswordArg.ReplaceAllString(cmd, "'password=***'")
+}
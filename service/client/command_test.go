@@ -0,0 +1,79 @@
+package client
+
+import (
+	"errors"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestValidateName(t *testing.T) {
+	tests := []struct {
+		givenName string
+
+		wantError bool
+	}{
+		{givenName: "my-bucket_1.prod"},
+		{givenName: "tsuru_myapp.tsuru.io"},
+		{givenName: "", wantError: true},
+		{givenName: "-bucket", wantError: true},
+		{givenName: "my bucket", wantError: true},
+		{givenName: "bucket'; rm -rf /", wantError: true},
+		{givenName: "bucket$(id)", wantError: true},
+		{givenName: "ALL", wantError: true},
+		{givenName: "plans", wantError: true},
+		{givenName: strings.Repeat("a", 256), wantError: true},
+	}
+
+	for _, test := range tests {
+		err := ValidateName(test.givenName)
+		if test.wantError && !errors.Is(err, ErrInvalidName) {
+			t.Errorf("Expected invalid name error for '%s'; got: %v", test.givenName, err)
+		}
+		if !test.wantError && err != nil {
+			t.Errorf("Expected valid name '%s'; got: %v", test.givenName, err)
+		}
+	}
+}
+
+func TestAdminCmdQuotesArguments(t *testing.T) {
+	args := []string{"simple", "it's", `"double" $(id) ; echo`, "password=a b'c"}
+	cmd := adminCmd("printf '%%s\\n' %s %s %s %s", args...)
+
+	// The shell receives each argument as is
+	out, err := exec.Command("sh", "-c", cmd).Output()
+	if err != nil {
+		t.Fatalf("Error running quoted command: %v", err)
+	}
+	want := strings.Join(args, "\n") + "\n"
+	if string(out) != want {
+		t.Errorf("Expected arguments %q;\ngot: %q", want, out)
+	}
+}
+
+func TestRedactCommand(t *testing.T) {
+	tests := []struct {
+		givenCmd string
+
+		wantCmd string
+	}{
+		{
+			givenCmd: adminCmd(createUserCmd, "tsuru_myapp", "password=s3cr3t"),
+			wantCmd:  "sudo riak-admin security add-user 'tsuru_myapp' 'password=***'",
+		},
+		{
+			givenCmd: adminCmd(alterUserCmd, "tsuru_myapp", "password=a b'c 'd"),
+			wantCmd:  "sudo riak-admin security alter-user 'tsuru_myapp' 'password=***'",
+		},
+		{
+			givenCmd: adminCmd(deleteUserCmd, "tsuru_myapp"),
+			wantCmd:  "sudo riak-admin security del-user 'tsuru_myapp'",
+		},
+	}
+
+	for _, test := range tests {
+		if got := redactCommand(test.givenCmd); got != test.wantCmd {
+			t.Errorf("Expected command %q; got: %q", test.wantCmd, got)
+		}
+	}
+}
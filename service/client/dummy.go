@@ -1,11 +1,15 @@
 package client
 
 import (
+	"context"
 	"errors"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 
+	"github.com/tsuru/riakapi/config"
 	"github.com/tsuru/riakapi/utils"
 )
 
@@ -13,6 +17,13 @@ type UserProps struct {
 	Username string
 	Password string
 	ACL      []string // bucket names wich can access
+	Sources  []string // CIDRs from where the user can authenticate
+
+	BindModes map[string]BindMode    // binding mode of each ACL bucket
+	Units     map[string][]string    // unit CIDRs of each ACL bucket
+	Certs     map[string]*IssuedCert // client certificate of each ACL bucket
+
+	PreviousPassword string // valid until the rotation with grace is confirmed
 }
 
 // Dummy is the entrypoint for riak dummy client
@@ -20,8 +31,11 @@ type Dummy struct {
 	*Riak
 
 	// Our custom database (on the instance to allow parallel tests)
-	Buckets map[string]string
-	Users   map[string]*UserProps
+	Buckets     map[string]string
+	BucketsInfo map[string]*BucketInfo
+	BucketsKeys map[string]int
+	Users       map[string]*UserProps
+	Revoked     []*IssuedCert // revoked client certificates
 
 	bucketsMutex *sync.Mutex
 	usersMutex   *sync.Mutex
@@ -30,61 +44,138 @@ type Dummy struct {
 // NewDummy creates a dummy client, useful for testing
 func NewDummy() *Dummy {
 	return &Dummy{
-		Riak:         &Riak{},
+		Riak:         &Riak{Plans: config.DefaultPlans},
 		Buckets:      map[string]string{},
+		BucketsInfo:  map[string]*BucketInfo{},
+		BucketsKeys:  map[string]int{},
 		Users:        map[string]*UserProps{},
 		bucketsMutex: &sync.Mutex{},
 		usersMutex:   &sync.Mutex{},
 	}
 }
 
-func (c *Dummy) GetBucketType(bucketName string) string {
+func (c *Dummy) GetBucketType(ctx context.Context, bucketName string) string {
 	return c.Buckets[bucketName]
 }
 
-func (c *Dummy) GetBucketTypes() ([]map[string]string, error) {
-	var r []map[string]string
+func (c *Dummy) GetBucketInfo(ctx context.Context, bucketName string) (*BucketInfo, error) {
+	c.bucketsMutex.Lock()
+	defer c.bucketsMutex.Unlock()
+	return c.bucketInfo(bucketName)
+}
 
-	for k, v := range BucketTypes {
-		r = append(r, map[string]string{
-			"name":        k,
-			"description": v,
-		})
+// bucketInfo returns the bucket info, the buckets mutex must be held
+func (c *Dummy) bucketInfo(bucketName string) (*BucketInfo, error) {
+	bucketType, ok := c.Buckets[bucketName]
+	if !ok {
+		return nil, ErrInstanceNotFound
+	}
+	info := &BucketInfo{}
+	if i, ok := c.BucketsInfo[bucketName]; ok {
+		*info = *i
 	}
-	return r, nil
+	info.Name = bucketName
+	info.BucketType = bucketType
+	info.DataType = c.Plans.DataType(bucketType)
+	return info, nil
+}
 
+func (c *Dummy) ListBuckets(ctx context.Context, team, plan string) ([]*BucketInfo, error) {
+	c.bucketsMutex.Lock()
+	defer c.bucketsMutex.Unlock()
+	buckets := []*BucketInfo{}
+	for name := range c.Buckets {
+		info, _ := c.bucketInfo(name)
+		if info.matches(team, plan) {
+			buckets = append(buckets, info)
+		}
+	}
+	sort.Sort(bucketsByName(buckets))
+	return buckets, nil
 }
 
-func (c *Dummy) CreateBucket(bucketName, bucketType string) error {
-	// Check bucket type
-	if _, ok := BucketTypes[bucketType]; !ok {
-		return errors.New("Not valid bucket type")
+func (c *Dummy) GetBucketUsers(ctx context.Context, bucketName string) ([]string, error) {
+	c.usersMutex.Lock()
+	defer c.usersMutex.Unlock()
+	users := []string{}
+	for _, user := range c.Users {
+		for _, a := range user.ACL {
+			if a == bucketName {
+				users = append(users, user.Username)
+			}
+		}
+	}
+	sort.Strings(users)
+	return users, nil
+}
+
+func (c *Dummy) CountBucketKeys(ctx context.Context, bucketName string) (int, error) {
+	c.bucketsMutex.Lock()
+	defer c.bucketsMutex.Unlock()
+	return c.BucketsKeys[bucketName], nil
+}
+
+func (c *Dummy) CreateBucket(ctx context.Context, info *BucketInfo) error {
+	bucketName := info.Name
+	bucketType := info.BucketType
+
+	// Check name, bucket type and parameters
+	if err := ValidateName(bucketName); err != nil {
+		return err
+	}
+	if c.Plans.Get(bucketType) == nil {
+		return ErrInvalidPlan
+	}
+	if err := c.Plans.validateParams(bucketType, info.Parameters); err != nil {
+		return err
 	}
 
 	c.bucketsMutex.Lock()
 	defer c.bucketsMutex.Unlock()
 	if _, ok := c.Buckets[bucketName]; !ok {
+		record := *info
+		record.CreatedAt = time.Now().UTC()
 		c.Buckets[bucketName] = bucketType
+		c.BucketsInfo[bucketName] = &record
 		logrus.Infof("Bucket '%s' of type '%s' created", bucketName, bucketType)
 		return nil
 	}
-	return errors.New("Bucket already declared")
+	return ErrInstanceExists
 }
-func (c *Dummy) DeleteBucket(bucketName, bucketType string) error {
+func (c *Dummy) DeleteBucket(ctx context.Context, bucketName, bucketType string) error {
 	c.bucketsMutex.Lock()
 	defer c.bucketsMutex.Unlock()
 	if _, ok := c.Buckets[bucketName]; ok {
 		delete(c.Buckets, bucketName)
-		return nil
+		delete(c.BucketsInfo, bucketName)
+		delete(c.BucketsKeys, bucketName)
+	}
+
+	// Revoke all the grants on the bucket
+	c.usersMutex.Lock()
+	defer c.usersMutex.Unlock()
+	for _, user := range c.Users {
+		for i, v := range user.ACL {
+			if v == bucketName {
+				user.ACL = append(user.ACL[:i], user.ACL[i+1:]...)
+				delete(user.Units, bucketName)
+				c.revokeCert(user, bucketName)
+				user.Sources = c.userSources(user, c.Buckets)
+				break
+			}
+		}
 	}
 	return nil
 }
 
-func (c *Dummy) EnsureUserPresent(word string) (user, pass string, err error) {
+func (c *Dummy) EnsureUserPresent(ctx context.Context, word string) (user, pass string, err error) {
 	c.usersMutex.Lock()
 	defer c.usersMutex.Unlock()
 	//TODO: use salt
 	user = utils.GenerateUsername(word)
+	if err = ValidateName(user); err != nil {
+		return
+	}
 	var props *UserProps
 	var ok bool
 	if props, ok = c.Users[user]; !ok {
@@ -93,57 +184,131 @@ func (c *Dummy) EnsureUserPresent(word string) (user, pass string, err error) {
 			Username: user,
 			Password: pass,
 			ACL:      []string{},
+			Sources:  []string{},
 		}
 		return
 	}
 	pass = props.Password
 	return
 }
-func (c *Dummy) GrantUserAccess(username, bucketName string) error {
+func (c *Dummy) GrantUserAccess(ctx context.Context, username, bucketName string, mode BindMode) (certPEM, keyPEM string, err error) {
+	buckets := c.bucketTypes()
+	if _, ok := buckets[bucketName]; !ok {
+		return "", "", ErrInstanceNotFound
+	}
+
 	c.usersMutex.Lock()
 	defer c.usersMutex.Unlock()
 	if user, ok := c.Users[username]; ok {
+		// The certificate is issued first, nothing is granted if it fails
+		certPEM, keyPEM, err := c.issueCert(user, bucketName)
+		if err != nil {
+			return "", "", err
+		}
+
+		if user.BindModes == nil {
+			user.BindModes = map[string]BindMode{}
+		}
+		user.BindModes[bucketName] = mode
 		// Check if present already (performance on dummy doesn't matter)
 		for _, a := range user.ACL {
 			if a == bucketName {
-				return nil
+				return certPEM, keyPEM, nil
 			}
 		}
 		user.ACL = append(user.ACL, bucketName)
-		return nil
+		user.Sources = c.userSources(user, buckets)
+		return certPEM, keyPEM, nil
+	}
+	return "", "", ErrUserNotFound
+}
+
+// bucketTypes returns a copy of the buckets types, so they can be read while
+// the users mutex is held
+func (c *Dummy) bucketTypes() map[string]string {
+	c.bucketsMutex.Lock()
+	defer c.bucketsMutex.Unlock()
+	buckets := map[string]string{}
+	for b, t := range c.Buckets {
+		buckets[b] = t
 	}
-	return errors.New("Not present user")
+	return buckets
 }
 
-func (c *Dummy) DeleteUser(username string) error {
+// userSources returns the user sources, the units of each binding or the plan
+// allowed CIDRs. The users mutex must be held
+func (c *Dummy) userSources(user *UserProps, buckets map[string]string) []string {
+	sources := []string{}
+	seen := map[string]bool{}
+	for _, b := range user.ACL {
+		cidrs, registered := user.Units[b]
+		if !registered {
+			cidrs = c.Plans.AllowedCIDRs(buckets[b])
+		}
+		for _, cidr := range cidrs {
+			if !seen[cidr] {
+				seen[cidr] = true
+				sources = append(sources, cidr)
+			}
+		}
+	}
+	sort.Strings(sources)
+	return sources
+}
+
+func (c *Dummy) GetUserBuckets(ctx context.Context, username string) ([]string, error) {
+	c.usersMutex.Lock()
+	defer c.usersMutex.Unlock()
+	buckets := []string{}
+	if user, ok := c.Users[username]; ok {
+		buckets = append(buckets, user.ACL...)
+	}
+	return buckets, nil
+}
+
+func (c *Dummy) DeleteUser(ctx context.Context, username string) error {
 	c.usersMutex.Lock()
 	defer c.usersMutex.Unlock()
 
-	if _, ok := c.Users[username]; ok {
+	if user, ok := c.Users[username]; ok {
+		if len(user.ACL) > 0 {
+			return ErrUserGranted
+		}
 		delete(c.Users, username)
 		return nil
 	}
-	return errors.New("Theres no user to delete")
+	return ErrUserNotFound
 }
 
-func (c *Dummy) RevokeUserAccess(username, bucketName string) error {
+func (c *Dummy) RevokeUserAccess(ctx context.Context, username, bucketName string) error {
+	buckets := c.bucketTypes()
+	if _, ok := buckets[bucketName]; !ok {
+		return ErrInstanceNotFound
+	}
+
 	c.usersMutex.Lock()
 	defer c.usersMutex.Unlock()
 	user, ok := c.Users[username]
 	if !ok {
-		return errors.New("Not valid username")
+		return ErrUserNotFound
 	}
 	for i, v := range user.ACL {
 		if v == bucketName {
 			// remove ACL
 			user.ACL = append(user.ACL[:i], user.ACL[i+1:]...)
-			return nil
+			delete(user.BindModes, bucketName)
+			delete(user.Units, bucketName)
+			c.revokeCert(user, bucketName)
+			break
 		}
 	}
+
+	// The user is shared between instances, the sources of the other grants are kept
+	user.Sources = c.userSources(user, buckets)
 	return nil
 }
 
-func (c *Dummy) IsAlive(bucketName string) (alive bool, err error) {
+func (c *Dummy) IsAlive(ctx context.Context, bucketName string) (alive bool, err error) {
 	c.bucketsMutex.Lock()
 	defer c.bucketsMutex.Unlock()
 	if _, ok := c.Buckets[bucketName]; ok {
@@ -153,3 +318,137 @@ func (c *Dummy) IsAlive(bucketName string) (alive bool, err error) {
 	err = errors.New("Dummy not alive")
 	return
 }
+
+func (c *Dummy) RotateUserPassword(ctx context.Context, username string, grace bool) (*RotationResult, error) {
+	c.usersMutex.Lock()
+	defer c.usersMutex.Unlock()
+
+	user, ok := c.Users[username]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	if user.PreviousPassword != "" {
+		return nil, ErrRotationPending
+	}
+	pass, err := utils.GenerateRandomPassword()
+	if err != nil {
+		return nil, err
+	}
+	if grace {
+		user.PreviousPassword = user.Password
+	}
+	user.Password = pass
+	return &RotationResult{User: username, Instances: append([]string{}, user.ACL...), Grace: grace}, nil
+}
+
+func (c *Dummy) ConfirmUserRotation(ctx context.Context, username string) error {
+	c.usersMutex.Lock()
+	defer c.usersMutex.Unlock()
+
+	user, ok := c.Users[username]
+	if !ok {
+		return ErrUserNotFound
+	}
+	if user.PreviousPassword == "" {
+		return ErrRotationNotPending
+	}
+	user.PreviousPassword = ""
+	return nil
+}
+
+func (c *Dummy) BindUnit(ctx context.Context, username, bucketName, unitHost string) error {
+	cidr, err := unitSourceCIDR(unitHost)
+	if err != nil {
+		return err
+	}
+	buckets := c.bucketTypes()
+	if _, ok := buckets[bucketName]; !ok {
+		return ErrInstanceNotFound
+	}
+
+	c.usersMutex.Lock()
+	defer c.usersMutex.Unlock()
+	user, ok := c.Users[username]
+	if !ok {
+		return ErrUserNotFound
+	}
+	bound := false
+	for _, a := range user.ACL {
+		bound = bound || a == bucketName
+	}
+	if !bound {
+		return ErrUserNotFound
+	}
+	if user.Units == nil {
+		user.Units = map[string][]string{}
+	}
+	for _, u := range user.Units[bucketName] {
+		if u == cidr {
+			return nil
+		}
+	}
+	user.Units[bucketName] = append(user.Units[bucketName], cidr)
+	user.Sources = c.userSources(user, buckets)
+	return nil
+}
+
+func (c *Dummy) UnbindUnit(ctx context.Context, username, bucketName, unitHost string) error {
+	cidr, err := unitSourceCIDR(unitHost)
+	if err != nil {
+		return err
+	}
+	buckets := c.bucketTypes()
+
+	c.usersMutex.Lock()
+	defer c.usersMutex.Unlock()
+	user, ok := c.Users[username]
+	if !ok {
+		return nil
+	}
+	for i, u := range user.Units[bucketName] {
+		if u == cidr {
+			user.Units[bucketName] = append(user.Units[bucketName][:i], user.Units[bucketName][i+1:]...)
+			break
+		}
+	}
+	user.Sources = c.userSources(user, buckets)
+	return nil
+}
+
+// issueCert issues the certificate of the user binding revoking the previous
+// one. The users mutex must be held
+func (c *Dummy) issueCert(user *UserProps, bucketName string) (certPEM, keyPEM string, err error) {
+	if c.Certs == nil {
+		return "", "", nil
+	}
+
+	certPEM, keyPEM, cert, err := c.Certs.Issue(user.Username)
+	if err != nil {
+		return "", "", err
+	}
+	c.revokeCert(user, bucketName)
+	if user.Certs == nil {
+		user.Certs = map[string]*IssuedCert{}
+	}
+	user.Certs[bucketName] = cert
+	return certPEM, keyPEM, nil
+}
+
+func (c *Dummy) CertificateRevocationList(ctx context.Context) ([]byte, error) {
+	if c.Certs == nil {
+		return nil, ErrCertificatesDisabled
+	}
+	c.usersMutex.Lock()
+	defer c.usersMutex.Unlock()
+	return c.Certs.CRL(c.Revoked)
+}
+
+// revokeCert revokes the certificate of the user binding, the users mutex must
+// be held
+func (c *Dummy) revokeCert(user *UserProps, bucketName string) {
+	if cert, ok := user.Certs[bucketName]; ok {
+		cert.RevokedAt = time.Now().UTC()
+		c.Revoked = append(c.Revoked, cert)
+		delete(user.Certs, bucketName)
+	}
+}
@@ -0,0 +1,88 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestDummyRevokeUserAccessKeepsSourceWithOtherGrants(t *testing.T) {
+	c := NewDummy()
+	c.CreateBucket(context.Background(), &BucketInfo{Name: "instance-a", BucketType: BucketTypeCounter, Team: "myteam"})
+	c.CreateBucket(context.Background(), &BucketInfo{Name: "instance-b", BucketType: BucketTypeCounter, Team: "myteam"})
+	user, _, _ := c.EnsureUserPresent(context.Background(), "myapp.tsuru.io")
+	c.GrantUserAccess(context.Background(), user, "instance-a", BindModeReadWrite)
+	c.GrantUserAccess(context.Background(), user, "instance-b", BindModeReadOnly)
+
+	tests := []struct {
+		givenBucket string
+
+		wantACL     []string
+		wantSources []string
+	}{
+		{
+			givenBucket: "instance-a",
+			wantACL:     []string{"instance-b"},
+			wantSources: []string{defaultSourceCIDR},
+		},
+		{
+			givenBucket: "instance-b",
+			wantACL:     []string{},
+			wantSources: []string{},
+		},
+	}
+
+	for _, test := range tests {
+		if err := c.RevokeUserAccess(context.Background(), user, test.givenBucket); err != nil {
+			t.Errorf("Error revoking user: %v", err)
+		}
+
+		if !reflect.DeepEqual(c.Users[user].ACL, test.wantACL) {
+			t.Errorf("Expected ACL %v; got: %v", test.wantACL, c.Users[user].ACL)
+		}
+
+		if !reflect.DeepEqual(c.Users[user].Sources, test.wantSources) {
+			t.Errorf("Expected sources %v; got: %v", test.wantSources, c.Users[user].Sources)
+		}
+	}
+}
+
+func TestDummyBindUnitSources(t *testing.T) {
+	c := NewDummy()
+	c.Plans = Plans{
+		{Name: "tsuru-counter", DataType: "counter"},
+		{Name: "tsuru-set", DataType: "set", AllowedCIDRs: []string{"10.0.0.0/8"}},
+	}
+	c.CreateBucket(context.Background(), &BucketInfo{Name: "instance-a", BucketType: "tsuru-counter"})
+	c.CreateBucket(context.Background(), &BucketInfo{Name: "instance-b", BucketType: "tsuru-set"})
+	user, _, _ := c.EnsureUserPresent(context.Background(), "myapp.tsuru.io")
+	c.GrantUserAccess(context.Background(), user, "instance-a", BindModeReadWrite)
+	c.GrantUserAccess(context.Background(), user, "instance-b", BindModeReadWrite)
+
+	if want := []string{"0.0.0.0/0", "10.0.0.0/8"}; !reflect.DeepEqual(c.Users[user].Sources, want) {
+		t.Errorf("Expected plan sources %v; got: %v", want, c.Users[user].Sources)
+	}
+
+	c.BindUnit(context.Background(), user, "instance-a", "192.168.1.5")
+	c.BindUnit(context.Background(), user, "instance-b", "192.168.1.5")
+	if want := []string{"192.168.1.5/32"}; !reflect.DeepEqual(c.Users[user].Sources, want) {
+		t.Errorf("Expected unit sources %v; got: %v", want, c.Users[user].Sources)
+	}
+
+	// The unit is kept while bound to other instance, the binding without units
+	// doesn't fall back to the plan networks
+	c.UnbindUnit(context.Background(), user, "instance-a", "192.168.1.5")
+	if want := []string{"192.168.1.5/32"}; !reflect.DeepEqual(c.Users[user].Sources, want) {
+		t.Errorf("Expected sources %v; got: %v", want, c.Users[user].Sources)
+	}
+
+	c.UnbindUnit(context.Background(), user, "instance-b", "192.168.1.5")
+	if want := []string{}; !reflect.DeepEqual(c.Users[user].Sources, want) {
+		t.Errorf("Expected no sources; got: %v", c.Users[user].Sources)
+	}
+
+	if err := c.BindUnit(context.Background(), user, "instance-a", "unit-1.tsuru.io"); !errors.Is(err, ErrInvalidParameter) {
+		t.Errorf("Expected invalid unit host error; got: %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Client errors, the service maps them to the proper response
+var (
+	// ErrInvalidPlan is returned when the plan (bucket type) is not available
+	ErrInvalidPlan = errors.New("invalid plan")
+	// ErrInvalidParameter is returned when an instance parameter is not allowed
+	// on the plan or its value is not valid
+	ErrInvalidParameter = errors.New("invalid parameter")
+	// ErrInvalidName is returned when an instance or user name has characters
+	// not allowed by riak
+	ErrInvalidName = errors.New("invalid name")
+	// ErrInstanceExists is returned when the instance (bucket) is already created
+	ErrInstanceExists = errors.New("instance already exists")
+	// ErrInstancePurging is returned when the keys of a removed instance with
+	// the same name are still being deleted
+	ErrInstancePurging = errors.New("instance with the same name still being removed")
+	// ErrPurgerNotStarted is returned when creating or removing instances with
+	// a client without purger (the one-shot commands clients)
+	ErrPurgerNotStarted = errors.New("instance purger not started")
+	// ErrInstanceNotFound is returned when the instance (bucket) is not created
+	ErrInstanceNotFound = errors.New("instance not found")
+	// ErrUserNotFound is returned when the user is not created
+	ErrUserNotFound = errors.New("user not found")
+	// ErrUserGranted is returned when deleting a user that still has
+	// permissions on instances
+	ErrUserGranted = errors.New("user still granted on instances")
+	// ErrRotationPending is returned when the user password was rotated with
+	// grace and the rotation is not confirmed yet
+	ErrRotationPending = errors.New("password rotation pending confirmation")
+	// ErrRotationNotPending is returned when confirming a rotation of a user not
+	// rotated with grace
+	ErrRotationNotPending = errors.New("no password rotation pending")
+	// ErrBackendUnavailable is returned when riak can't be reached
+	ErrBackendUnavailable = errors.New("riak unavailable")
+	// ErrCommandInterrupted is returned when the connection is lost after a
+	// riak-admin command started, it could have run so it's not retried
+	ErrCommandInterrupted = errors.New("riak-admin command interrupted")
+)
+
+// unavailableErrMsgs are parts of the error messages returned when the riak
+// nodes can't be reached
+var unavailableErrMsgs = []string{
+	"connection refused",
+	"connection reset",
+	"no route to host",
+	"i/o timeout",
+	"broken pipe",
+	"no nodes available",
+	"no node available",
+}
+
+// backendError marks the errors caused by riak being unreachable as ErrBackendUnavailable
+func backendError(err error) error {
+	if err == nil || errors.Is(err, ErrBackendUnavailable) {
+		return err
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return fmt.Errorf("%w: %v", ErrBackendUnavailable, err)
+	}
+
+	msg := strings.ToLower(err.Error())
+	for _, m := range unavailableErrMsgs {
+		if strings.Contains(msg, m) {
+			return fmt.Errorf("%w: %v", ErrBackendUnavailable, err)
+		}
+	}
+	return err
+}
@@ -0,0 +1,173 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/tsuru/riakapi/config"
+)
+
+// Available admin executors
+const (
+	// AdminExecutorSSH runs the riak-admin commands on a riak node through ssh
+	AdminExecutorSSH = "ssh"
+	// AdminExecutorLocal runs the riak-admin commands on the same host of riakapi
+	AdminExecutorLocal = "local"
+	// AdminExecutorMemory only records the riak-admin commands, useful for testing
+	AdminExecutorMemory = "memory"
+)
+
+// NewAdminExecutor creates the riak-admin executor selected on the configuration
+func NewAdminExecutor(cfg *config.ServiceConfig) (AdminExecutor, error) {
+	switch cfg.RiakAPIAdminExecutor {
+	case AdminExecutorSSH:
+		sshConfig := &ssh.ClientConfig{
+			User:            cfg.SSHUser,
+			Auth:            cfg.SSHAuthMethods,
+			HostKeyCallback: cfg.SSHHostKeyCallback,
+		}
+		opts := SSHOptions{
+			KeepaliveInterval: time.Duration(cfg.SSHKeepaliveInterval) * time.Second,
+			MaxSessions:       cfg.SSHMaxSessions,
+			DialAttempts:      cfg.SSHDialAttempts,
+		}
+		if len(cfg.SSHNodes) <= 1 {
+			// The only node can be a cluster host with its own ssh address
+			addr := fmt.Sprintf("%s:%d", cfg.SSHHost, cfg.SSHPort)
+			if len(cfg.SSHNodes) == 1 {
+				addr = fmt.Sprintf("%s:%d", cfg.SSHNodes[0].Host, cfg.SSHNodes[0].Port)
+			}
+			return NewSSHExecutor(addr, sshConfig, opts)
+		}
+
+		// Any node of the cluster can run the commands, connect when required so
+		// a node down doesn't stop riakapi
+		nodes := make([]*AdminNode, 0, len(cfg.SSHNodes))
+		for _, n := range cfg.SSHNodes {
+			addr := fmt.Sprintf("%s:%d", n.Host, n.Port)
+			nodes = append(nodes, &AdminNode{Name: addr, Executor: NewLazySSHExecutor(addr, sshConfig, opts)})
+		}
+		return NewFailoverExecutor(nodes...), nil
+	case AdminExecutorLocal:
+		return NewLocalExecutor(), nil
+	case AdminExecutorMemory:
+		logrus.Warning("riak-admin commands will not be run, only recorded")
+		return NewMemoryExecutor(nil), nil
+	}
+	return nil, fmt.Errorf("'%s' is not a valid riak-admin executor", cfg.RiakAPIAdminExecutor)
+}
+
+// AdminExecutor runs riak-admin commands, all the riak-admin interactions go
+// through it
+type AdminExecutor interface {
+	// Run runs the command and returns its standard output, the command exit
+	// status different from 0 is an error. When the command can't be run
+	// because the node is not reachable ErrBackendUnavailable is returned. The
+	// command is killed when the context is done and its error returned
+	Run(ctx context.Context, cmd string) ([]byte, error)
+	// Close releases the executor resources
+	Close() error
+}
+
+// CommandError is returned when a riak-admin command exits with a status
+// different from 0, riak-admin prints some errors on stdout and others on stderr
+type CommandError struct {
+	ExitStatus int
+	Stdout     []byte
+	Stderr     []byte
+}
+
+// Error returns the command output, the command isn't included because it could
+// have passwords
+func (e *CommandError) Error() string {
+	msg := strings.TrimSpace(string(e.Stderr))
+	if msg == "" {
+		msg = strings.TrimSpace(string(e.Stdout))
+	}
+	return fmt.Sprintf("riak-admin exited with status %d: %s", e.ExitStatus, msg)
+}
+
+// LocalExecutor runs the commands on the local host, for riakapi running on a
+// riak node
+type LocalExecutor struct {
+	// Shell is the shell used to run the commands (they use pipes), default 'sh'
+	Shell string
+}
+
+// NewLocalExecutor creates a local executor
+func NewLocalExecutor() *LocalExecutor {
+	return &LocalExecutor{Shell: "sh"}
+}
+
+// Run runs the command on the local shell
+func (e *LocalExecutor) Run(ctx context.Context, cmd string) ([]byte, error) {
+	logrus.Debugf("Running '%s' locally", redactCommand(cmd))
+	out, err := exec.CommandContext(ctx, e.Shell, "-c", cmd).Output()
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("riak-admin command not finished: %w", ctx.Err())
+	}
+	if err != nil {
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			return nil, fmt.Errorf("%w: could not run command: %v", ErrBackendUnavailable, err)
+		}
+		return out, &CommandError{ExitStatus: exitErr.ExitCode(), Stdout: out, Stderr: exitErr.Stderr}
+	}
+	return out, nil
+}
+
+// Close does nothing, there aren't resources to release
+func (e *LocalExecutor) Close() error {
+	return nil
+}
+
+// MemoryExecutor records the commands without running them, the optional
+// handler answers each command
+type MemoryExecutor struct {
+	// Handler returns the output (or error) of the commands, all the commands
+	// succeed with empty output if not set
+	Handler func(cmd string) ([]byte, error)
+
+	commands []string
+	mutex    sync.Mutex
+}
+
+// NewMemoryExecutor creates a recording executor
+func NewMemoryExecutor(handler func(cmd string) ([]byte, error)) *MemoryExecutor {
+	return &MemoryExecutor{Handler: handler}
+}
+
+// Run records the command and returns the handler answer
+func (e *MemoryExecutor) Run(ctx context.Context, cmd string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("riak-admin command not run: %w", err)
+	}
+
+	e.mutex.Lock()
+	e.commands = append(e.commands, cmd)
+	e.mutex.Unlock()
+
+	if e.Handler == nil {
+		return []byte{}, nil
+	}
+	return e.Handler(cmd)
+}
+
+// Commands returns the recorded commands in order
+func (e *MemoryExecutor) Commands() []string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return append([]string{}, e.commands...)
+}
+
+// Close does nothing, there aren't resources to release
+func (e *MemoryExecutor) Close() error {
+	return nil
+}
@@ -0,0 +1,64 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestLocalExecutorRun(t *testing.T) {
+	e := NewLocalExecutor()
+
+	out, err := e.Run(context.Background(), "echo riak | tr a-z A-Z")
+	if err != nil {
+		t.Errorf("Error running command: %v", err)
+	}
+	if string(out) != "RIAK\n" {
+		t.Errorf("Expected command output; got: %s", out)
+	}
+
+	if _, err := e.Run(context.Background(), "exit 1"); err == nil || errors.Is(err, ErrBackendUnavailable) {
+		t.Errorf("Expected command error; got: %v", err)
+	}
+
+	// Stderr is present on the command errors
+	_, err = e.Run(context.Background(), "echo 'user already exists' >&2; exit 3")
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) || cmdErr.ExitStatus != 3 || err.Error() != "riak-admin exited with status 3: user already exists" {
+		t.Errorf("Expected command error with stderr; got: %v", err)
+	}
+
+	e.Shell = "/not/present/shell"
+	if _, err := e.Run(context.Background(), "echo riak"); !errors.Is(err, ErrBackendUnavailable) {
+		t.Errorf("Expected unavailable error; got: %v", err)
+	}
+}
+
+func TestMemoryExecutorRun(t *testing.T) {
+	e := NewMemoryExecutor(func(cmd string) ([]byte, error) {
+		if cmd == "fail" {
+			return nil, errors.New("exit status 1")
+		}
+		return []byte("ok"), nil
+	})
+
+	if out, err := e.Run(context.Background(), "riak-admin status"); err != nil || string(out) != "ok" {
+		t.Errorf("Expected handler output; got: %s, %v", out, err)
+	}
+	if _, err := e.Run(context.Background(), "fail"); err == nil {
+		t.Errorf("Expected handler error")
+	}
+
+	// Done contexts don't run the command
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := e.Run(ctx, "riak-admin cancelled"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected cancelled error; got: %v", err)
+	}
+
+	want := []string{"riak-admin status", "fail"}
+	got := e.Commands()
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("Expected commands %#v;\ngot: %#v", want, got)
+	}
+}
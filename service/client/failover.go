@@ -0,0 +1,107 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// nodeDownOutputs are the riak-admin outputs of a node that is not running
+var nodeDownOutputs = [][]byte{
+	[]byte("Node is not running"),
+	[]byte("not responding to pings"),
+}
+
+// AdminNode is a riak node where the riak-admin commands can be run
+type AdminNode struct {
+	// Name identifies the node on the logs
+	Name string
+	// Executor runs the commands on the node
+	Executor AdminExecutor
+}
+
+// FailoverExecutor runs the commands on the first healthy node of the cluster,
+// when a node can't be reached or riak is down on it the next node is tried.
+// Security changes and bucket types are cluster metadata, so running them on
+// any node applies them on the whole cluster
+type FailoverExecutor struct {
+	nodes []*AdminNode
+
+	mutex sync.Mutex
+	// current is the node used last time, the first one tried on each command
+	current int
+}
+
+// NewFailoverExecutor creates the executor, the nodes are tried in order
+func NewFailoverExecutor(nodes ...*AdminNode) *FailoverExecutor {
+	return &FailoverExecutor{nodes: nodes}
+}
+
+// Run runs the command starting on the last healthy node, if every node is
+// down ErrBackendUnavailable is returned. Done contexts aren't retried
+func (e *FailoverExecutor) Run(ctx context.Context, cmd string) ([]byte, error) {
+	if len(e.nodes) == 0 {
+		return nil, fmt.Errorf("%w: no riak-admin nodes", ErrBackendUnavailable)
+	}
+
+	e.mutex.Lock()
+	start := e.current
+	e.mutex.Unlock()
+
+	var lastErr error
+	for i := 0; i < len(e.nodes); i++ {
+		idx := (start + i) % len(e.nodes)
+		node := e.nodes[idx]
+
+		out, err := node.Executor.Run(ctx, cmd)
+		if ctx.Err() != nil {
+			return out, err
+		}
+		if !nodeDown(out, err) {
+			if idx != start {
+				logrus.Infof("Running riak-admin commands on node '%s'", node.Name)
+				e.mutex.Lock()
+				e.current = idx
+				e.mutex.Unlock()
+			}
+			return out, err
+		}
+
+		lastErr = fmt.Errorf("node '%s': %v", node.Name, err)
+		logrus.Warningf("Could not run riak-admin on node '%s', trying next node: %v", node.Name, err)
+	}
+	return nil, fmt.Errorf("%w: all riak-admin nodes failed, last %v", ErrBackendUnavailable, lastErr)
+}
+
+// Close closes all the nodes executors
+func (e *FailoverExecutor) Close() error {
+	var err error
+	for _, n := range e.nodes {
+		if cErr := n.Executor.Close(); cErr != nil {
+			err = cErr
+		}
+	}
+	return err
+}
+
+// nodeDown checks if the command failed because the node (or riak on it) is
+// down, in that case the command can be run on other node. The interrupted
+// commands could have run on the node, they are not run again
+func nodeDown(out []byte, err error) bool {
+	if err == nil || errors.Is(err, ErrCommandInterrupted) {
+		return false
+	}
+	if errors.Is(err, ErrBackendUnavailable) {
+		return true
+	}
+	for _, o := range nodeDownOutputs {
+		if bytes.Contains(out, o) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestFailoverExecutorRun(t *testing.T) {
+	down := map[string]bool{}
+	node := func(name string) *AdminNode {
+		return &AdminNode{Name: name, Executor: NewMemoryExecutor(func(cmd string) ([]byte, error) {
+			if down[name] {
+				return []byte("Node is not running!\n"), errors.New("exit status 1")
+			}
+			if cmd == "fail" {
+				return []byte("Error: bad command\n"), errors.New("exit status 1")
+			}
+			return []byte(name), nil
+		})}
+	}
+	unreachable := &AdminNode{Name: "n0", Executor: NewMemoryExecutor(func(cmd string) ([]byte, error) {
+		return nil, fmt.Errorf("%w: connection refused", ErrBackendUnavailable)
+	})}
+	e := NewFailoverExecutor(unreachable, node("n1"), node("n2"))
+
+	if out, err := e.Run(context.Background(), "status"); err != nil || string(out) != "n1" {
+		t.Errorf("Expected command run on n1; got: %s, %v", out, err)
+	}
+
+	// Command errors are not node errors
+	if _, err := e.Run(context.Background(), "fail"); err == nil || errors.Is(err, ErrBackendUnavailable) {
+		t.Errorf("Expected command error; got: %v", err)
+	}
+
+	down["n1"] = true
+	if out, err := e.Run(context.Background(), "status"); err != nil || string(out) != "n2" {
+		t.Errorf("Expected command run on n2; got: %s, %v", out, err)
+	}
+
+	// The last healthy node is used first
+	down["n1"] = false
+	if out, err := e.Run(context.Background(), "status"); err != nil || string(out) != "n2" {
+		t.Errorf("Expected command run on n2; got: %s, %v", out, err)
+	}
+	if got := len(unreachable.Executor.(*MemoryExecutor).Commands()); got != 1 {
+		t.Errorf("Expected 1 command on the unreachable node; got: %d", got)
+	}
+
+	down["n1"], down["n2"] = true, true
+	if _, err := e.Run(context.Background(), "status"); !errors.Is(err, ErrBackendUnavailable) {
+		t.Errorf("Expected unavailable error; got: %v", err)
+	}
+
+	// Cancelled commands are not failed over
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := e.Run(ctx, "status"); !errors.Is(err, context.Canceled) || errors.Is(err, ErrBackendUnavailable) {
+		t.Errorf("Expected cancelled error; got: %v", err)
+	}
+
+	// Interrupted commands could have run, they are not run on other node
+	interrupted := &AdminNode{Name: "n3", Executor: NewMemoryExecutor(func(cmd string) ([]byte, error) {
+		return nil, fmt.Errorf("%w: connection lost", ErrCommandInterrupted)
+	})}
+	n4 := node("n4")
+	e = NewFailoverExecutor(interrupted, n4)
+	if _, err := e.Run(context.Background(), "status"); !errors.Is(err, ErrCommandInterrupted) {
+		t.Errorf("Expected interrupted error; got: %v", err)
+	}
+	if got := len(n4.Executor.(*MemoryExecutor).Commands()); got != 0 {
+		t.Errorf("Expected no commands on the next node; got: %d", got)
+	}
+}
@@ -0,0 +1,462 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	riak "github.com/basho/riak-go-client"
+)
+
+// RiakLocksBucket holds the leases of the locked users and buckets
+const RiakLocksBucket = "tsuru-locks"
+
+// defaultLocksBucketType is the riak default bucket type (not strongly consistent)
+const defaultLocksBucketType = "default"
+
+// Default lock leases
+const (
+	defaultLockTTL     = 60 * time.Second
+	minLockPollWait    = 50 * time.Millisecond
+	maxLockPollWait    = time.Second
+	lockReleaseTimeout = 10 * time.Second
+	lockRenewTimeout   = 10 * time.Second
+)
+
+// ErrLockHeld is returned by the lock stores when the lease is present or it
+// was changed by other owner
+var ErrLockHeld = errors.New("lock held")
+
+// LockLease is the lock of a key, valid until it expires so the locks of
+// crashed replicas are released
+type LockLease struct {
+	Owner   string    `json:"owner"`
+	Expires time.Time `json:"expires"`
+}
+
+// LockStore stores the lock leases, the writes are conditional so only one
+// owner gets the lock
+type LockStore interface {
+	// Create stores the lease if the key is not locked, ErrLockHeld if it is
+	Create(ctx context.Context, key string, lease *LockLease) error
+	// Get returns the lease and its version, nil if the key is not locked
+	Get(ctx context.Context, key string) (lease *LockLease, version []byte, err error)
+	// Replace stores the lease if the lock didn't change since the version was
+	// read, ErrLockHeld if it did
+	Replace(ctx context.Context, key string, lease *LockLease, version []byte) error
+	// Delete removes the lease of the version
+	Delete(ctx context.Context, key string, version []byte) error
+}
+
+// Locker serializes the changes of the same user or bucket across the riakapi
+// replicas (and the concurrent requests of a replica). A nil locker doesn't lock
+type Locker struct {
+	Store LockStore
+	// TTL is the lease duration, the leases are renewed while the keys are
+	// locked so a longer operation doesn't lose them
+	TTL time.Duration
+}
+
+// NewLocker creates a locker, zero ttl uses the default
+func NewLocker(store LockStore, ttl time.Duration) *Locker {
+	if ttl <= 0 {
+		ttl = defaultLockTTL
+	}
+	return &Locker{Store: store, TTL: ttl}
+}
+
+// userLockKey and bucketLockKey are the lock keys of the users and buckets,
+// the bucket locks are acquired before the user locks
+func userLockKey(username string) string     { return "user/" + username }
+func bucketLockKey(bucketName string) string { return "bucket/" + bucketName }
+
+// Lock acquires the locks of the keys waiting until they are released or the
+// context is done, the returned function releases them. The keys are locked
+// in order so the operations locking the same keys don't wait on each other.
+// The leases are renewed until released
+func (l *Locker) Lock(ctx context.Context, keys ...string) (unlock func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	keys = append([]string{}, keys...)
+	sort.Strings(keys)
+	owner, err := newLockOwner()
+	if err != nil {
+		return nil, fmt.Errorf("Could not lock: %w", err)
+	}
+
+	var mutex sync.Mutex
+	locked := []string{}
+	lockedKeys := func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]string{}, locked...)
+	}
+
+	// The first keys are renewed while waiting for the next ones
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		l.renew(stop, owner, lockedKeys)
+	}()
+
+	unlock = func() {
+		close(stop)
+		<-stopped
+		keys := lockedKeys()
+		for i := len(keys) - 1; i >= 0; i-- {
+			l.release(keys[i], owner)
+		}
+	}
+	for _, k := range keys {
+		if err := l.acquire(ctx, k, owner); err != nil {
+			unlock()
+			return nil, err
+		}
+		mutex.Lock()
+		locked = append(locked, k)
+		mutex.Unlock()
+	}
+	return unlock, nil
+}
+
+// renew extends the leases of the locked keys every third of the TTL until
+// stopped
+func (l *Locker) renew(stop <-chan struct{}, owner string, locked func() []string) {
+	ticker := time.NewTicker(l.TTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		for _, k := range locked() {
+			if err := l.renewLease(k, owner); err != nil {
+				logrus.Errorf("Could not renew lock '%s', it could expire before unlocking it: %v", k, err)
+			}
+		}
+	}
+}
+
+// renewLease replaces the key lease with a new expiration if it's still owned,
+// it has its own timeout like the release
+func (l *Locker) renewLease(key, owner string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), lockRenewTimeout)
+	defer cancel()
+
+	held, version, err := l.Store.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	if held == nil || held.Owner != owner {
+		return fmt.Errorf("%w: lease expired and taken over", ErrLockHeld)
+	}
+	lease := &LockLease{Owner: owner, Expires: time.Now().Add(l.TTL).UTC()}
+	if err := l.Store.Replace(ctx, key, lease, version); err != nil {
+		return err
+	}
+	logrus.Debugf("Renewed lock '%s'", key)
+	return nil
+}
+
+// acquire waits until the key lease is created for the owner
+func (l *Locker) acquire(ctx context.Context, key, owner string) error {
+	wait := minLockPollWait
+	for {
+		acquired, err := l.tryAcquire(ctx, key, owner)
+		if err != nil {
+			return fmt.Errorf("Could not lock '%s': %w", key, err)
+		}
+		if acquired {
+			logrus.Debugf("Locked '%s'", key)
+			return nil
+		}
+
+		logrus.Debugf("'%s' is locked, waiting %v", key, wait)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return fmt.Errorf("Could not lock '%s': %w", key, ctx.Err())
+		}
+		if wait *= 2; wait > maxLockPollWait {
+			wait = maxLockPollWait
+		}
+	}
+}
+
+// tryAcquire creates the key lease, an expired lease is replaced. The lease is
+// read back after creating it, a concurrent create could have won it
+func (l *Locker) tryAcquire(ctx context.Context, key, owner string) (bool, error) {
+	lease := &LockLease{Owner: owner, Expires: time.Now().Add(l.TTL).UTC()}
+	err := l.Store.Create(ctx, key, lease)
+	if err != nil && !errors.Is(err, ErrLockHeld) {
+		return false, err
+	}
+
+	held, version, err := l.Store.Get(ctx, key)
+	switch {
+	case err != nil:
+		return false, err
+	case held == nil: // Released meanwhile
+		return false, nil
+	case held.Owner == owner: // Created (maybe by a retried store)
+		return true, nil
+	case time.Now().Before(held.Expires):
+		return false, nil
+	}
+
+	logrus.Warningf("Lock '%s' of '%s' expired at %v, taking it over", key, held.Owner, held.Expires)
+	if err := l.Store.Replace(ctx, key, lease, version); err != nil {
+		if errors.Is(err, ErrLockHeld) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// release deletes the key lease if it's still owned, the request context
+// could be done so it has its own timeout
+func (l *Locker) release(key, owner string) {
+	ctx, cancel := context.WithTimeout(context.Background(), lockReleaseTimeout)
+	defer cancel()
+
+	held, version, err := l.Store.Get(ctx, key)
+	if err != nil {
+		logrus.Errorf("Could not unlock '%s', it will be unlocked when it expires: %v", key, err)
+		return
+	}
+	if held == nil || held.Owner != owner {
+		logrus.Warningf("Lock '%s' expired before unlocking it", key)
+		return
+	}
+	if err := l.Store.Delete(ctx, key, version); err != nil {
+		logrus.Errorf("Could not unlock '%s', it will be unlocked when it expires: %v", key, err)
+		return
+	}
+	logrus.Debugf("Unlocked '%s'", key)
+}
+
+// newLockOwner returns a unique owner of the locks, the host name is kept to
+// find the replica holding the lock
+func newLockOwner() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s/%s", host, hex.EncodeToString(b)), nil
+}
+
+// RiakLockStore stores the leases on riak with conditional stores (if_none_match
+// and if_not_modified). On a strongly consistent bucket type the conditional
+// stores are linearizable and a lock is held by one owner at most. On other
+// bucket types they are checked by the coordinating node only, so concurrent
+// creates on different nodes (or partitions) could both succeed: they become
+// siblings (allow_mult) and every replica picks the same winner, or the last
+// write wins. Then two owners could hold a lock until the loser reads it back
+type RiakLockStore struct {
+	Client *Riak
+	// BucketType of the locks bucket, empty is the default bucket type
+	BucketType string
+}
+
+// Create stores the lease if the key is not present
+func (s *RiakLockStore) Create(ctx context.Context, key string, lease *LockLease) error {
+	return s.store(ctx, key, lease, nil)
+}
+
+// Get fetches the lease and its vclock, the winner lease of the siblings
+func (s *RiakLockStore) Get(ctx context.Context, key string) (*LockLease, []byte, error) {
+	cmd, err := riak.NewFetchValueCommandBuilder().
+		WithBucketType(s.bucketType()).
+		WithBucket(RiakLocksBucket).
+		WithKey(key).
+		Build()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = s.Client.execute(ctx, cmd); err != nil {
+		return nil, nil, err
+	}
+
+	fvc, ok := cmd.(*riak.FetchValueCommand)
+	if !ok {
+		return nil, nil, errors.New("Could not fetch any value")
+	}
+	if len(fvc.Response.Values) == 0 {
+		return nil, nil, nil
+	}
+
+	leases := make([]*LockLease, 0, len(fvc.Response.Values))
+	for _, v := range fvc.Response.Values {
+		lease := &LockLease{}
+		if err := json.Unmarshal(v.Value, lease); err != nil {
+			return nil, nil, fmt.Errorf("Could not decode lock lease: %w", err)
+		}
+		leases = append(leases, lease)
+	}
+	// The vclock covers all the siblings, storing with it resolves them
+	return winningLease(leases), fvc.Response.VClock, nil
+}
+
+// winningLease picks the lease of the concurrent creates (siblings), the same
+// one on all the replicas: the lowest owner
+func winningLease(leases []*LockLease) *LockLease {
+	var winner *LockLease
+	for _, l := range leases {
+		if winner == nil || l.Owner < winner.Owner {
+			winner = l
+		}
+	}
+	return winner
+}
+
+// Replace stores the lease if the vclock didn't change
+func (s *RiakLockStore) Replace(ctx context.Context, key string, lease *LockLease, version []byte) error {
+	return s.store(ctx, key, lease, version)
+}
+
+// Delete removes the lease of the vclock
+func (s *RiakLockStore) Delete(ctx context.Context, key string, version []byte) error {
+	cmd, err := riak.NewDeleteValueCommandBuilder().
+		WithBucketType(s.bucketType()).
+		WithBucket(RiakLocksBucket).
+		WithKey(key).
+		WithVClock(version).
+		Build()
+	if err != nil {
+		return err
+	}
+	return s.Client.execute(ctx, cmd)
+}
+
+// store creates the lease (nil vclock) or replaces the one of the vclock
+func (s *RiakLockStore) store(ctx context.Context, key string, lease *LockLease, vclock []byte) error {
+	value, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+	obj := &riak.Object{
+		ContentType:     "application/json",
+		Charset:         "utf-8",
+		ContentEncoding: "utf-8",
+		Value:           value,
+	}
+
+	b := riak.NewStoreValueCommandBuilder().
+		WithBucketType(s.bucketType()).
+		WithBucket(RiakLocksBucket).
+		WithKey(key).
+		WithContent(obj)
+	if vclock == nil {
+		b = b.WithIfNoneMatch(true)
+	} else {
+		b = b.WithVClock(vclock).WithIfNotModified(true)
+	}
+	cmd, err := b.Build()
+	if err != nil {
+		return err
+	}
+
+	err = s.Client.execute(ctx, cmd)
+	if err == nil {
+		return nil
+	}
+
+	// The failure reason isn't a riak error code, the lease tells if the
+	// condition failed: present when creating or changed when replacing
+	held, version, getErr := s.Get(ctx, key)
+	if getErr != nil {
+		return err
+	}
+	if held != nil && (vclock == nil || !bytes.Equal(version, vclock)) {
+		return fmt.Errorf("%w: %v", ErrLockHeld, err)
+	}
+	return err
+}
+
+// bucketType returns the bucket type of the locks bucket
+func (s *RiakLockStore) bucketType() string {
+	if s.BucketType == "" {
+		return defaultLocksBucketType
+	}
+	return s.BucketType
+}
+
+// MemoryLockStore stores the leases on memory (for tests and a single replica)
+type MemoryLockStore struct {
+	mutex   sync.Mutex
+	leases  map[string]LockLease
+	version int
+	// versions are the version of each lease, changed on each store
+	versions map[string]string
+}
+
+// NewMemoryLockStore creates an empty memory lock store
+func NewMemoryLockStore() *MemoryLockStore {
+	return &MemoryLockStore{leases: map[string]LockLease{}, versions: map[string]string{}}
+}
+
+// Create stores the lease if the key is not present
+func (s *MemoryLockStore) Create(ctx context.Context, key string, lease *LockLease) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.leases[key]; ok {
+		return ErrLockHeld
+	}
+	s.put(key, lease)
+	return nil
+}
+
+// Get returns the lease and its version
+func (s *MemoryLockStore) Get(ctx context.Context, key string) (*LockLease, []byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	lease, ok := s.leases[key]
+	if !ok {
+		return nil, nil, nil
+	}
+	return &lease, []byte(s.versions[key]), nil
+}
+
+// Replace stores the lease if the version didn't change
+func (s *MemoryLockStore) Replace(ctx context.Context, key string, lease *LockLease, version []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.versions[key] != string(version) {
+		return ErrLockHeld
+	}
+	s.put(key, lease)
+	return nil
+}
+
+// Delete removes the lease if the version didn't change
+func (s *MemoryLockStore) Delete(ctx context.Context, key string, version []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.versions[key] == string(version) {
+		delete(s.leases, key)
+		delete(s.versions, key)
+	}
+	return nil
+}
+
+func (s *MemoryLockStore) put(key string, lease *LockLease) {
+	s.version++
+	s.leases[key] = *lease
+	s.versions[key] = fmt.Sprint(s.version)
+}
@@ -0,0 +1,221 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLockerLock(t *testing.T) {
+	store := NewMemoryLockStore()
+	l := NewLocker(store, time.Minute)
+
+	unlock, err := l.Lock(context.Background(), userLockKey("tsuru_myapp"), bucketLockKey("instance-a"))
+	if err != nil {
+		t.Fatalf("Error locking: %v", err)
+	}
+	for _, k := range []string{"user/tsuru_myapp", "bucket/instance-a"} {
+		if lease, _, _ := store.Get(context.Background(), k); lease == nil {
+			t.Errorf("Expected '%s' locked", k)
+		}
+	}
+
+	// Other keys are not locked
+	unlockOther, err := l.Lock(context.Background(), bucketLockKey("instance-b"))
+	if err != nil {
+		t.Errorf("Error locking other key: %v", err)
+	} else {
+		unlockOther()
+	}
+
+	// Locked keys wait until the context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := l.Lock(ctx, bucketLockKey("instance-a")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected deadline error waiting for the lock; got: %v", err)
+	}
+
+	unlock()
+	for _, k := range []string{"user/tsuru_myapp", "bucket/instance-a"} {
+		if lease, _, _ := store.Get(context.Background(), k); lease != nil {
+			t.Errorf("Expected '%s' unlocked", k)
+		}
+	}
+}
+
+func TestLockerRenewsLeases(t *testing.T) {
+	store := NewMemoryLockStore()
+	l := NewLocker(store, 90*time.Millisecond)
+	key := userLockKey("tsuru_myapp")
+
+	unlock, err := l.Lock(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Error locking: %v", err)
+	}
+	locked, _, _ := store.Get(context.Background(), key)
+
+	// Held longer than the TTL, the lease is not taken over
+	time.Sleep(300 * time.Millisecond)
+	renewed, _, _ := store.Get(context.Background(), key)
+	if renewed == nil || renewed.Owner != locked.Owner || !renewed.Expires.After(locked.Expires) {
+		t.Errorf("Expected lease renewed; got: %+v", renewed)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := l.Lock(ctx, key); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected renewed lock held; got: %v", err)
+	}
+
+	unlock()
+	if lease, _, _ := store.Get(context.Background(), key); lease != nil {
+		t.Errorf("Expected '%s' unlocked; got: %+v", key, lease)
+	}
+}
+
+func TestLockerLockSerializes(t *testing.T) {
+	l := NewLocker(NewMemoryLockStore(), time.Minute)
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	running, maxRunning := 0, 0
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock, err := l.Lock(context.Background(), userLockKey("tsuru_myapp"))
+			if err != nil {
+				t.Errorf("Error locking: %v", err)
+				return
+			}
+			defer unlock()
+
+			mutex.Lock()
+			if running++; running > maxRunning {
+				maxRunning = running
+			}
+			mutex.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			mutex.Lock()
+			running--
+			mutex.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if maxRunning != 1 {
+		t.Errorf("Expected 1 lock holder at most; got: %d", maxRunning)
+	}
+}
+
+func TestLockerExpiredLease(t *testing.T) {
+	store := NewMemoryLockStore()
+	l := NewLocker(store, time.Minute)
+	key := userLockKey("tsuru_myapp")
+
+	// Lock of a crashed replica
+	store.Create(context.Background(), key, &LockLease{Owner: "crashed", Expires: time.Now().Add(-time.Second)})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	unlock, err := l.Lock(ctx, key)
+	if err != nil {
+		t.Fatalf("Expected expired lock taken over; got: %v", err)
+	}
+	if lease, _, _ := store.Get(context.Background(), key); lease == nil || lease.Owner == "crashed" {
+		t.Errorf("Expected lease replaced; got: %+v", lease)
+	}
+	unlock()
+
+	// Leases expired and taken by others are not released
+	unlock, err = l.Lock(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Error locking: %v", err)
+	}
+	_, version, _ := store.Get(context.Background(), key)
+	other := &LockLease{Owner: "other", Expires: time.Now().Add(time.Minute)}
+	store.Replace(context.Background(), key, other, version)
+	unlock()
+	if lease, _, _ := store.Get(context.Background(), key); lease == nil || lease.Owner != "other" {
+		t.Errorf("Expected the other owner lease kept; got: %+v", lease)
+	}
+}
+
+func TestLockerRetriedCreate(t *testing.T) {
+	store := NewMemoryLockStore()
+	l := NewLocker(store, time.Minute)
+	key := bucketLockKey("instance-a")
+
+	// The lease was stored by a failed (retried) create of the same owner
+	store.Create(context.Background(), key, &LockLease{Owner: "me", Expires: time.Now().Add(time.Minute)})
+	if acquired, err := l.tryAcquire(context.Background(), key, "me"); err != nil || !acquired {
+		t.Errorf("Expected own lease acquired; got: %t, %v", acquired, err)
+	}
+	if acquired, err := l.tryAcquire(context.Background(), key, "other"); err != nil || acquired {
+		t.Errorf("Expected held lease not acquired; got: %t, %v", acquired, err)
+	}
+
+	// Nil lockers don't lock
+	var nilLocker *Locker
+	if unlock, err := nilLocker.Lock(context.Background(), key); err != nil {
+		t.Errorf("Error locking without locker: %v", err)
+	} else {
+		unlock()
+	}
+}
+
+// lostCreateStore acknowledges the creates of locked keys without storing
+// them, like a concurrent create that lost as a sibling
+type lostCreateStore struct {
+	*MemoryLockStore
+}
+
+func (s *lostCreateStore) Create(ctx context.Context, key string, lease *LockLease) error {
+	if err := s.MemoryLockStore.Create(ctx, key, lease); err != ErrLockHeld {
+		return err
+	}
+	return nil
+}
+
+func TestLockerLostCreate(t *testing.T) {
+	store := &lostCreateStore{NewMemoryLockStore()}
+	l := NewLocker(store, time.Minute)
+	key := bucketLockKey("instance-a")
+
+	unlock, err := l.Lock(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Error locking: %v", err)
+	}
+	defer unlock()
+
+	// The acknowledged create is read back, the lock is still held
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := l.Lock(ctx, key); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected deadline error waiting for the lock; got: %v", err)
+	}
+}
+
+func TestWinningLease(t *testing.T) {
+	expires := time.Now()
+	a := &LockLease{Owner: "host-a/01", Expires: expires}
+	b := &LockLease{Owner: "host-b/02", Expires: expires}
+
+	tests := []struct {
+		givenLeases []*LockLease
+
+		wantLease *LockLease
+	}{
+		{givenLeases: nil, wantLease: nil},
+		{givenLeases: []*LockLease{b}, wantLease: b},
+		{givenLeases: []*LockLease{a, b}, wantLease: a},
+		{givenLeases: []*LockLease{b, a}, wantLease: a},
+	}
+
+	for _, test := range tests {
+		if got := winningLease(test.givenLeases); got != test.wantLease {
+			t.Errorf("Expected lease %+v; got: %+v", test.wantLease, got)
+		}
+	}
+}
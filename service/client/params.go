@@ -0,0 +1,149 @@
+package client
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	riak "github.com/basho/riak-go-client"
+)
+
+// Riak protocol buffers special values for the quorum bucket properties
+const (
+	quorumOne     uint32 = math.MaxUint32 - 1
+	quorumQuorum  uint32 = math.MaxUint32 - 2
+	quorumAll     uint32 = math.MaxUint32 - 3
+	quorumDefault uint32 = math.MaxUint32 - 4
+)
+
+// quorumValues are the named values accepted by the quorum bucket properties
+var quorumValues = map[string]uint32{
+	"one":     quorumOne,
+	"quorum":  quorumQuorum,
+	"all":     quorumAll,
+	"default": quorumDefault,
+}
+
+// bucketParamSetter applies a parameter value to the bucket props command
+type bucketParamSetter func(b *riak.StoreBucketPropsCommandBuilder, value string) error
+
+// bucketParams are the bucket properties that can be set on instance creation,
+// the plans select which of them are allowed
+var bucketParams = map[string]bucketParamSetter{
+	"n_val": func(b *riak.StoreBucketPropsCommandBuilder, v string) error {
+		n, err := strconv.ParseUint(v, 10, 32)
+		if err != nil || n == 0 {
+			return fmt.Errorf("'%s' is not a positive number", v)
+		}
+		b.WithNVal(uint32(n))
+		return nil
+	},
+	"r":               quorumParam((*riak.StoreBucketPropsCommandBuilder).WithR),
+	"pr":              quorumParam((*riak.StoreBucketPropsCommandBuilder).WithPr),
+	"w":               quorumParam((*riak.StoreBucketPropsCommandBuilder).WithW),
+	"pw":              quorumParam((*riak.StoreBucketPropsCommandBuilder).WithPw),
+	"dw":              quorumParam((*riak.StoreBucketPropsCommandBuilder).WithDw),
+	"rw":              quorumParam((*riak.StoreBucketPropsCommandBuilder).WithRw),
+	"allow_mult":      boolParam((*riak.StoreBucketPropsCommandBuilder).WithAllowMult),
+	"last_write_wins": boolParam((*riak.StoreBucketPropsCommandBuilder).WithLastWriteWins),
+	"basic_quorum":    boolParam((*riak.StoreBucketPropsCommandBuilder).WithBasicQuorum),
+	"notfound_ok":     boolParam((*riak.StoreBucketPropsCommandBuilder).WithNotFoundOk),
+}
+
+// quorumParam creates a setter for quorum properties, these accept a number or
+// one of the named values (one, quorum, all, default)
+func quorumParam(set func(*riak.StoreBucketPropsCommandBuilder, uint32) *riak.StoreBucketPropsCommandBuilder) bucketParamSetter {
+	return func(b *riak.StoreBucketPropsCommandBuilder, v string) error {
+		if q, ok := quorumValues[v]; ok {
+			set(b, q)
+			return nil
+		}
+		n, err := strconv.ParseUint(v, 10, 32)
+		if err != nil || n == 0 || uint32(n) >= quorumDefault {
+			return fmt.Errorf("'%s' is not a valid quorum value", v)
+		}
+		set(b, uint32(n))
+		return nil
+	}
+}
+
+// boolParam creates a setter for boolean properties
+func boolParam(set func(*riak.StoreBucketPropsCommandBuilder, bool) *riak.StoreBucketPropsCommandBuilder) bucketParamSetter {
+	return func(b *riak.StoreBucketPropsCommandBuilder, v string) error {
+		value, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("'%s' is not a boolean", v)
+		}
+		set(b, value)
+		return nil
+	}
+}
+
+// validateParams checks the parameters are allowed on the plan and have valid values
+func (p Plans) validateParams(planName string, params map[string]string) error {
+	_, err := p.bucketPropsBuilder(planName, params)
+	return err
+}
+
+// bucketPropsBuilder validates the parameters and creates the builder of the
+// command that applies them to a bucket
+func (p Plans) bucketPropsBuilder(planName string, params map[string]string) (*riak.StoreBucketPropsCommandBuilder, error) {
+	plan := p.Get(planName)
+	if plan == nil {
+		return nil, ErrInvalidPlan
+	}
+
+	allowed := map[string]bool{}
+	for _, a := range plan.Parameters {
+		allowed[a] = true
+	}
+
+	b := riak.NewStoreBucketPropsCommandBuilder().WithBucketType(planName)
+	for _, k := range sortedParamNames(params) {
+		set, ok := bucketParams[k]
+		if !ok || !allowed[k] {
+			return nil, fmt.Errorf("%w: '%s' is not allowed on plan '%s'", ErrInvalidParameter, k, planName)
+		}
+		if err := set(b, params[k]); err != nil {
+			return nil, fmt.Errorf("%w: %s %v", ErrInvalidParameter, k, err)
+		}
+	}
+	return b, nil
+}
+
+// checkPlansParams checks all the plans have valid bucket type names and allow
+// only the parameters we know how to apply
+func checkPlansParams(plans Plans) error {
+	for _, p := range plans {
+		if err := ValidateName(p.Name); err != nil {
+			return fmt.Errorf("plan '%s' name is not a valid bucket type name: %v", p.Name, err)
+		}
+		for _, a := range p.Parameters {
+			if _, ok := bucketParams[a]; !ok {
+				return fmt.Errorf("plan '%s' allows unknown parameter '%s'", p.Name, a)
+			}
+		}
+	}
+	return nil
+}
+
+// sortedParamNames returns the parameter names in order
+func sortedParamNames(params map[string]string) []string {
+	names := make([]string, 0, len(params))
+	for k := range params {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// FormatParams formats the parameters in 'k=v, k2=v2' form sorted by name
+func FormatParams(params map[string]string) string {
+	pairs := make([]string, 0, len(params))
+	for _, k := range sortedParamNames(params) {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", k, params[k]))
+	}
+	return strings.Join(pairs, ", ")
+}
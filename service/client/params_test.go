@@ -0,0 +1,57 @@
+package client
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/tsuru/riakapi/config"
+)
+
+func TestPlansValidateParams(t *testing.T) {
+	plans := Plans{
+		{Name: "tsuru-kv", Parameters: []string{"n_val", "r", "allow_mult"}},
+	}
+
+	tests := []struct {
+		givenPlan   string
+		givenParams map[string]string
+
+		wantError error
+	}{
+		{givenPlan: "tsuru-kv", givenParams: nil},
+		{givenPlan: "tsuru-kv", givenParams: map[string]string{"n_val": "5", "r": "quorum", "allow_mult": "true"}},
+		{givenPlan: "tsuru-kv", givenParams: map[string]string{"r": "2"}},
+		{givenPlan: "wrong", givenParams: nil, wantError: ErrInvalidPlan},
+		{givenPlan: "tsuru-kv", givenParams: map[string]string{"w": "1"}, wantError: ErrInvalidParameter},
+		{givenPlan: "tsuru-kv", givenParams: map[string]string{"backend": "x"}, wantError: ErrInvalidParameter},
+		{givenPlan: "tsuru-kv", givenParams: map[string]string{"n_val": "0"}, wantError: ErrInvalidParameter},
+		{givenPlan: "tsuru-kv", givenParams: map[string]string{"r": "most"}, wantError: ErrInvalidParameter},
+		{givenPlan: "tsuru-kv", givenParams: map[string]string{"allow_mult": "sure"}, wantError: ErrInvalidParameter},
+	}
+
+	for _, test := range tests {
+		err := plans.validateParams(test.givenPlan, test.givenParams)
+		if test.wantError == nil && err != nil {
+			t.Errorf("Unexpected error validating %v: %v", test.givenParams, err)
+		}
+		if test.wantError != nil && !errors.Is(err, test.wantError) {
+			t.Errorf("Expected error %v validating %v; got: %v", test.wantError, test.givenParams, err)
+		}
+	}
+}
+
+func TestCheckPlansParams(t *testing.T) {
+	if err := checkPlansParams(config.DefaultPlans); err != nil {
+		t.Errorf("Default plans should be valid: %v", err)
+	}
+
+	plans := Plans{{Name: "tsuru-kv", Parameters: []string{"backend"}}}
+	if err := checkPlansParams(plans); err == nil {
+		t.Errorf("Expected error on unknown plan parameter")
+	}
+
+	plans = Plans{{Name: "tsuru kv"}}
+	if err := checkPlansParams(plans); err == nil {
+		t.Errorf("Expected error on not valid plan name")
+	}
+}
@@ -0,0 +1,106 @@
+package client
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/tsuru/riakapi/config"
+	"github.com/tsuru/riakapi/utils"
+)
+
+// encryptedPasswordPrefix prefixes the encrypted stored passwords, followed by
+// the key id and the base64 nonce and sealed password: 'enc:<key id>:<base64>'.
+// Passwords stored before the encryption are plain hex strings
+const encryptedPasswordPrefix = "enc:"
+
+// legacyPasswordSalt is the salt of the passwords derived from the username
+// before they were random, those passwords can be computed from the app host
+const legacyPasswordSalt = "xxxxxxxxx"
+
+// ErrPasswordKeyNotFound is returned when a stored password was encrypted with
+// a key not configured
+var ErrPasswordKeyNotFound = errors.New("password key not found")
+
+// PasswordCipher encrypts the stored user passwords with AES-GCM, the first key
+// encrypts and all the keys decrypt so the keys can be rotated. A nil cipher
+// stores the passwords unencrypted
+type PasswordCipher struct {
+	keyID string
+	aeads map[string]cipher.AEAD
+}
+
+// NewPasswordCipher creates the cipher of the keys, nil if there aren't keys
+func NewPasswordCipher(keys []*config.PasswordKey) (*PasswordCipher, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	c := &PasswordCipher{keyID: keys[0].ID, aeads: map[string]cipher.AEAD{}}
+	for _, k := range keys {
+		block, err := aes.NewCipher(k.Key)
+		if err != nil {
+			return nil, fmt.Errorf("Wrong password key '%s': %v", k.ID, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("Wrong password key '%s': %v", k.ID, err)
+		}
+		c.aeads[k.ID] = aead
+	}
+	return c, nil
+}
+
+// Encrypt encrypts the user password with the current key, the username is
+// authenticated so a stored password can't be copied to other user
+func (c *PasswordCipher) Encrypt(username, pass string) (string, error) {
+	if c == nil {
+		return pass, nil
+	}
+
+	aead := c.aeads[c.keyID]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("Could not encrypt password: %w", err)
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(pass), []byte(username))
+	return encryptedPasswordPrefix + c.keyID + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt decrypts the stored user password, current is false when the password
+// should be stored again (unencrypted or encrypted with an old key)
+func (c *PasswordCipher) Decrypt(username, stored string) (pass string, current bool, err error) {
+	if !strings.HasPrefix(stored, encryptedPasswordPrefix) {
+		return stored, c == nil, nil
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(stored, encryptedPasswordPrefix), ":", 2)
+	if len(parts) != 2 {
+		return "", false, errors.New("Could not decrypt password: wrong format")
+	}
+	keyID := parts[0]
+	if c == nil || c.aeads[keyID] == nil {
+		return "", false, fmt.Errorf("Could not decrypt password: %w: '%s'", ErrPasswordKeyNotFound, keyID)
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(parts[1])
+	aead := c.aeads[keyID]
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", false, errors.New("Could not decrypt password: wrong format")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(username))
+	if err != nil {
+		return "", false, fmt.Errorf("Could not decrypt password: %v", err)
+	}
+	return string(plain), keyID == c.keyID, nil
+}
+
+// isLegacyPassword checks the password is the one derived from the username
+// before the passwords were random
+func isLegacyPassword(username, pass string) bool {
+	return pass == utils.GeneratePassword(username, legacyPasswordSalt)
+}
@@ -0,0 +1,124 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/tsuru/riakapi/config"
+	"github.com/tsuru/riakapi/utils"
+)
+
+func TestPasswordCipher(t *testing.T) {
+	oldKey := &config.PasswordKey{ID: "2016", Key: bytes.Repeat([]byte{1}, 32)}
+	newKey := &config.PasswordKey{ID: "2017", Key: bytes.Repeat([]byte{2}, 32)}
+	user := "tsuru_myapp.tsuru.io"
+
+	oldCipher, err := NewPasswordCipher([]*config.PasswordKey{oldKey})
+	if err != nil {
+		t.Fatalf("Error creating cipher: %v", err)
+	}
+	c, err := NewPasswordCipher([]*config.PasswordKey{newKey, oldKey})
+	if err != nil {
+		t.Fatalf("Error creating cipher: %v", err)
+	}
+
+	stored, err := c.Encrypt(user, "secret")
+	if err != nil {
+		t.Fatalf("Error encrypting: %v", err)
+	}
+	if !strings.HasPrefix(stored, "enc:2017:") || strings.Contains(stored, "secret") {
+		t.Errorf("Expected password encrypted with the current key; got: %s", stored)
+	}
+	if again, _ := c.Encrypt(user, "secret"); again == stored {
+		t.Errorf("Expected a random nonce on each encryption")
+	}
+
+	tests := []struct {
+		givenCipher *PasswordCipher
+		givenUser   string
+		givenStored string
+
+		wantPass    string
+		wantCurrent bool
+		wantErr     bool
+	}{
+		{ // Current key
+			givenCipher: c, givenUser: user, givenStored: stored,
+			wantPass: "secret", wantCurrent: true,
+		},
+		{ // Old key, stored again
+			givenCipher: c, givenUser: user, givenStored: mustEncrypt(t, oldCipher, user, "old"),
+			wantPass: "old", wantCurrent: false,
+		},
+		{ // Unencrypted, stored again
+			givenCipher: c, givenUser: user, givenStored: "plain",
+			wantPass: "plain", wantCurrent: false,
+		},
+		{ // Unencrypted without keys
+			givenCipher: nil, givenUser: user, givenStored: "plain",
+			wantPass: "plain", wantCurrent: true,
+		},
+		{ // Password copied from other user
+			givenCipher: c, givenUser: "tsuru_other", givenStored: stored,
+			wantErr: true,
+		},
+		{ // Unknown key
+			givenCipher: oldCipher, givenUser: user, givenStored: stored,
+			wantErr: true,
+		},
+		{ // Encrypted without keys
+			givenCipher: nil, givenUser: user, givenStored: stored,
+			wantErr: true,
+		},
+		{
+			givenCipher: c, givenUser: user, givenStored: "enc:2017:not base64!",
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		pass, current, err := test.givenCipher.Decrypt(test.givenUser, test.givenStored)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("Expected error decrypting %s", test.givenStored)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Error decrypting %s: %v", test.givenStored, err)
+			continue
+		}
+		if pass != test.wantPass || current != test.wantCurrent {
+			t.Errorf("Expected %s (current %t); got: %s (current %t)", test.wantPass, test.wantCurrent, pass, current)
+		}
+	}
+
+	if _, _, err := oldCipher.Decrypt(user, stored); !errors.Is(err, ErrPasswordKeyNotFound) {
+		t.Errorf("Expected key not found error; got: %v", err)
+	}
+}
+
+func TestIsLegacyPassword(t *testing.T) {
+	user := "tsuru_myapp.tsuru.io"
+	if !isLegacyPassword(user, utils.GeneratePassword(user, "xxxxxxxxx")) {
+		t.Errorf("Expected derived password detected as legacy")
+	}
+
+	pass, err := utils.GenerateRandomPassword()
+	if err != nil {
+		t.Fatalf("Error generating password: %v", err)
+	}
+	if isLegacyPassword(user, pass) || len(pass) != 64 {
+		t.Errorf("Expected 64 characters random password; got: %s", pass)
+	}
+}
+
+func mustEncrypt(t *testing.T, c *PasswordCipher, user, pass string) string {
+	stored, err := c.Encrypt(user, pass)
+	if err != nil {
+		t.Fatalf("Error encrypting: %v", err)
+	}
+	return stored
+}
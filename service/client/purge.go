@@ -0,0 +1,298 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	riak "github.com/basho/riak-go-client"
+)
+
+// RiakPurgesInfoBucket holds the pending bucket purges, so a purge can be
+// resumed if the service crashes while it's running
+const RiakPurgesInfoBucket = "tsuru-purges"
+
+// PurgeJob is a pending deletion of all the keys of a removed instance bucket
+type PurgeJob struct {
+	BucketName string    `json:"bucket_name"`
+	BucketType string    `json:"bucket_type"`
+	Deleted    int       `json:"deleted"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+
+	// attempts is the number of failed runs of the job
+	attempts int
+}
+
+// Failed purges are retried with exponential backoff
+const (
+	purgeRetryBackoff    = 10 * time.Second
+	purgeMaxRetryBackoff = 10 * time.Minute
+)
+
+// purgeRetryDelay returns the time to wait before running a job failed the
+// attempts times
+func purgeRetryDelay(attempts int) time.Duration {
+	delay := purgeRetryBackoff
+	for i := 1; i < attempts && delay < purgeMaxRetryBackoff; i++ {
+		delay *= 2
+	}
+	if delay > purgeMaxRetryBackoff {
+		delay = purgeMaxRetryBackoff
+	}
+	return delay
+}
+
+// Purger deletes the keys of the removed buckets on background, riak doesn't
+// have a way of deleting a bucket so we need to delete all its keys one by one
+// throttling the deletion so we don't hurt the cluster. The commands run with
+// the client timeouts and retries
+type Purger struct {
+	client        *Riak
+	batchSize     int
+	batchInterval time.Duration
+	jobs          chan *PurgeJob
+}
+
+// NewPurger creates a purger and starts its worker
+func NewPurger(client *Riak, batchSize int, batchInterval time.Duration) *Purger {
+	p := &Purger{
+		client:        client,
+		batchSize:     batchSize,
+		batchInterval: batchInterval,
+		jobs:          make(chan *PurgeJob, 64),
+	}
+	go p.run()
+	return p
+}
+
+// Register stores the purge job without processing it, so it's resumed after a
+// crash. Started with Start or removed with Cancel
+func (p *Purger) Register(bucketName, bucketType string) (*PurgeJob, error) {
+	now := time.Now().UTC()
+	job := &PurgeJob{
+		BucketName: bucketName,
+		BucketType: bucketType,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	if err := p.saveJob(job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// Start queues a registered job to be processed
+func (p *Purger) Start(job *PurgeJob) {
+	// Don't block the caller if the queue is full
+	go func() { p.jobs <- job }()
+	logrus.Infof("Purge of bucket '%s' enqueued", job.BucketName)
+}
+
+// Cancel removes a registered job not started
+func (p *Purger) Cancel(job *PurgeJob) error {
+	return p.deleteJob(job)
+}
+
+// Resume enqueues all the purge jobs that didn't finish (for example a service
+// restart in the middle of a purge)
+func (p *Purger) Resume() error {
+	timeout := p.client.Timeouts.withDefaults().List
+	cmd, err := riak.NewListKeysCommandBuilder().
+		WithBucket(RiakPurgesInfoBucket).
+		WithTimeout(timeout).
+		Build()
+	if err != nil {
+		return fmt.Errorf("Could not list pending purges: %w", err)
+	}
+
+	if err = p.client.executeTimeout(context.Background(), cmd, timeout); err != nil {
+		return fmt.Errorf("Could not list pending purges: %w", err)
+	}
+
+	lkc, ok := cmd.(*riak.ListKeysCommand)
+	if !ok {
+		return errors.New("Could not list pending purges")
+	}
+
+	for _, k := range lkc.Response.Keys {
+		job, err := p.getJob(k)
+		if err != nil {
+			logrus.Errorf("Could not resume purge of bucket '%s': %v", k, err)
+			continue
+		}
+		if job == nil { // Finished meanwhile
+			continue
+		}
+		logrus.Infof("Resuming purge of bucket '%s' (%d keys already deleted)", job.BucketName, job.Deleted)
+		go func(j *PurgeJob) { p.jobs <- j }(job)
+	}
+	return nil
+}
+
+// Pending checks if the bucket has a purge not finished, its keys are still
+// being deleted
+func (p *Purger) Pending(bucketName string) (bool, error) {
+	job, err := p.getJob(bucketName)
+	if err != nil {
+		return false, fmt.Errorf("Could not get purge job: %w", err)
+	}
+	return job != nil, nil
+}
+
+// run processes the jobs one by one
+func (p *Purger) run() {
+	for job := range p.jobs {
+		if err := p.purge(job); err != nil {
+			job.attempts++
+			delay := purgeRetryDelay(job.attempts)
+			logrus.Errorf("Could not purge bucket '%s', retrying in %s: %v", job.BucketName, delay, err)
+			j := job
+			time.AfterFunc(delay, func() { p.jobs <- j })
+			continue
+		}
+		logrus.Infof("Bucket '%s' purged, %d keys deleted", job.BucketName, job.Deleted)
+	}
+}
+
+// purge streams the keys of the bucket and deletes them in batches. The
+// listing isn't retried nor time limited (the batches are throttled), a failed
+// purge is retried from the start by the worker
+func (p *Purger) purge(job *PurgeJob) error {
+	batch := make([]string, 0, p.batchSize)
+	var batchErr error
+
+	err := p.client.streamKeys(context.Background(), job.BucketType, job.BucketName, 0, func(keys []string) error {
+		for _, k := range keys {
+			batch = append(batch, k)
+			if len(batch) < p.batchSize {
+				continue
+			}
+			if batchErr = p.deleteBatch(job, batch); batchErr != nil {
+				return batchErr
+			}
+			batch = batch[:0]
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Could not list bucket keys: %w", err)
+	}
+	if batchErr != nil {
+		return batchErr
+	}
+
+	// Last batch
+	if len(batch) > 0 {
+		if err := p.deleteBatch(job, batch); err != nil {
+			return err
+		}
+	}
+
+	return p.deleteJob(job)
+}
+
+// deleteBatch deletes the keys, saves the progress and waits before the next batch
+func (p *Purger) deleteBatch(job *PurgeJob, keys []string) error {
+	for _, k := range keys {
+		cmd, err := riak.NewDeleteValueCommandBuilder().
+			WithBucketType(job.BucketType).
+			WithBucket(job.BucketName).
+			WithKey(k).
+			Build()
+		if err != nil {
+			return fmt.Errorf("Could not delete key '%s': %v", k, err)
+		}
+
+		if err = p.client.execute(context.Background(), cmd); err != nil {
+			return fmt.Errorf("Could not delete key '%s': %v", k, err)
+		}
+	}
+
+	job.Deleted += len(keys)
+	job.UpdatedAt = time.Now().UTC()
+	if err := p.saveJob(job); err != nil {
+		return err
+	}
+	logrus.Debugf("Purged %d keys from bucket '%s'", job.Deleted, job.BucketName)
+
+	time.Sleep(p.batchInterval)
+	return nil
+}
+
+// saveJob stores the purge job progress
+func (p *Purger) saveJob(job *PurgeJob) error {
+	value, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("Could not store purge job: %w", err)
+	}
+
+	obj := &riak.Object{
+		ContentType:     "application/json",
+		Charset:         "utf-8",
+		ContentEncoding: "utf-8",
+		Value:           value,
+	}
+
+	cmd, err := riak.NewStoreValueCommandBuilder().
+		WithBucket(RiakPurgesInfoBucket).
+		WithKey(job.BucketName).
+		WithContent(obj).
+		Build()
+	if err != nil {
+		return fmt.Errorf("Could not store purge job: %w", err)
+	}
+
+	if err = p.client.execute(context.Background(), cmd); err != nil {
+		return fmt.Errorf("Could not store purge job: %w", err)
+	}
+	return nil
+}
+
+// getJob retrieves a stored purge job, nil if there isn't
+func (p *Purger) getJob(bucketName string) (*PurgeJob, error) {
+	cmd, err := riak.NewFetchValueCommandBuilder().
+		WithBucket(RiakPurgesInfoBucket).
+		WithKey(bucketName).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = p.client.execute(context.Background(), cmd); err != nil {
+		return nil, err
+	}
+
+	fvc, ok := cmd.(*riak.FetchValueCommand)
+	if !ok {
+		return nil, errors.New("Could not fetch any value")
+	}
+	if len(fvc.Response.Values) == 0 {
+		return nil, nil
+	}
+
+	job := &PurgeJob{}
+	if err := json.Unmarshal(fvc.Response.Values[0].Value, job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// deleteJob removes the purge job once finished
+func (p *Purger) deleteJob(job *PurgeJob) error {
+	cmd, err := riak.NewDeleteValueCommandBuilder().
+		WithBucket(RiakPurgesInfoBucket).
+		WithKey(job.BucketName).
+		Build()
+	if err != nil {
+		return fmt.Errorf("Could not delete purge job: %w", err)
+	}
+
+	if err = p.client.execute(context.Background(), cmd); err != nil {
+		return fmt.Errorf("Could not delete purge job: %w", err)
+	}
+	return nil
+}
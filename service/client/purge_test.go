@@ -0,0 +1,25 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPurgeRetryDelay(t *testing.T) {
+	tests := []struct {
+		givenAttempts int
+
+		wantDelay time.Duration
+	}{
+		{givenAttempts: 1, wantDelay: purgeRetryBackoff},
+		{givenAttempts: 2, wantDelay: 2 * purgeRetryBackoff},
+		{givenAttempts: 3, wantDelay: 4 * purgeRetryBackoff},
+		{givenAttempts: 100, wantDelay: purgeMaxRetryBackoff},
+	}
+
+	for _, test := range tests {
+		if got := purgeRetryDelay(test.givenAttempts); got != test.wantDelay {
+			t.Errorf("Expected delay %s after %d attempts; got: %s", test.wantDelay, test.givenAttempts, got)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+	riak "github.com/basho/riak-go-client"
+)
+
+// getRegistryList returns the list of values stored on a registry key (for
+// example the users of a bucket), an empty list if there isn't anything stored
+func (c *Riak) getRegistryList(ctx context.Context, infoBucket, key string) ([]string, error) {
+	values, _, err := c.fetchRegistryList(ctx, infoBucket, key)
+	return values, err
+}
+
+// fetchRegistryList returns the list of values stored on a registry key, found
+// is false if the key is not stored (an empty list can be stored)
+func (c *Riak) fetchRegistryList(ctx context.Context, infoBucket, key string) (values []string, found bool, err error) {
+	cmd, err := riak.NewFetchValueCommandBuilder().
+		WithBucket(infoBucket).
+		WithKey(key).
+		Build()
+	if err != nil {
+		return nil, false, err
+	}
+
+	if err = c.execute(ctx, cmd); err != nil {
+		return nil, false, err
+	}
+
+	fvc, ok := cmd.(*riak.FetchValueCommand)
+	if !ok {
+		return nil, false, errors.New("Could not fetch any value")
+	}
+
+	values = []string{}
+	if len(fvc.Response.Values) == 0 {
+		return values, false, nil
+	}
+
+	if err := json.Unmarshal(fvc.Response.Values[0].Value, &values); err != nil {
+		return nil, false, fmt.Errorf("Could not decode '%s' from '%s': %v", key, infoBucket, err)
+	}
+	return values, true, nil
+}
+
+// storeRegistryList saves the list of values on a registry key, if there are
+// no values the key is deleted
+func (c *Riak) storeRegistryList(ctx context.Context, infoBucket, key string, values []string) error {
+	if len(values) > 0 {
+		return c.saveRegistryList(ctx, infoBucket, key, values)
+	}
+
+	cmd, err := riak.NewDeleteValueCommandBuilder().
+		WithBucket(infoBucket).
+		WithKey(key).
+		Build()
+	if err != nil {
+		return fmt.Errorf("Could not store '%s' on '%s': %v", key, infoBucket, err)
+	}
+
+	if err = c.execute(ctx, cmd); err != nil {
+		return fmt.Errorf("Could not store '%s' on '%s': %v", key, infoBucket, err)
+	}
+	logrus.Debugf("'%s' deleted from '%s'", key, infoBucket)
+	return nil
+}
+
+// saveRegistryList saves the list of values on a registry key, an empty list
+// is stored too
+func (c *Riak) saveRegistryList(ctx context.Context, infoBucket, key string, values []string) error {
+	if values == nil {
+		values = []string{}
+	}
+	value, err := json.Marshal(values)
+	if err != nil {
+		return fmt.Errorf("Could not store '%s' on '%s': %v", key, infoBucket, err)
+	}
+	obj := &riak.Object{
+		ContentType:     "application/json",
+		Charset:         "utf-8",
+		ContentEncoding: "utf-8",
+		Value:           value,
+	}
+	cmd, err := riak.NewStoreValueCommandBuilder().
+		WithBucket(infoBucket).
+		WithKey(key).
+		WithContent(obj).
+		Build()
+	if err != nil {
+		return fmt.Errorf("Could not store '%s' on '%s': %v", key, infoBucket, err)
+	}
+
+	if err = c.execute(ctx, cmd); err != nil {
+		return fmt.Errorf("Could not store '%s' on '%s': %v", key, infoBucket, err)
+	}
+	logrus.Debugf("'%s' stored on '%s'", key, infoBucket)
+	return nil
+}
+
+// addToRegistryList adds a value to the list of a registry key if not present
+func (c *Riak) addToRegistryList(ctx context.Context, infoBucket, key, value string) error {
+	values, err := c.getRegistryList(ctx, infoBucket, key)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range values {
+		if v == value {
+			return nil
+		}
+	}
+	return c.storeRegistryList(ctx, infoBucket, key, append(values, value))
+}
+
+// removeFromRegistryList removes a value from the list of a registry key
+func (c *Riak) removeFromRegistryList(ctx context.Context, infoBucket, key, value string) error {
+	values, err := c.getRegistryList(ctx, infoBucket, key)
+	if err != nil {
+		return err
+	}
+
+	for i, v := range values {
+		if v == value {
+			return c.storeRegistryList(ctx, infoBucket, key, append(values[:i], values[i+1:]...))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Default retry policy
+const (
+	defaultRetryAttempts   = 3
+	defaultRetryBackoff    = 100 * time.Millisecond
+	defaultRetryMaxBackoff = 2 * time.Second
+	defaultRetryJitter     = 0.2
+
+	// retryStatsLogInterval is the time between the retry counters logs
+	retryStatsLogInterval = 5 * time.Minute
+)
+
+// transientErrMsgs are parts of the riak and riak-admin error messages of
+// operations that didn't run because the cluster was busy (overloaded vnodes,
+// ring handoff, a bucket type not yet propagated to all the nodes...)
+var transientErrMsgs = []string{
+	"overload",
+	"insufficient_vnodes",
+	"pr_val_unsatisfied",
+	"pw_val_unsatisfied",
+	"all_nodes_down",
+	"not_ready",
+	"cannot be activated yet",
+	"badrpc",
+}
+
+// Retryable checks the error is transient and the operation can be tried again,
+// riak unreachable and busy cluster errors are retried. Context errors aren't
+// retried, the command could have been run (neither the interrupted commands)
+func Retryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, ErrCommandInterrupted) {
+		return false
+	}
+	if errors.Is(err, ErrBackendUnavailable) {
+		return true
+	}
+
+	msg := strings.ToLower(err.Error())
+	for _, m := range transientErrMsgs {
+		if strings.Contains(msg, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// RetryStats are the retry counters of a policy
+type RetryStats struct {
+	// Retries is the number of operations tried again
+	Retries uint64
+	// Exhausted is the number of operations failed after all the attempts
+	Exhausted uint64
+}
+
+// RetryPolicy retries the riak and riak-admin operations failed with transient
+// errors with exponential backoff. A nil policy doesn't retry
+type RetryPolicy struct {
+	// MaxAttempts is the number of times an operation is tried, 1 doesn't retry
+	MaxAttempts int
+	// Backoff is the wait after the first failed attempt, doubled on each retry
+	Backoff time.Duration
+	// MaxBackoff caps the wait between attempts
+	MaxBackoff time.Duration
+	// Jitter is the fraction (0-1) of the wait that is randomized, so the
+	// retries of concurrent requests don't hit riak at the same time
+	Jitter float64
+	// Retryable classifies the errors, defaults to Retryable
+	Retryable func(err error) bool
+
+	retries   uint64
+	exhausted uint64
+}
+
+// NewRetryPolicy creates a retry policy, zero values use the defaults
+func NewRetryPolicy(attempts int, backoff, maxBackoff time.Duration, jitter float64) *RetryPolicy {
+	if attempts <= 0 {
+		attempts = defaultRetryAttempts
+	}
+	if backoff <= 0 {
+		backoff = defaultRetryBackoff
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = defaultRetryMaxBackoff
+	}
+	if jitter <= 0 || jitter > 1 {
+		jitter = defaultRetryJitter
+	}
+	return &RetryPolicy{
+		MaxAttempts: attempts,
+		Backoff:     backoff,
+		MaxBackoff:  maxBackoff,
+		Jitter:      jitter,
+		Retryable:   Retryable,
+	}
+}
+
+// Do runs the operation until it succeeds, fails with a not retryable error,
+// the attempts are exhausted or the context is done. The last error is returned
+func (p *RetryPolicy) Do(ctx context.Context, name string, op func(ctx context.Context) error) error {
+	if p == nil {
+		return op(ctx)
+	}
+	retryable := p.Retryable
+	if retryable == nil {
+		retryable = Retryable
+	}
+
+	backoff := p.Backoff
+	for attempt := 1; ; attempt++ {
+		err := op(ctx)
+		if err == nil || !retryable(err) {
+			return err
+		}
+		if attempt >= p.MaxAttempts {
+			atomic.AddUint64(&p.exhausted, 1)
+			if p.MaxAttempts > 1 {
+				logrus.Errorf("%s failed after %d attempts: %v", name, attempt, err)
+			}
+			return err
+		}
+
+		wait := p.jitter(backoff)
+		logrus.Warningf("%s failed (attempt %d of %d), retrying in %v: %v", name, attempt, p.MaxAttempts, wait, err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return fmt.Errorf("%s not retried: %w (last error: %v)", name, ctx.Err(), err)
+		}
+		atomic.AddUint64(&p.retries, 1)
+
+		if backoff *= 2; p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
+}
+
+// jitter randomizes the wait by the jitter fraction (up or down)
+func (p *RetryPolicy) jitter(wait time.Duration) time.Duration {
+	if p.Jitter <= 0 || wait <= 0 {
+		return wait
+	}
+	delta := float64(wait) * p.Jitter
+	return wait + time.Duration(delta*(2*rand.Float64()-1))
+}
+
+// Stats returns the retry counters
+func (p *RetryPolicy) Stats() RetryStats {
+	if p == nil {
+		return RetryStats{}
+	}
+	return RetryStats{
+		Retries:   atomic.LoadUint64(&p.retries),
+		Exhausted: atomic.LoadUint64(&p.exhausted),
+	}
+}
+
+// LogStats logs the retry counters every interval when they changed, until the
+// context is done. A nil policy doesn't log
+func (p *RetryPolicy) LogStats(ctx context.Context, interval time.Duration) {
+	if p == nil {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last := RetryStats{}
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		if stats := p.Stats(); stats != last {
+			logrus.Infof("Riak operations retried: %d, failed after all the attempts: %d", stats.Retries, stats.Exhausted)
+			last = stats
+		}
+	}
+}
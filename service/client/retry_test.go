@@ -0,0 +1,173 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		givenErr error
+
+		wantRetryable bool
+	}{
+		{givenErr: fmt.Errorf("%w: connection refused", ErrBackendUnavailable), wantRetryable: true},
+		{givenErr: fmt.Errorf("%w: connection lost", ErrCommandInterrupted), wantRetryable: false},
+		{givenErr: errors.New("RiakError|0|overload"), wantRetryable: true},
+		{givenErr: errors.New("{insufficient_vnodes,1,need,2}"), wantRetryable: true},
+		{givenErr: &CommandError{ExitStatus: 1, Stdout: []byte("tsuru-counter has been created but cannot be activated yet")}, wantRetryable: true},
+		{givenErr: &CommandError{ExitStatus: 1, Stdout: []byte("Error: {badrpc,nodedown}")}, wantRetryable: true},
+		{givenErr: &CommandError{ExitStatus: 1, Stderr: []byte("Error: unknown user")}, wantRetryable: false},
+		{givenErr: fmt.Errorf("riak command not finished: %w", context.DeadlineExceeded), wantRetryable: false},
+		{givenErr: fmt.Errorf("%w: overload", context.Canceled), wantRetryable: false},
+		{givenErr: ErrInstanceNotFound, wantRetryable: false},
+		{givenErr: nil, wantRetryable: false},
+	}
+
+	for _, test := range tests {
+		if got := Retryable(test.givenErr); got != test.wantRetryable {
+			t.Errorf("Expected retryable %t for '%v'; got: %t", test.wantRetryable, test.givenErr, got)
+		}
+	}
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	transient := fmt.Errorf("%w: connection reset", ErrBackendUnavailable)
+	tests := []struct {
+		givenErrs []error
+
+		wantErr       error
+		wantAttempts  int
+		wantRetries   uint64
+		wantExhausted uint64
+	}{
+		{ // Success on the first attempt
+			givenErrs:    []error{nil},
+			wantAttempts: 1,
+		},
+		{ // Transient errors retried
+			givenErrs:    []error{transient, transient, nil},
+			wantAttempts: 3,
+			wantRetries:  2,
+		},
+		{ // Not retryable errors returned right away
+			givenErrs:    []error{ErrInvalidPlan, nil},
+			wantErr:      ErrInvalidPlan,
+			wantAttempts: 1,
+		},
+		{ // Attempts exhausted, the last error is returned
+			givenErrs:     []error{transient, transient, transient, nil},
+			wantErr:       ErrBackendUnavailable,
+			wantAttempts:  3,
+			wantRetries:   2,
+			wantExhausted: 1,
+		},
+	}
+
+	for _, test := range tests {
+		p := NewRetryPolicy(3, time.Millisecond, 5*time.Millisecond, 0.5)
+		attempts := 0
+		err := p.Do(context.Background(), "test operation", func(ctx context.Context) error {
+			err := test.givenErrs[attempts]
+			attempts++
+			return err
+		})
+
+		if (test.wantErr == nil) != (err == nil) || (test.wantErr != nil && !errors.Is(err, test.wantErr)) {
+			t.Errorf("Expected error %v; got: %v", test.wantErr, err)
+		}
+		if attempts != test.wantAttempts {
+			t.Errorf("Expected %d attempts; got: %d", test.wantAttempts, attempts)
+		}
+		if got := p.Stats(); got.Retries != test.wantRetries || got.Exhausted != test.wantExhausted {
+			t.Errorf("Expected %d retries and %d exhausted; got: %+v", test.wantRetries, test.wantExhausted, got)
+		}
+	}
+}
+
+func TestRetryPolicyDoCancelled(t *testing.T) {
+	p := NewRetryPolicy(5, time.Minute, time.Minute, 0.1)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	attempts := 0
+	start := time.Now()
+	err := p.Do(ctx, "test operation", func(ctx context.Context) error {
+		attempts++
+		return ErrBackendUnavailable
+	})
+	if !errors.Is(err, context.DeadlineExceeded) || attempts != 1 {
+		t.Errorf("Expected the backoff wait cancelled after 1 attempt; got: %d attempts, %v", attempts, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the backoff wait cancelled; took: %v", elapsed)
+	}
+
+	// Nil policies don't retry
+	var nilPolicy *RetryPolicy
+	attempts = 0
+	nilPolicy.Do(context.Background(), "test operation", func(ctx context.Context) error {
+		attempts++
+		return ErrBackendUnavailable
+	})
+	if attempts != 1 {
+		t.Errorf("Expected 1 attempt without policy; got: %d", attempts)
+	}
+}
+
+func TestRetryPolicyLogStats(t *testing.T) {
+	p := NewRetryPolicy(2, time.Millisecond, time.Millisecond, 0)
+	p.Do(context.Background(), "test operation", func(ctx context.Context) error {
+		return ErrBackendUnavailable
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		p.LogStats(ctx, 10*time.Millisecond)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("Expected stats logging stopped with the context")
+	}
+
+	// Nil policies don't log
+	var nilPolicy *RetryPolicy
+	nilPolicy.LogStats(context.Background(), time.Millisecond)
+}
+
+func TestRiakAdminRetries(t *testing.T) {
+	activations := 0
+	admin := NewMemoryExecutor(func(cmd string) ([]byte, error) {
+		if cmd != adminCmd(activateBucketTypeCmd, "tsuru-counter") {
+			return []byte{}, nil
+		}
+		// The bucket type is not propagated to all the nodes on the first attempt
+		if activations++; activations == 1 {
+			out := []byte("tsuru-counter has been created but cannot be activated yet\n")
+			return out, &CommandError{ExitStatus: 1, Stdout: out}
+		}
+		return []byte("tsuru-counter has been activated\n"), nil
+	})
+	c := &Riak{
+		Admin: admin,
+		Plans: Plans{{Name: "tsuru-counter", DataType: "counter"}},
+		Retry: NewRetryPolicy(3, time.Millisecond, time.Millisecond, 0),
+	}
+
+	if err := c.ensureBucketTypePresent(context.Background(), "tsuru-counter"); err != nil {
+		t.Errorf("Expected bucket type activated on retry; got: %v", err)
+	}
+	if activations != 2 {
+		t.Errorf("Expected 2 activations; got: %d", activations)
+	}
+	if got := c.Retry.Stats().Retries; got != 1 {
+		t.Errorf("Expected 1 retry; got: %d", got)
+	}
+}
@@ -1,45 +1,132 @@
 package client
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	riak "github.com/basho/riak-go-client"
-	"golang.org/x/crypto/ssh"
 
 	"github.com/tsuru/riakapi/config"
 	"github.com/tsuru/riakapi/utils"
 )
 
-// Riak admin cmd fmts
+// Riak admin cmd fmts, the arguments are shell quoted by adminCmd
 const (
-	checkBucketTypePresentCmd = `sudo riak-admin bucket-type list | grep -e "%s"`
-	createBucketTypeCmd       = `sudo riak-admin bucket-type create %s '{"props":{"datatype":"%s", "allow_mult": true}}'`
-	activateBucketTypeCmd     = `sudo riak-admin bucket-type activate %s`
-
-	createUserCmd   = `sudo riak-admin security add-user %s password="%s"`
-	grantUserCmd    = `sudo riak-admin security grant riak_kv.get,riak_kv.put,riak_kv.delete,riak_kv.index,riak_kv.list_keys,riak_kv.list_buckets on %s %s to %s`
-	grantSourceCmd  = `sudo riak-admin security add-source %s 0.0.0.0/0 password`
-	revokeUserCmd   = `sudo riak-admin security revoke riak_kv.get,riak_kv.put,riak_kv.delete,riak_kv.index,riak_kv.list_keys,riak_kv.list_buckets on %s %s from %s`
-	revokeSourceCmd = `sudo riak-admin security del-source %s 0.0.0.0/0`
+	listBucketTypesCmd    = `sudo riak-admin bucket-type list`
+	bucketTypeStatusCmd   = `sudo riak-admin bucket-type status %s`
+	createBucketTypeCmd   = `sudo riak-admin bucket-type create %s %s`
+	activateBucketTypeCmd = `sudo riak-admin bucket-type activate %s`
+
+	createUserCmd   = `sudo riak-admin security add-user %s %s`
+	alterUserCmd    = `sudo riak-admin security alter-user %s %s`
+	deleteUserCmd   = `sudo riak-admin security del-user %s`
+	grantUserCmd    = `sudo riak-admin security grant %s on %s %s to %s`
+	grantSourceCmd  = `sudo riak-admin security add-source %s %s %s`
+	revokeUserCmd   = `sudo riak-admin security revoke %s on %s %s from %s`
+	revokeSourceCmd = `sudo riak-admin security del-source %s %s`
+	printUsersCmd   = `sudo riak-admin security print-users`
+	printGrantsCmd  = `sudo riak-admin security print-grants %s`
+	printSourcesCmd = `sudo riak-admin security print-sources`
+	revokeAllCmd    = `sudo riak-admin security revoke riak_kv.get,riak_kv.put,riak_kv.delete,riak_kv.index,riak_kv.list_keys,riak_kv.list_buckets on %s %s from all`
+
+	memberStatusCmd = `sudo riak-admin member-status`
 )
 
+// defaultSourceCIDR is the network the users can connect from with password
+// when their units are not registered and the plan doesn't restrict it
+const defaultSourceCIDR = "0.0.0.0/0"
+
 // This will hold the added instances on tsuru
 const (
-	RiakInstancesInfoBucket = "tsuru-instances"
-	RiakUsersInfoBucket     = "tsuru-users"
+	RiakInstancesInfoBucket     = "tsuru-instances"
+	RiakInstanceUsersInfoBucket = "tsuru-instance-users"
+	RiakUsersInfoBucket         = "tsuru-users"
+	RiakBindingsInfoBucket      = "tsuru-bindings"
+)
+
+// User metadata keys where the instance team and the json encoded creation
+// parameters are stored
+const (
+	teamMetaKey       = "team"
+	parametersMetaKey = "parameters"
+)
+
+// Default operation timeouts
+const (
+	defaultAdminTimeout   = 30 * time.Second
+	defaultCommandTimeout = 5 * time.Second
+	defaultListTimeout    = 10 * time.Second
 )
 
+// Timeouts are the maximum durations of the riak operations, zero values use
+// the defaults
+type Timeouts struct {
+	// Admin is the timeout of each riak-admin command
+	Admin time.Duration
+	// Command is the timeout of each riak key/value command
+	Command time.Duration
+	// List is the timeout of the key listings (instances and bucket keys)
+	List time.Duration
+}
+
+// withDefaults returns the timeouts with the defaults set
+func (t Timeouts) withDefaults() Timeouts {
+	if t.Admin <= 0 {
+		t.Admin = defaultAdminTimeout
+	}
+	if t.Command <= 0 {
+		t.Command = defaultCommandTimeout
+	}
+	if t.List <= 0 {
+		t.List = defaultListTimeout
+	}
+	return t
+}
+
 // Riak is the entrypoint for riak client
 type Riak struct {
-	//SSHConnection SSH connection (for riak-admin manage operations)
-	SSHClient *ssh.Client
+	// Admin runs the riak-admin commands (for riak-admin manage operations)
+	Admin AdminExecutor
 
 	// RiakClient riak lowlevel client (for riak bucket operations)
 	RiakClient *riak.Cluster
+
+	// Purger deletes the keys of the removed buckets on background, nil on the
+	// one-shot commands clients
+	Purger *Purger
+
+	// Plans are the available plans, each one is a bucket type
+	Plans Plans
+
+	// Timeouts of the riak and riak-admin operations
+	Timeouts Timeouts
+
+	// Retry retries the riak and riak-admin operations failed with transient
+	// errors, nil doesn't retry
+	Retry *RetryPolicy
+
+	// Locker serializes the changes of each user and bucket across the
+	// replicas, nil doesn't lock
+	Locker *Locker
+
+	// Passwords encrypts the stored user passwords, nil stores them unencrypted
+	Passwords *PasswordCipher
+
+	// Certs issues the client certificates of the users, nil authenticates
+	// the users with password
+	Certs *CertIssuer
+
+	// KeysStream lists the keys of a bucket once passing them to fn as they
+	// are streamed, nil lists them with RiakClient
+	KeysStream func(ctx context.Context, bucketType, bucketName string, timeout time.Duration, fn func(keys []string) error) error
 }
 
 // newRiakAuth creates teh auth options needed by riak to create a TLS connection
@@ -109,385 +196,1388 @@ func NewRiakCluster(cfg *config.ServiceConfig) (*riak.Cluster, error) {
 	return cluster, nil
 }
 
-// NewRiak creates a riak client and the ssh connection
+// NewRiak creates a riak client and the riak-admin executor, the pending purges
+// are resumed and the retry counters logged
 func NewRiak(cfg *config.ServiceConfig) *Riak {
+	c := NewRiakWithoutPurger(cfg)
+	go c.Retry.LogStats(context.Background(), retryStatsLogInterval)
+	c.Purger = NewPurger(c, cfg.RiakAPIPurgeBatchSize, time.Duration(cfg.RiakAPIPurgeBatchInterval)*time.Millisecond)
+	if err := c.Purger.Resume(); err != nil {
+		logrus.Errorf("Could not resume pending purges: %v", err)
+	}
+	return c
+}
+
+// NewRiakWithoutPurger creates a riak client for the one-shot commands, it
+// can't create nor remove instances (ErrPurgerNotStarted). Only the service
+// runs the purges, a command exiting would stop them in the middle
+func NewRiakWithoutPurger(cfg *config.ServiceConfig) *Riak {
 	cluster, err := NewRiakCluster(cfg)
 
 	if err != nil {
 		logrus.Fatalf("Error connecting to riak: %v", err)
 	}
 
-	// Create SSH connection
-	sshConfig := &ssh.ClientConfig{
-		User: cfg.SSHUser,
-		Auth: cfg.SSHAuthMethods,
+	// Create the riak-admin executor (ssh connection by default)
+	admin, err := NewAdminExecutor(cfg)
+	if err != nil {
+		logrus.Fatalf("Error creating riak-admin executor: %v", err)
 	}
-	addr := fmt.Sprintf("%s:%d", cfg.SSHHost, cfg.SSHPort)
-	sClient, err := ssh.Dial("tcp", addr, sshConfig)
 
+	if err := checkPlansParams(cfg.Plans); err != nil {
+		logrus.Fatalf("Wrong plans configuration: %v", err)
+	}
+
+	passwords, err := NewPasswordCipher(cfg.PasswordKeys)
+	if err != nil {
+		logrus.Fatalf("Wrong password keys: %v", err)
+	}
+
+	certs, err := NewCertIssuer(cfg.RiakAPIClientCA, cfg.RiakAPIClientCAKey, time.Duration(cfg.RiakAPIClientCertTTL)*24*time.Hour, cfg.RiakAPICRLURL)
 	if err != nil {
-		logrus.Fatalf("Error connecting with ssh: %v", err)
+		logrus.Fatalf("Wrong client CA: %v", err)
 	}
 
-	return &Riak{
+	c := &Riak{
 		RiakClient: cluster,
-		SSHClient:  sClient,
+		Admin:      admin,
+		Plans:      cfg.Plans,
+		Passwords:  passwords,
+		Certs:      certs,
+		Timeouts: Timeouts{
+			Admin:   time.Duration(cfg.RiakAPIAdminTimeout) * time.Second,
+			Command: time.Duration(cfg.RiakAPIRiakTimeout) * time.Second,
+			List:    time.Duration(cfg.RiakAPIListTimeout) * time.Second,
+		}.withDefaults(),
+		Retry: NewRetryPolicy(
+			cfg.RiakAPIRetryAttempts,
+			time.Duration(cfg.RiakAPIRetryBackoff)*time.Millisecond,
+			time.Duration(cfg.RiakAPIRetryMaxBackoff)*time.Millisecond,
+			float64(cfg.RiakAPIRetryJitter)/100,
+		),
 	}
+	c.Locker = NewLocker(&RiakLockStore{Client: c, BucketType: cfg.RiakAPILockBucketType}, time.Duration(cfg.RiakAPILockTTL)*time.Second)
+	return c
 }
 
 // GetBucketTypes Gets Riak plans
-func (c *Riak) GetBucketTypes() ([]map[string]string, error) {
+func (c *Riak) GetBucketTypes(ctx context.Context) ([]map[string]string, error) {
 	var r []map[string]string
 
-	for k, v := range BucketTypes {
+	for _, p := range c.Plans {
 		r = append(r, map[string]string{
-			"name":        k,
-			"description": v,
+			"name":        p.Name,
+			"description": p.Description,
 		})
 	}
 	return r, nil
 }
 
-// CreateBucket Creates a bucket on riak
-func (c *Riak) CreateBucket(bucketName, bucketType string) error {
+// CreateBucket Creates a bucket on riak from the instance record (name, bucket
+// type, team, creator, parameters and tags), the parameters are applied as
+// bucket properties
+func (c *Riak) CreateBucket(ctx context.Context, info *BucketInfo) error {
+	bucketName := info.Name
+	bucketType := info.BucketType
 
-	// Check valid bucketType
-	if _, ok := BucketTypes[bucketType]; !ok {
+	// Creating needs the pending purges, a name could still be being removed
+	if c.Purger == nil {
+		return ErrPurgerNotStarted
+	}
+
+	// Check valid name, bucketType and parameters before touching riak
+	if err := ValidateName(bucketName); err != nil {
+		logrus.Errorf("Not valid bucket name: %v", err)
+		return err
+	}
+	if c.Plans.Get(bucketType) == nil {
 		logrus.Errorf("%s is not a valid bucket type", bucketType)
-		return errors.New("Not valid bucket type")
+		return ErrInvalidPlan
+	}
+	if err := c.Plans.validateParams(bucketType, info.Parameters); err != nil {
+		logrus.Errorf("Not valid parameters for bucket '%s': %v", bucketName, err)
+		return err
+	}
+
+	unlock, err := c.Locker.Lock(ctx, bucketLockKey(bucketName))
+	if err != nil {
+		logrus.Errorf("Could not create bucket '%s': %v", bucketName, err)
+		return err
 	}
+	defer unlock()
 
-	// First ensure the data types are createed (with Riak-admin)
-	if err := c.ensureBucketTypePresent(bucketType); err != nil {
-		logrus.Errorf("Could not ensure bucket type '%s' presence: %v", bucketType, err)
+	// Check the bucket is not already created
+	if _, err := c.GetBucketInfo(ctx, bucketName); err == nil {
+		logrus.Errorf("Bucket '%s' already created", bucketName)
+		return ErrInstanceExists
+	} else if !errors.Is(err, ErrInstanceNotFound) {
 		return err
 	}
 
-	// Second create bucket on the bucket type
-	if err := c.ensureBucketPresent(bucketName, bucketType); err != nil {
-		logrus.Errorf("Could not create bucket '%s' on bucket '%s': %v", bucketName, bucketType, err)
+	// The purge of a removed instance with the same name would delete the
+	// keys of the new one
+	if pending, err := c.Purger.Pending(bucketName); err != nil {
+		logrus.Errorf("Could not create bucket '%s': %v", bucketName, err)
 		return err
+	} else if pending {
+		logrus.Errorf("Bucket '%s' keys are still being purged", bucketName)
+		return ErrInstancePurging
 	}
 
-	// Third save the location of the created bucket (store its datatype)
-	if err := c.saveBucketLocation(bucketName, bucketType); err != nil {
-		logrus.Errorf("Could not save bucket '%s' location: %v", bucketName, err)
+	// The bucket type is shared by all the plan instances and the bucket
+	// initialization and properties are applied again on retries, so only the
+	// instance record (saved last, it makes the instance visible) is undone
+	record := *info
+	record.CreatedAt = time.Now().UTC()
+	err = runSteps(ctx,
+		step{
+			name: fmt.Sprintf("bucket type '%s' creation", bucketType),
+			do: func(ctx context.Context) error {
+				if err := c.ensureBucketTypePresent(ctx, bucketType); err != nil {
+					logrus.Errorf("Could not ensure bucket type '%s' presence: %v", bucketType, err)
+					return err
+				}
+				return nil
+			},
+		},
+		step{
+			name: fmt.Sprintf("bucket '%s' creation", bucketName),
+			do: func(ctx context.Context) error {
+				if err := c.ensureBucketPresent(ctx, bucketName, bucketType); err != nil {
+					logrus.Errorf("Could not create bucket '%s' on bucket '%s': %v", bucketName, bucketType, err)
+					return err
+				}
+				return nil
+			},
+		},
+		step{
+			name: fmt.Sprintf("bucket '%s' properties", bucketName),
+			do: func(ctx context.Context) error {
+				if err := c.applyBucketParams(ctx, bucketName, bucketType, info.Parameters); err != nil {
+					logrus.Errorf("Could not set bucket '%s' properties: %v", bucketName, err)
+					return err
+				}
+				return nil
+			},
+		},
+		step{
+			name: fmt.Sprintf("bucket '%s' record", bucketName),
+			do: func(ctx context.Context) error {
+				if err := c.saveBucketInfo(ctx, &record); err != nil {
+					logrus.Errorf("Could not save bucket '%s' info: %v", bucketName, err)
+					return err
+				}
+				return nil
+			},
+			undo: func(ctx context.Context) error {
+				return c.deleteBucketLocation(ctx, bucketName)
+			},
+		},
+	)
+	if err != nil {
 		return err
 	}
-	c.GetBucketType(bucketName)
 	logrus.Infof("Bucket '%s' of bucket type '%s' ready", bucketName, bucketType)
 	return nil
 }
 
 // EnsureUserPresent stores the user and password (based on a reference word) on the database if there
-// aren't present, returns the generated user and password or previous stored one
-func (c *Riak) EnsureUserPresent(word string) (user, pass string, err error) {
+// aren't present, returns the generated user and password or previous stored one. The returned user
+// is the riak login, other than the generated user when the password was rotated with grace
+func (c *Riak) EnsureUserPresent(ctx context.Context, word string) (user, pass string, err error) {
 	user = utils.GenerateUsername(word)
+	if err = ValidateName(user); err != nil {
+		return
+	}
+
+	// Parallel bindings of the app (or other replicas) wait for the user
+	// creation, only one password is generated
+	unlock, err := c.Locker.Lock(ctx, userLockKey(user))
+	if err != nil {
+		return
+	}
+	defer unlock()
 
 	// Check the user is previously created (if yes then teh password will be
 	// retrieved)
+	pass, found, err := c.userPassword(ctx, user)
+	if err != nil {
+		return
+	}
+
+	// Not found, we create the user on riak first and store the password after
+	// it, a failed creation doesn't leave a stored password without riak user
+	// (it would never be created on the next bindings)
+	if !found {
+		logrus.Debugf("Creating new user '%s' with password", user)
+		if pass, err = utils.GenerateRandomPassword(); err != nil {
+			return "", "", fmt.Errorf("Could not generate password: %w", err)
+		}
+
+		created := false
+		err = runSteps(ctx,
+			step{
+				name: fmt.Sprintf("user '%s' creation", user),
+				do: func(ctx context.Context) error {
+					// A user without stored password (created outside riakapi
+					// or a failed rollback) gets the new password
+					present, err := c.securityUserPresent(ctx, user)
+					if err != nil {
+						return err
+					}
+					cmdFmt := createUserCmd
+					if present {
+						cmdFmt = alterUserCmd
+					}
+					if _, err := c.admin(ctx, adminCmd(cmdFmt, user, "password="+pass)); err != nil {
+						return err
+					}
+					created = !present
+					logrus.Debugf("User '%s' created on riak", user)
+					return nil
+				},
+				undo: func(ctx context.Context) error {
+					if !created {
+						return nil
+					}
+					_, err := c.admin(ctx, adminCmd(deleteUserCmd, user))
+					return err
+				},
+			},
+			step{
+				name: fmt.Sprintf("user '%s' password store", user),
+				do: func(ctx context.Context) error {
+					return c.storeUserPassword(ctx, user, pass)
+				},
+			},
+		)
+		if err != nil {
+			return "", "", err
+		}
+	} else {
+		// Users rotated with grace log in with other riak user
+		logins, err := c.getUserLogins(ctx, user)
+		if err != nil {
+			return "", "", err
+		}
+		logrus.Debugf("Retrieved user '%s' (login '%s')", user, logins.Login)
+		user = logins.Login
+	}
+	logrus.Infof("User '%s' ready", user)
+	return
+}
+
+// userPassword returns the stored password of the user, found is false if the
+// user wasn't created. Passwords stored unencrypted or with an old key are
+// stored again with the current key (the user has to be locked)
+func (c *Riak) userPassword(ctx context.Context, username string) (pass string, found bool, err error) {
+	pass, current, found, err := c.fetchUserPassword(ctx, username)
+	if err != nil || !found {
+		return "", found, err
+	}
+
+	if !current {
+		if err := c.storeUserPassword(ctx, username, pass); err != nil {
+			logrus.Errorf("Could not store user '%s' password with the current key: %v", username, err)
+		} else {
+			logrus.Infof("User '%s' password stored with the current key", username)
+		}
+	}
+	return pass, true, nil
+}
+
+// fetchUserPassword fetches and decrypts the stored password of the user,
+// current is false when it should be stored again with the current key
+func (c *Riak) fetchUserPassword(ctx context.Context, username string) (pass string, current, found bool, err error) {
 	cmd, err := riak.NewFetchValueCommandBuilder().
 		WithBucket(RiakUsersInfoBucket).
-		WithKey(user).
+		WithKey(username).
 		Build()
 	if err != nil {
-		return
+		return "", false, false, err
 	}
 
-	if err = c.RiakClient.Execute(cmd); err != nil {
-		return
+	if err = c.execute(ctx, cmd); err != nil {
+		return "", false, false, err
 	}
 
 	fvc, ok := cmd.(*riak.FetchValueCommand)
 	if !ok {
-		err = errors.New("Could not fetch any value")
-		return
+		return "", false, false, errors.New("Could not fetch any value")
 	}
-	// No values, we create the values
 	if len(fvc.Response.Values) == 0 {
-		logrus.Debugf("Creating new user '%s' with password", user)
-		// Store user and password
-		// Our value to store
-		//TODO: Change salt
-		pass = utils.GeneratePassword(user, "xxxxxxxxx")
-		obj := &riak.Object{
-			ContentType:     "text/plain",
-			Charset:         "utf-8",
-			ContentEncoding: "utf-8",
-			Value:           []byte(pass),
-		}
-		cmd, err = riak.NewStoreValueCommandBuilder().
-			WithBucket(RiakUsersInfoBucket).
-			WithKey(user).
-			WithContent(obj).
-			Build()
+		return "", false, false, nil
+	}
+
+	pass, current, err = c.Passwords.Decrypt(username, string(fvc.Response.Values[0].Value))
+	if err != nil {
+		return "", false, true, fmt.Errorf("User '%s': %w", username, err)
+	}
+	if isLegacyPassword(username, pass) {
+		logrus.Warningf("User '%s' password is derived from its name, it should be rotated", username)
+	}
+	return pass, current, true, nil
+}
+
+// PasswordMigration is the result of a passwords migration
+type PasswordMigration struct {
+	// Encrypted is the number of passwords stored again with the current key
+	Encrypted int `json:"encrypted"`
+	// Rotated are the rotations of the passwords derived from the app host, the
+	// instances have to be bound again to get the new password
+	Rotated []*RotationResult `json:"rotated"`
+}
+
+// MigratePasswords stores again the passwords stored unencrypted or encrypted
+// with an old key and rotates the passwords derived from the app host
+func (c *Riak) MigratePasswords(ctx context.Context) (*PasswordMigration, error) {
+	cmd, err := riak.NewListKeysCommandBuilder().
+		WithBucket(RiakUsersInfoBucket).
+		WithTimeout(c.Timeouts.withDefaults().List).
+		Build()
+	if err != nil {
+		return nil, fmt.Errorf("Could not list users: %w", err)
+	}
+
+	if err = c.executeTimeout(ctx, cmd, c.Timeouts.withDefaults().List); err != nil {
+		return nil, fmt.Errorf("Could not list users: %w", err)
+	}
+
+	lkc, ok := cmd.(*riak.ListKeysCommand)
+	if !ok {
+		return nil, errors.New("Could not list users")
+	}
 
+	res := &PasswordMigration{Rotated: []*RotationResult{}}
+	for _, u := range lkc.Response.Keys {
+		encrypted, legacy, err := c.migrateUserPassword(ctx, u)
 		if err != nil {
-			return
+			return res, fmt.Errorf("Could not migrate user '%s' password: %w", u, err)
 		}
-
-		// Save
-		if err = c.RiakClient.Execute(cmd); err != nil {
-			return
+		if encrypted {
+			res.Encrypted++
+		}
+		if !legacy {
+			continue
 		}
 
-		// Create the user on raik
-		cmd := fmt.Sprintf(createUserCmd, user, pass)
-		session, _ := c.SSHClient.NewSession()
-
-		err = session.Run(cmd)
-		session.Close()
+		// The riak user password is changed too, the apps have to be bound
+		// again to connect
+		rotation, err := c.RotateUserPassword(ctx, u, false)
 		if err != nil {
-			return
+			return res, fmt.Errorf("Could not rotate user '%s' password: %w", u, err)
 		}
+		res.Rotated = append(res.Rotated, rotation)
+	}
+	logrus.Infof("%d of %d user passwords migrated, %d rotated", res.Encrypted, len(lkc.Response.Keys), len(res.Rotated))
+	return res, nil
+}
 
-		logrus.Debugf("User '%s' created on riak", user)
+// migrateUserPassword stores again the user password if it's not encrypted with
+// the current key, legacy is true if the password is derived from the username
+func (c *Riak) migrateUserPassword(ctx context.Context, username string) (encrypted, legacy bool, err error) {
+	unlock, err := c.Locker.Lock(ctx, userLockKey(username))
+	if err != nil {
+		return false, false, err
+	}
+	defer unlock()
 
-	} else {
-		pass = string(fvc.Response.Values[0].Value)
-		logrus.Debugf("Retrieved user '%s'", user)
+	pass, current, found, err := c.fetchUserPassword(ctx, username)
+	if err != nil || !found {
+		return false, false, err
 	}
-	logrus.Infof("User '%s' ready", user)
-	return
+	legacy = isLegacyPassword(username, pass)
+	if current {
+		return false, legacy, nil
+	}
+	if err := c.storeUserPassword(ctx, username, pass); err != nil {
+		return false, false, err
+	}
+	logrus.Debugf("User '%s' password migrated", username)
+	return true, legacy, nil
 }
 
-// GrantUserAccess grants access to a bucket on riak
-func (c *Riak) GrantUserAccess(username, bucketName string) error {
-	bucketType := c.GetBucketType(bucketName)
+// storeUserPassword stores the password of the user encrypted with the current key
+func (c *Riak) storeUserPassword(ctx context.Context, username, pass string) error {
+	stored, err := c.Passwords.Encrypt(username, pass)
+	if err != nil {
+		return err
+	}
+	obj := &riak.Object{
+		ContentType:     "text/plain",
+		Charset:         "utf-8",
+		ContentEncoding: "utf-8",
+		Value:           []byte(stored),
+	}
+	cmd, err := riak.NewStoreValueCommandBuilder().
+		WithBucket(RiakUsersInfoBucket).
+		WithKey(username).
+		WithContent(obj).
+		Build()
+	if err != nil {
+		return fmt.Errorf("Could not store user password: %w", err)
+	}
 
-	// Grant access on riak
-	// Set permissions
-	cmd := fmt.Sprintf(grantUserCmd, bucketType, bucketName, username)
-	session, _ := c.SSHClient.NewSession()
+	if err = c.execute(ctx, cmd); err != nil {
+		return fmt.Errorf("Could not store user password: %w", err)
+	}
+	return nil
+}
 
-	err := session.Run(cmd)
-	session.Close()
+// GrantUserAccess grants access to a bucket on riak and issues the client
+// certificate of the binding (blank if not enabled), a failed grant is rolled
+// back so the user keeps the access it had before
+func (c *Riak) GrantUserAccess(ctx context.Context, username, bucketName string, mode BindMode) (certPEM, keyPEM string, err error) {
+	unlock, err := c.Locker.Lock(ctx, bucketLockKey(bucketName), userLockKey(username))
 	if err != nil {
 		logrus.Errorf("Error granting user on bucket: %v", err)
-		return fmt.Errorf("Error granting user on bucket: %v", err)
+		return "", "", err
 	}
+	defer unlock()
 
-	// Grant access from source
-	cmd = fmt.Sprintf(grantSourceCmd, username)
-	session, _ = c.SSHClient.NewSession()
+	info, err := c.GetBucketInfo(ctx, bucketName)
+	if err != nil {
+		logrus.Errorf("Error granting user on bucket: %v", err)
+		return "", "", err
+	}
+	bucketType := info.BucketType
 
-	err = session.Run(cmd)
-	session.Close()
+	// If already bound with other mode the previous permissions are replaced
+	prevMode, bound, err := c.boundMode(ctx, username, bucketName)
 	if err != nil {
 		logrus.Errorf("Error granting user on bucket: %v", err)
-		return fmt.Errorf("Error granting user on bucket: %v", err)
+		return "", "", err
 	}
 
-	logrus.Infof("User '%s' granted on %s.%s", username, bucketType, bucketName)
+	// Users rotated with grace are granted on all their logins
+	logins, err := c.getUserLogins(ctx, username)
+	if err != nil {
+		logrus.Errorf("Error granting user on bucket: %v", err)
+		return "", "", err
+	}
+	var cert *IssuedCert
+	steps := []step{}
+	for _, l := range logins.all() {
+		steps = append(steps, c.grantLoginSteps(l, bucketType, bucketName, mode, prevMode, bound)...)
+	}
 
-	return nil
+	err = runSteps(ctx, append(steps,
+		step{
+			name: fmt.Sprintf("user '%s' binding register on '%s'", username, bucketName),
+			do: func(ctx context.Context) error {
+				return c.registerBinding(ctx, username, bucketName)
+			},
+			undo: func(ctx context.Context) error {
+				if bound {
+					return nil
+				}
+				return c.unregisterBinding(ctx, username, bucketName)
+			},
+		},
+		step{
+			name: fmt.Sprintf("user '%s' binding mode on '%s'", username, bucketName),
+			do: func(ctx context.Context) error {
+				return c.saveBindingMode(ctx, username, bucketName, mode)
+			},
+			// The grants are set back to the previous mode, its revoke needs it
+			undo: func(ctx context.Context) error {
+				if !bound {
+					return c.deleteBindingMode(ctx, username, bucketName)
+				}
+				return c.saveBindingMode(ctx, username, bucketName, prevMode)
+			},
+		},
+		step{
+			name: fmt.Sprintf("user '%s' certificate on '%s'", username, bucketName),
+			do: func(ctx context.Context) error {
+				var err error
+				certPEM, keyPEM, cert, err = c.issueBindingCert(ctx, username, logins.Login, bucketName)
+				return err
+			},
+			undo: func(ctx context.Context) error {
+				if cert == nil {
+					return nil
+				}
+				return c.revokeBindingCerts(ctx, username, bucketName, func(ic *IssuedCert) bool { return ic.Serial == cert.Serial })
+			},
+		},
+		// The sources are synced again by the next binding changes, they are
+		// not undone
+		step{
+			name: fmt.Sprintf("user '%s' sources", username),
+			do: func(ctx context.Context) error {
+				if err := c.syncUserSources(ctx, username); err != nil {
+					return fmt.Errorf("Error granting user on bucket: %w", err)
+				}
+				return nil
+			},
+		},
+		// The app only gets the new certificate, the previous ones are revoked
+		// last so a failed binding keeps them
+		step{
+			name: fmt.Sprintf("user '%s' previous certificates revocation on '%s'", username, bucketName),
+			do: func(ctx context.Context) error {
+				if cert == nil {
+					return nil
+				}
+				return c.revokeBindingCerts(ctx, username, bucketName, func(ic *IssuedCert) bool { return ic.Serial != cert.Serial })
+			},
+		},
+	)...)
+	if err != nil {
+		logrus.Errorf("Error granting user on bucket: %v", err)
+		return "", "", err
+	}
+
+	logrus.Infof("User '%s' granted on %s.%s (%s)", username, bucketType, bucketName, mode)
+
+	return certPEM, keyPEM, nil
 }
 
-// DeleteBucket Deletes a bucket on riak
-func (c *Riak) DeleteBucket(bucketName, bucketType string) error {
-	// It's decided to not delete a riak bucket because there is not a proper way
-	// of doing this. for riak a bucket is only a namespace, so unless there aren't
-	// keys on the bucket then the bucket will always exists. Deleting all the keys
-	// one by one is not a good choice
-	return errors.New("Should not delete a riak bucket for now")
+// grantLoginSteps returns the steps granting the riak login on the bucket, the
+// permissions of the previous binding mode are replaced
+func (c *Riak) grantLoginSteps(login, bucketType, bucketName string, mode, prevMode BindMode, bound bool) []step {
+	rebind := bound && prevMode == mode
+	return []step{
+		{
+			name: fmt.Sprintf("user '%s' %s permissions revocation on '%s'", login, prevMode, bucketName),
+			do: func(ctx context.Context) error {
+				if !bound || rebind {
+					return nil
+				}
+				cmd := adminCmd(revokeUserCmd, prevMode.Permissions(), bucketType, bucketName, login)
+				if _, err := c.admin(ctx, cmd); err != nil {
+					return fmt.Errorf("Error revoking previous user permissions: %w", err)
+				}
+				logrus.Debugf("User '%s' %s permissions on '%s' revoked", login, prevMode, bucketName)
+				return nil
+			},
+			undo: func(ctx context.Context) error {
+				if !bound || rebind {
+					return nil
+				}
+				_, err := c.admin(ctx, adminCmd(grantUserCmd, prevMode.Permissions(), bucketType, bucketName, login))
+				return err
+			},
+		},
+		{
+			name: fmt.Sprintf("user '%s' %s permissions grant on '%s'", login, mode, bucketName),
+			do: func(ctx context.Context) error {
+				cmd := adminCmd(grantUserCmd, mode.Permissions(), bucketType, bucketName, login)
+				if _, err := c.admin(ctx, cmd); err != nil {
+					return fmt.Errorf("Error granting user on bucket: %w", err)
+				}
+				return nil
+			},
+			undo: func(ctx context.Context) error {
+				// The permissions were already granted by the previous binding
+				if rebind {
+					return nil
+				}
+				_, err := c.admin(ctx, adminCmd(revokeUserCmd, mode.Permissions(), bucketType, bucketName, login))
+				return err
+			},
+		},
+	}
 }
 
-// DeleteUser Deletes a user on riak
-func (c *Riak) DeleteUser(username string) error {
-	// It's decided to not delete the riak user  because we can be connected to
-	// various instances with the same user, and keeping track of this add
-	// unecessary logic, revoking access to bucket is the only requirement
-	return errors.New("Should not delete a riak user for now")
+// DeleteBucket Deletes a bucket on riak. For riak a bucket is only a namespace,
+// so unless there aren't keys on the bucket then the bucket will always exist.
+// The access is revoked and the bucket unregistered right away, the keys are
+// deleted on background by the purger
+func (c *Riak) DeleteBucket(ctx context.Context, bucketName, bucketType string) error {
+	if c.Purger == nil {
+		return ErrPurgerNotStarted
+	}
+
+	unlock, err := c.Locker.Lock(ctx, bucketLockKey(bucketName))
+	if err != nil {
+		logrus.Errorf("Could not delete bucket '%s': %v", bucketName, err)
+		return err
+	}
+	defer unlock()
+
+	// First revoke all the grants on the bucket
+	cmd := adminCmd(revokeAllCmd, bucketType, bucketName)
+	_, err = c.admin(ctx, cmd)
+	if err != nil {
+		logrus.Errorf("Error revoking grants on bucket: %v", err)
+		return fmt.Errorf("Error revoking grants on bucket: %w", err)
+	}
+
+	// Second remove the bucket users
+	users, err := c.GetBucketUsers(ctx, bucketName)
+	if err != nil {
+		logrus.Errorf("Could not delete bucket '%s' users: %v", bucketName, err)
+		return err
+	}
+
+	// The user binding lists are changed too, the bucket is already locked
+	userKeys := []string{}
+	for _, u := range users {
+		userKeys = append(userKeys, userLockKey(u))
+	}
+	unlockUsers, err := c.Locker.Lock(ctx, userKeys...)
+	if err != nil {
+		logrus.Errorf("Could not delete bucket '%s' users: %v", bucketName, err)
+		return err
+	}
+	defer unlockUsers()
+
+	for _, u := range users {
+		// The grants of the user are not revoked by the 'all' revoke, a new
+		// instance with the same name would be accessible by the app
+		mode, err := c.getBindingMode(ctx, u, bucketName)
+		if err != nil {
+			logrus.Errorf("Could not delete bucket '%s' users: %v", bucketName, err)
+			return err
+		}
+		logins, err := c.getUserLogins(ctx, u)
+		if err != nil {
+			logrus.Errorf("Could not delete bucket '%s' users: %v", bucketName, err)
+			return err
+		}
+		if err := c.revokeBindingGrants(ctx, logins.all(), mode, bucketType, bucketName); err != nil {
+			logrus.Errorf("Could not delete bucket '%s' users: %v", bucketName, err)
+			return err
+		}
+
+		if err := c.unregisterBinding(ctx, u, bucketName); err != nil {
+			logrus.Errorf("Could not delete bucket '%s' users: %v", bucketName, err)
+			return err
+		}
+		if err := c.deleteBindingMode(ctx, u, bucketName); err != nil {
+			logrus.Errorf("Could not delete bucket '%s' users: %v", bucketName, err)
+			return err
+		}
+		if err := c.deleteBindingUnits(ctx, u, bucketName); err != nil {
+			logrus.Errorf("Could not delete bucket '%s' users: %v", bucketName, err)
+			return err
+		}
+		if err := c.revokeBindingCerts(ctx, u, bucketName, nil); err != nil {
+			logrus.Errorf("Could not delete bucket '%s' users: %v", bucketName, err)
+			return err
+		}
+		if err := c.syncUserSources(ctx, u); err != nil {
+			logrus.Errorf("Could not delete bucket '%s' users: %v", bucketName, err)
+			return err
+		}
+	}
+
+	// Third register the purge (so it can be resumed after a crash) and remove
+	// the location of the bucket, the purge only starts once it's removed
+	var job *PurgeJob
+	err = runSteps(ctx,
+		step{
+			name: fmt.Sprintf("bucket '%s' purge registration", bucketName),
+			do: func(ctx context.Context) error {
+				var err error
+				job, err = c.Purger.Register(bucketName, bucketType)
+				return err
+			},
+			undo: func(ctx context.Context) error {
+				return c.Purger.Cancel(job)
+			},
+		},
+		step{
+			name: fmt.Sprintf("bucket '%s' location delete", bucketName),
+			do: func(ctx context.Context) error {
+				return c.deleteBucketLocation(ctx, bucketName)
+			},
+		},
+	)
+	if err != nil {
+		logrus.Errorf("Could not delete bucket '%s': %v", bucketName, err)
+		return err
+	}
+	c.Purger.Start(job)
+
+	logrus.Infof("Bucket '%s' of bucket type '%s' deleted", bucketName, bucketType)
+	return nil
 }
 
-// RevokeUserAccess revokes access to user on a bucket
-func (c *Riak) RevokeUserAccess(username, bucketName string) error {
-	bucketType := c.GetBucketType(bucketName)
+// DeleteUser Deletes a user on riak, the same user is used on all the instances
+// an app is bound to, so the user is only deleted when it isn't granted on any bucket
+func (c *Riak) DeleteUser(ctx context.Context, username string) error {
+	unlock, err := c.Locker.Lock(ctx, userLockKey(username))
+	if err != nil {
+		logrus.Errorf("Error deleting user: %v", err)
+		return err
+	}
+	defer unlock()
+
+	if err := c.checkUserPresent(ctx, username); err != nil {
+		return err
+	}
+
+	buckets, err := c.GetUserBuckets(ctx, username)
+	if err != nil {
+		logrus.Errorf("Error deleting user: %v", err)
+		return fmt.Errorf("Error deleting user: %w", err)
+	}
+	if len(buckets) > 0 {
+		return fmt.Errorf("%w: '%s' on %d buckets", ErrUserGranted, username, len(buckets))
+	}
+
+	logins, err := c.getUserLogins(ctx, username)
+	if err != nil {
+		logrus.Errorf("Error deleting user: %v", err)
+		return fmt.Errorf("Error deleting user: %w", err)
+	}
+
+	// The apps bound before the bindings were registered only have their grants
+	// on riak, the user is kept while it has permissions on any bucket
+	granted, err := c.grantedBuckets(ctx, logins.all())
+	if err != nil {
+		logrus.Errorf("Error deleting user: %v", err)
+		return fmt.Errorf("Error deleting user: %w", err)
+	}
+	if len(granted) > 0 {
+		logrus.Warnf("User '%s' granted on unregistered buckets %v, not deleted", username, granted)
+		return fmt.Errorf("%w: '%s' on %d buckets", ErrUserGranted, username, len(granted))
+	}
+
+	// Delete user on riak, all its logins if rotated with grace
+	for _, l := range logins.all() {
+		cmd := adminCmd(deleteUserCmd, l)
+		if _, err = c.admin(ctx, cmd); err != nil {
+			logrus.Errorf("Error deleting user: %v", err)
+			return fmt.Errorf("Error deleting user: %w", err)
+		}
+	}
+	if err := c.deleteUserLogins(ctx, username); err != nil {
+		logrus.Errorf("Error deleting user: %v", err)
+		return err
+	}
 
-	// Revoke access on riak
-	// Delete permissions
-	cmd := fmt.Sprintf(revokeUserCmd, bucketType, bucketName, username)
-	session, _ := c.SSHClient.NewSession()
+	// Delete the stored password
+	dCmd, err := riak.NewDeleteValueCommandBuilder().
+		WithBucket(RiakUsersInfoBucket).
+		WithKey(username).
+		Build()
+	if err != nil {
+		return fmt.Errorf("Error deleting user password: %w", err)
+	}
 
-	err := session.Run(cmd)
-	session.Close()
+	if err = c.execute(ctx, dCmd); err != nil {
+		return fmt.Errorf("Error deleting user password: %w", err)
+	}
+
+	logrus.Infof("User '%s' deleted", username)
+	return nil
+}
+
+// RevokeUserAccess revokes access to user on a bucket
+func (c *Riak) RevokeUserAccess(ctx context.Context, username, bucketName string) error {
+	unlock, err := c.Locker.Lock(ctx, bucketLockKey(bucketName), userLockKey(username))
 	if err != nil {
 		logrus.Errorf("Error revoking user on bucket: %v", err)
-		return fmt.Errorf("Error revoking user on bucket: %v", err)
+		return err
 	}
+	defer unlock()
 
-	// Revoke access from source
-	cmd = fmt.Sprintf(revokeSourceCmd, username)
-	session, _ = c.SSHClient.NewSession()
+	info, err := c.GetBucketInfo(ctx, bucketName)
+	if err != nil {
+		logrus.Errorf("Error revoking user on bucket: %v", err)
+		return err
+	}
+	bucketType := info.BucketType
 
-	err = session.Run(cmd)
-	session.Close()
+	if err := c.checkUserPresent(ctx, username); err != nil {
+		logrus.Errorf("Error revoking user on bucket: %v", err)
+		return err
+	}
+
+	// Revoke exactly the permissions granted on the binding
+	mode, err := c.getBindingMode(ctx, username, bucketName)
 	if err != nil {
 		logrus.Errorf("Error revoking user on bucket: %v", err)
-		return fmt.Errorf("Error revoking user on bucket: %v", err)
+		return err
+	}
+
+	// Revoke access on riak, from all the logins of the users rotated with grace
+	logins, err := c.getUserLogins(ctx, username)
+	if err != nil {
+		logrus.Errorf("Error revoking user on bucket: %v", err)
+		return err
+	}
+	if err := c.revokeBindingGrants(ctx, logins.all(), mode, bucketType, bucketName); err != nil {
+		logrus.Errorf("Error revoking user on bucket: %v", err)
+		return err
+	}
+
+	// Unregister the binding
+	if err := c.unregisterBinding(ctx, username, bucketName); err != nil {
+		logrus.Errorf("Error unregistering user from bucket: %v", err)
+		return err
+	}
+	if err := c.deleteBindingMode(ctx, username, bucketName); err != nil {
+		logrus.Errorf("Error unregistering user from bucket: %v", err)
+		return err
+	}
+	if err := c.deleteBindingUnits(ctx, username, bucketName); err != nil {
+		logrus.Errorf("Error unregistering user from bucket: %v", err)
+		return err
+	}
+	if err := c.revokeBindingCerts(ctx, username, bucketName, nil); err != nil {
+		logrus.Errorf("Error revoking user certificates: %v", err)
+		return err
+	}
+
+	// The user is shared by all the instances an app is bound to, the sources of
+	// the other bindings are kept
+	if err := c.syncUserSources(ctx, username); err != nil {
+		logrus.Errorf("Error revoking user on bucket: %v", err)
+		return fmt.Errorf("Error revoking user on bucket: %w", err)
 	}
 
-	logrus.Infof("User '%s' revoked on %s.%s", username, bucketType, bucketName)
+	logrus.Infof("User '%s' revoked on %s.%s (%s)", username, bucketType, bucketName, mode)
 
 	return nil
 }
 
-// GetBucketType returns the bucket type based on the bucket name
-func (c *Riak) GetBucketType(bucketName string) string {
-	var bucketType string
+// revokeBindingGrants revokes the permissions of the binding mode on the bucket
+// from the user logins
+func (c *Riak) revokeBindingGrants(ctx context.Context, logins []string, mode BindMode, bucketType, bucketName string) error {
+	for _, l := range logins {
+		cmd := adminCmd(revokeUserCmd, mode.Permissions(), bucketType, bucketName, l)
+		if _, err := c.admin(ctx, cmd); err != nil {
+			return fmt.Errorf("Error revoking user on bucket: %w", err)
+		}
+	}
+	return nil
+}
 
-	// Create command
+// grantedBuckets returns the buckets ("type.bucket") the logins have dedicated
+// permissions on according to riak, registered or not
+func (c *Riak) grantedBuckets(ctx context.Context, logins []string) ([]string, error) {
+	buckets := []string{}
+	seen := map[string]bool{}
+	for _, l := range logins {
+		grants, err := c.userGrants(ctx, l)
+		if err != nil {
+			return nil, err
+		}
+		for _, g := range grants.Dedicated {
+			b := fmt.Sprintf("%s.%s", g.BucketType, g.Bucket)
+			if !seen[b] {
+				seen[b] = true
+				buckets = append(buckets, b)
+			}
+		}
+	}
+	return buckets, nil
+}
+
+// boundMode returns the mode of the user binding to the bucket, bound is false
+// if the user isn't bound to the bucket
+func (c *Riak) boundMode(ctx context.Context, username, bucketName string) (mode BindMode, bound bool, err error) {
+	users, err := c.GetBucketUsers(ctx, bucketName)
+	if err != nil {
+		return "", false, err
+	}
+
+	for _, u := range users {
+		if u == username {
+			bound = true
+			break
+		}
+	}
+	if !bound {
+		return "", false, nil
+	}
+
+	mode, err = c.getBindingMode(ctx, username, bucketName)
+	if err != nil {
+		return "", false, err
+	}
+	return mode, true, nil
+}
+
+// checkUserPresent checks the user was created by EnsureUserPresent, returns
+// ErrUserNotFound if not
+func (c *Riak) checkUserPresent(ctx context.Context, username string) error {
 	cmd, err := riak.NewFetchValueCommandBuilder().
-		WithBucket(RiakInstancesInfoBucket).
-		WithKey(bucketName).
+		WithBucket(RiakUsersInfoBucket).
+		WithKey(username).
 		Build()
 	if err != nil {
-		return ""
+		return err
 	}
 
-	if err = c.RiakClient.Execute(cmd); err != nil {
-		return ""
+	if err = c.execute(ctx, cmd); err != nil {
+		return err
 	}
 
 	fvc, ok := cmd.(*riak.FetchValueCommand)
 	if !ok {
-		return ""
+		return errors.New("Could not fetch any value")
 	}
 	if len(fvc.Response.Values) == 0 {
-		return ""
+		return ErrUserNotFound
 	}
+	return nil
+}
 
-	bucketType = string(fvc.Response.Values[0].Value)
-	logrus.Debugf("Retrieved Bucket type '%s' from bucket name '%s'", bucketType, bucketName)
+// execute runs a command on the riak cluster with the command timeout
+func (c *Riak) execute(ctx context.Context, cmd riak.Command) error {
+	return c.executeTimeout(ctx, cmd, c.Timeouts.withDefaults().Command)
+}
 
-	return bucketType
+// executeTimeout runs a command on the riak cluster, retrying the transient
+// failures. Each attempt is abandoned when the context is done or the timeout
+// expires (the riak-go-client commands can't be cancelled, their timeout is set
+// on the builders too)
+func (c *Riak) executeTimeout(ctx context.Context, cmd riak.Command, timeout time.Duration) error {
+	return c.Retry.Do(ctx, fmt.Sprintf("Riak %s", cmd.Name()), func(ctx context.Context) error {
+		return c.executeOnce(ctx, cmd, timeout)
+	})
 }
 
-//ensureBucketTypePresent checks bucket type present and if not will create adn activate it
-func (c *Riak) ensureBucketTypePresent(bucketType string) error {
-	// Sessions are channels on the same connection
-	var session *ssh.Session
-	var err error
+// executeOnce runs a command on the riak cluster without retrying it, zero
+// timeout only waits for the context
+func (c *Riak) executeOnce(ctx context.Context, cmd riak.Command, timeout time.Duration) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
 
-	// Check bucket type is present
-	logrus.Debugf("Check bucket type '%s' is created", bucketType)
-	cmd := fmt.Sprintf(checkBucketTypePresentCmd, bucketType)
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("riak command not run: %w", err)
+	}
+
+	async := &riak.Async{Command: cmd, Done: make(chan riak.Command, 1)}
+	if err := c.RiakClient.ExecuteAsync(async); err != nil {
+		return backendError(err)
+	}
+
+	select {
+	case <-async.Done:
+		return backendError(async.Error)
+	case <-ctx.Done():
+		return fmt.Errorf("riak command not finished: %w", ctx.Err())
+	}
+}
+
+// streamKeys lists the keys of a bucket once passing them to fn as they are
+// streamed. A failed listing can't be retried as is, fn already got part of
+// the keys
+func (c *Riak) streamKeys(ctx context.Context, bucketType, bucketName string, timeout time.Duration, fn func(keys []string) error) error {
+	if c.KeysStream != nil {
+		return c.KeysStream(ctx, bucketType, bucketName, timeout, fn)
+	}
+
+	b := riak.NewListKeysCommandBuilder().
+		WithBucketType(bucketType).
+		WithBucket(bucketName).
+		WithStreaming(true).
+		WithCallback(fn)
+	if timeout > 0 {
+		b = b.WithTimeout(timeout)
+	}
+	cmd, err := b.Build()
+	if err != nil {
+		return err
+	}
+	return c.executeOnce(ctx, cmd, timeout)
+}
+
+// errStaleListing stops the listings of the abandoned attempts
+var errStaleListing = errors.New("keys listing attempt abandoned")
+
+// listKeys streams the keys of a bucket to fn retrying the transient failures
+// from the start, reset is called before each attempt to discard what fn got
+// from the failed one. The keys still streamed by an abandoned (timed out)
+// attempt are dropped
+func (c *Riak) listKeys(ctx context.Context, bucketType, bucketName string, reset func(), fn func(keys []string) error) error {
+	var mu sync.Mutex
+	attempt := 0
+
+	err := c.Retry.Do(ctx, "Riak list keys", func(ctx context.Context) error {
+		mu.Lock()
+		attempt++
+		current := attempt
+		reset()
+		mu.Unlock()
+
+		return c.streamKeys(ctx, bucketType, bucketName, c.Timeouts.withDefaults().List, func(keys []string) error {
+			mu.Lock()
+			defer mu.Unlock()
+
+			if current != attempt {
+				return errStaleListing
+			}
+			return fn(keys)
+		})
+	})
+
+	mu.Lock()
+	attempt++
+	mu.Unlock()
+	return err
+}
+
+// admin runs a riak-admin command with the admin timeout, retrying the
+// transient failures
+func (c *Riak) admin(ctx context.Context, cmd string) ([]byte, error) {
+	var out []byte
+	err := c.Retry.Do(ctx, "riak-admin command", func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, c.Timeouts.withDefaults().Admin)
+		defer cancel()
+
+		var err error
+		out, err = c.Admin.Run(ctx, cmd)
+		return err
+	})
+	return out, err
+}
 
-	session, _ = c.SSHClient.NewSession()
-	err = session.Run(cmd)
-	session.Close()
+// GetBucketType returns the bucket type based on the bucket name
+func (c *Riak) GetBucketType(ctx context.Context, bucketName string) string {
+	info, err := c.GetBucketInfo(ctx, bucketName)
+	if err != nil {
+		return ""
+	}
 
-	// If error will need to create the bucket
+	logrus.Debugf("Retrieved Bucket type '%s' from bucket name '%s'", info.BucketType, bucketName)
+	return info.BucketType
+}
+
+//ensureBucketTypePresent checks bucket type present and if not will create adn activate it
+func (c *Riak) ensureBucketTypePresent(ctx context.Context, bucketType string) error {
+	// Check bucket type is present
+	logrus.Debugf("Check bucket type '%s' is created", bucketType)
+	state, err := c.bucketTypeState(ctx, bucketType)
 	if err != nil {
-		n, _ := NameBucketTypeMapping[bucketType]
-		cmd = fmt.Sprintf(createBucketTypeCmd, bucketType, n)
-		session, _ = c.SSHClient.NewSession()
-		err = session.Run(cmd)
-		session.Close()
+		return fmt.Errorf("Could not check bucket type: %w", err)
+	}
+
+	plan := c.Plans.Get(bucketType)
+	if state == nil {
+		props, err := bucketTypeProps(plan)
+		if err != nil {
+			return fmt.Errorf("Could not create bucket type: %w", err)
+		}
+		cmd := adminCmd(createBucketTypeCmd, bucketType, props)
+		_, err = c.admin(ctx, cmd)
 		if err != nil {
-			return fmt.Errorf("Could not create bucket type: %v", err)
+			return fmt.Errorf("Could not create bucket type: %w", err)
 		}
 		logrus.Debugf("Bucket type '%s' created", bucketType)
 	} else {
+		// A bucket type created outside riakapi could have other data type
+		status, err := c.bucketTypeStatus(ctx, bucketType)
+		if err != nil {
+			return fmt.Errorf("Could not check bucket type: %w", err)
+		}
+		if dataType := status.Props["datatype"]; plan != nil && dataType != plan.DataType {
+			return fmt.Errorf("Bucket type '%s' is present with datatype '%s' instead of '%s'", bucketType, dataType, plan.DataType)
+		}
 		logrus.Debugf("Bucket type '%s' already present", bucketType)
+
+		if state.Active {
+			return nil
+		}
 	}
-	// Activate always
-	cmd = fmt.Sprintf(activateBucketTypeCmd, bucketType)
-	session, _ = c.SSHClient.NewSession()
-	err = session.Run(cmd)
-	session.Close()
+
+	cmd := adminCmd(activateBucketTypeCmd, bucketType)
+	_, err = c.admin(ctx, cmd)
 	if err != nil {
-		return fmt.Errorf("Failed activating bucket type: %s", bucketType)
+		return fmt.Errorf("Failed activating bucket type '%s': %w", bucketType, err)
 	}
 	logrus.Debugf("Bucket type '%s' activated", bucketType)
 	return nil
 }
 
 // ensureBucketPresent creates a bucket of a buckettype if neccesary
-func (c *Riak) ensureBucketPresent(bucketName, bucketType string) error {
+func (c *Riak) ensureBucketPresent(ctx context.Context, bucketName, bucketType string) error {
 	// Select the correct data type and create the bucket
 	var cmd riak.Command
 	var err error
 
-	switch bucketType {
-	case BucketTypeCounter:
+	switch c.Plans.DataType(bucketType) {
+	case "counter":
 		cmd, err = riak.NewUpdateCounterCommandBuilder().
 			WithBucketType(bucketType).
 			WithBucket(bucketName).
 			Build()
-	case BucketTypeSet:
+	case "set":
 		cmd, err = riak.NewUpdateSetCommandBuilder().
 			WithBucketType(bucketType).
 			WithBucket(bucketName).
 			Build()
-	case BucketTypeMap:
+	case "map":
 		cmd, err = riak.NewUpdateMapCommandBuilder().
 			WithBucketType(bucketType).
 			WithBucket(bucketName).
 			Build()
+	default:
+		// Key/value buckets don't need to be initialized, they exist once
+		// a key is stored
+		logrus.Debugf("Bucket '%s' of bucket type '%s' doesn't need initialization", bucketName, bucketType)
+		return nil
 	}
 	if err != nil {
-		return fmt.Errorf("Could not create bucket type: %v", err)
+		return fmt.Errorf("Could not create bucket type: %w", err)
 	}
 
-	if err = c.RiakClient.Execute(cmd); err != nil {
-		return fmt.Errorf("Could not create bucket type: %v", err)
+	if err = c.execute(ctx, cmd); err != nil {
+		return fmt.Errorf("Could not create bucket type: %w", err)
 	}
 
-	// Create bucket
-	propsCmd, err := riak.NewStoreBucketTypePropsCommandBuilder().
-		WithBucketType(bucketType).
-		WithAllowMult(true).
-		Build()
+	logrus.Debugf("Bucket '%s' of bucket type '%s' created", bucketName, bucketType)
+	return nil
+}
+
+// applyBucketParams sets the instance parameters as bucket properties
+func (c *Riak) applyBucketParams(ctx context.Context, bucketName, bucketType string, params map[string]string) error {
+	if len(params) == 0 {
+		return nil
+	}
+
+	b, err := c.Plans.bucketPropsBuilder(bucketType, params)
 	if err != nil {
-		return fmt.Errorf("Could not set props on bucket type: %v", err)
+		return err
 	}
 
-	if err = c.RiakClient.Execute(propsCmd); err != nil {
-		return fmt.Errorf("Could not set props on bucket type: %v", err)
+	cmd, err := b.WithBucket(bucketName).Build()
+	if err != nil {
+		return fmt.Errorf("Could not set bucket properties: %w", err)
 	}
 
-	logrus.Debugf("Bucket '%s' of bucket type '%s' created", bucketName, bucketType)
+	if err = c.execute(ctx, cmd); err != nil {
+		return fmt.Errorf("Could not set bucket properties: %w", err)
+	}
+	logrus.Debugf("Bucket '%s' properties set: %s", bucketName, FormatParams(params))
 	return nil
 }
 
-// saveBucketLocation will save the location (default bucket type) of the bucketname
-// in key->value form: bucketName->bucketType this is used so we can reach the
-// bucket when we don't have the bucketType.
-func (c *Riak) saveBucketLocation(bucketNameKey, bucketTypeValue string) error {
+// bucketTypeProps returns the json properties of the plan bucket type as
+// riak-admin expects them
+func bucketTypeProps(plan *config.Plan) (string, error) {
+	props := map[string]interface{}{}
+	for k, v := range plan.Props {
+		props[k] = v
+	}
+	if plan.DataType != "" {
+		props["datatype"] = plan.DataType
+	}
+
+	b, err := json.Marshal(map[string]interface{}{"props": props})
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// saveBucketInfo stores the instance record of the bucket as a json document
+// keyed by the bucket name, this is used so we can reach the bucket when we
+// don't have the bucketType
+func (c *Riak) saveBucketInfo(ctx context.Context, info *BucketInfo) error {
+	value, err := json.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("Could not store bucket info: %w", err)
+	}
+
 	// Our value to store
 	obj := &riak.Object{
-		ContentType:     "text/plain",
+		ContentType:     "application/json",
 		Charset:         "utf-8",
 		ContentEncoding: "utf-8",
-		Value:           []byte(bucketTypeValue),
+		Value:           value,
 	}
 
 	// Create command
 	cmd, err := riak.NewStoreValueCommandBuilder().
 		WithBucket(RiakInstancesInfoBucket).
-		WithKey(bucketNameKey).
+		WithKey(info.Name).
 		WithContent(obj).
 		Build()
 	if err != nil {
-		return fmt.Errorf("Could not store bucket location: %v", err)
+		return fmt.Errorf("Could not store bucket info: %w", err)
+	}
+
+	if err := c.execute(ctx, cmd); err != nil {
+		return fmt.Errorf("Could not store bucket info: %w", err)
+	}
+	logrus.Debugf("Bucket '%s' info stored", info.Name)
+	return nil
+}
+
+// deleteBucketLocation removes the instance record of the bucket stored by saveBucketInfo
+func (c *Riak) deleteBucketLocation(ctx context.Context, bucketNameKey string) error {
+	cmd, err := riak.NewDeleteValueCommandBuilder().
+		WithBucket(RiakInstancesInfoBucket).
+		WithKey(bucketNameKey).
+		Build()
+	if err != nil {
+		return fmt.Errorf("Could not delete bucket location: %w", err)
 	}
 
-	if err := c.RiakClient.Execute(cmd); err != nil {
-		return fmt.Errorf("Could not store bucket location: %v", err)
+	if err := c.execute(ctx, cmd); err != nil {
+		return fmt.Errorf("Could not delete bucket location: %w", err)
 	}
-	logrus.Debugf("Bucket '%s' location stored", bucketNameKey)
+	logrus.Debugf("Bucket '%s' location deleted", bucketNameKey)
 	return nil
 }
 
+// GetBucketInfo returns the registered information of the bucket
+func (c *Riak) GetBucketInfo(ctx context.Context, bucketName string) (*BucketInfo, error) {
+	cmd, err := riak.NewFetchValueCommandBuilder().
+		WithBucket(RiakInstancesInfoBucket).
+		WithKey(bucketName).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = c.execute(ctx, cmd); err != nil {
+		return nil, err
+	}
+
+	fvc, ok := cmd.(*riak.FetchValueCommand)
+	if !ok {
+		return nil, errors.New("Could not fetch any value")
+	}
+	if len(fvc.Response.Values) == 0 {
+		return nil, ErrInstanceNotFound
+	}
+
+	info, err := c.decodeBucketInfo(bucketName, fvc.Response.Values[0])
+	if err != nil {
+		return nil, err
+	}
+
+	logrus.Debugf("Retrieved bucket '%s' info", bucketName)
+	return info, nil
+}
+
+// decodeBucketInfo decodes an instance record. Instances created before the
+// records were json documents store the bucket type as plain text value and
+// the team and parameters as metadata
+func (c *Riak) decodeBucketInfo(bucketName string, obj *riak.Object) (*BucketInfo, error) {
+	info := &BucketInfo{}
+	if obj.ContentType == "application/json" {
+		if err := json.Unmarshal(obj.Value, info); err != nil {
+			return nil, fmt.Errorf("Could not decode bucket '%s' info: %w", bucketName, err)
+		}
+	} else {
+		info.BucketType = string(obj.Value)
+		info.CreatedAt = obj.LastModified
+		for _, m := range obj.UserMeta {
+			switch string(m.Key) {
+			case teamMetaKey:
+				info.Team = string(m.Value)
+			case parametersMetaKey:
+				if err := json.Unmarshal(m.Value, &info.Parameters); err != nil {
+					logrus.Errorf("Could not decode bucket '%s' parameters: %v", bucketName, err)
+				}
+			}
+		}
+	}
+	info.Name = bucketName
+	info.DataType = c.Plans.DataType(info.BucketType)
+	return info, nil
+}
+
+// ListBuckets returns the registered instances filtered by team and plan (bucket
+// type), blank filters match all the instances
+func (c *Riak) ListBuckets(ctx context.Context, team, plan string) ([]*BucketInfo, error) {
+	cmd, err := riak.NewListKeysCommandBuilder().
+		WithBucket(RiakInstancesInfoBucket).
+		WithTimeout(c.Timeouts.withDefaults().List).
+		Build()
+	if err != nil {
+		return nil, fmt.Errorf("Could not list buckets: %w", err)
+	}
+
+	if err = c.executeTimeout(ctx, cmd, c.Timeouts.withDefaults().List); err != nil {
+		return nil, fmt.Errorf("Could not list buckets: %w", err)
+	}
+
+	lkc, ok := cmd.(*riak.ListKeysCommand)
+	if !ok {
+		return nil, errors.New("Could not list buckets")
+	}
+
+	buckets := []*BucketInfo{}
+	for _, k := range lkc.Response.Keys {
+		info, err := c.GetBucketInfo(ctx, k)
+		if errors.Is(err, ErrInstanceNotFound) {
+			// Removed while listing
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Could not list buckets: %w", err)
+		}
+		if info.matches(team, plan) {
+			buckets = append(buckets, info)
+		}
+	}
+	sort.Sort(bucketsByName(buckets))
+
+	logrus.Debugf("Listed %d buckets (team: '%s', plan: '%s')", len(buckets), team, plan)
+	return buckets, nil
+}
+
+// GetBucketUsers returns the users granted on the bucket
+func (c *Riak) GetBucketUsers(ctx context.Context, bucketName string) ([]string, error) {
+	return c.getRegistryList(ctx, RiakInstanceUsersInfoBucket, bucketName)
+}
+
+// GetUserBuckets returns the buckets where the user is granted
+func (c *Riak) GetUserBuckets(ctx context.Context, username string) ([]string, error) {
+	return c.getRegistryList(ctx, RiakBindingsInfoBucket, username)
+}
+
+// CountBucketKeys returns the number of keys of the bucket, listing keys on
+// riak is expensive and not consistent so the number is only an approximation
+func (c *Riak) CountBucketKeys(ctx context.Context, bucketName string) (int, error) {
+	bucketType := c.GetBucketType(ctx, bucketName)
+	count := 0
+
+	// A retried listing counts from the start
+	reset := func() { count = 0 }
+	err := c.listKeys(ctx, bucketType, bucketName, reset, func(keys []string) error {
+		count += len(keys)
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("Could not count bucket keys: %w", err)
+	}
+
+	logrus.Debugf("Bucket '%s' has approximately %d keys", bucketName, count)
+	return count, nil
+}
+
+// registerBinding stores the binding of the user and the bucket on both
+// directions (bucket users and user buckets)
+func (c *Riak) registerBinding(ctx context.Context, username, bucketName string) error {
+	if err := c.addToRegistryList(ctx, RiakInstanceUsersInfoBucket, bucketName, username); err != nil {
+		return err
+	}
+	return c.addToRegistryList(ctx, RiakBindingsInfoBucket, username, bucketName)
+}
+
+// unregisterBinding removes the binding of the user and the bucket on both
+// directions (bucket users and user buckets)
+func (c *Riak) unregisterBinding(ctx context.Context, username, bucketName string) error {
+	if err := c.removeFromRegistryList(ctx, RiakInstanceUsersInfoBucket, bucketName, username); err != nil {
+		return err
+	}
+	return c.removeFromRegistryList(ctx, RiakBindingsInfoBucket, username, bucketName)
+}
+
 // IsAlive checks if riak store is alive
-func (c *Riak) IsAlive(bucketName string) (alive bool, err error) {
+func (c *Riak) IsAlive(ctx context.Context, bucketName string) (alive bool, err error) {
 
-	bucketType := c.GetBucketType(bucketName)
+	bucketType := c.GetBucketType(ctx, bucketName)
 
 	// Check buckets present
 	cmd, err := riak.NewListBucketsCommandBuilder().
 		WithBucketType(bucketType).
+		WithTimeout(c.Timeouts.withDefaults().List).
 		Build()
 
 	if err != nil {
@@ -495,7 +1585,7 @@ func (c *Riak) IsAlive(bucketName string) (alive bool, err error) {
 		return
 	}
 
-	err = c.RiakClient.Execute(cmd)
+	err = c.executeTimeout(ctx, cmd, c.Timeouts.withDefaults().List)
 	if err != nil {
 		logrus.Errorf("Bucket not alive: %v", err)
 		return
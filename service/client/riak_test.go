@@ -0,0 +1,385 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	riak "github.com/basho/riak-go-client"
+
+	"github.com/tsuru/riakapi/config"
+)
+
+const testPrintSourcesOutput = `
++-----------------------------------------+------------+----------+----------+
+|                  users                  |    cidr    |  source  | options  |
++-----------------------------------------+------------+----------+----------+
+|tsuru_myapp.tsuru.io, tsuru_other.io     | 0.0.0.0/0  | password |    []    |
+|          tsuru_myapp.tsuru.io           |10.0.0.5/32 | password |    []    |
+|          tsuru_myapp.tsuru.io           |10.0.0.6/32 |  trust   |    []    |
++-----------------------------------------+------------+----------+----------+
+`
+
+func TestRiakSyncLoginSources(t *testing.T) {
+	user := "tsuru_myapp.tsuru.io"
+
+	tests := []struct {
+		givenLogins []string
+		givenCIDRs  []string
+
+		wantCommands []string
+	}{
+		{ // Units registered, the open source is deleted after adding the units
+			givenLogins: []string{user},
+			givenCIDRs:  []string{"10.0.0.5/32", "10.0.0.7/32"},
+			wantCommands: []string{
+				printSourcesCmd,
+				adminCmd(grantSourceCmd, user, "10.0.0.7/32", passwordSource),
+				adminCmd(revokeSourceCmd, user, "0.0.0.0/0"),
+			},
+		},
+		{ // Already synced
+			givenLogins:  []string{user},
+			givenCIDRs:   []string{"0.0.0.0/0", "10.0.0.5/32"},
+			wantCommands: []string{printSourcesCmd},
+		},
+		{ // Last binding revoked, only the password sources are deleted
+			givenLogins: []string{user},
+			givenCIDRs:  []string{},
+			wantCommands: []string{
+				printSourcesCmd,
+				adminCmd(revokeSourceCmd, user, "0.0.0.0/0"),
+				adminCmd(revokeSourceCmd, user, "10.0.0.5/32"),
+			},
+		},
+		{ // Rotated with grace, all the logins are synced
+			givenLogins: []string{"tsuru2_myapp.tsuru.io", user},
+			givenCIDRs:  []string{"10.0.0.5/32"},
+			wantCommands: []string{
+				printSourcesCmd,
+				adminCmd(grantSourceCmd, "tsuru2_myapp.tsuru.io", "10.0.0.5/32", passwordSource),
+				adminCmd(revokeSourceCmd, user, "0.0.0.0/0"),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		admin := NewMemoryExecutor(func(cmd string) ([]byte, error) {
+			if strings.Contains(cmd, "print-sources") {
+				return []byte(testPrintSourcesOutput), nil
+			}
+			return []byte{}, nil
+		})
+		c := &Riak{Admin: admin}
+
+		if err := c.syncLoginSources(context.Background(), test.givenLogins, test.givenCIDRs); err != nil {
+			t.Errorf("Error syncing sources: %v", err)
+		}
+
+		if got := admin.Commands(); !reflect.DeepEqual(got, test.wantCommands) {
+			t.Errorf("Expected commands %#v;\ngot: %#v", test.wantCommands, got)
+		}
+	}
+}
+
+func TestRiakRevokeBindingGrants(t *testing.T) {
+	admin := NewMemoryExecutor(nil)
+	c := &Riak{Admin: admin}
+
+	// Removed instances revoke the grants of all the logins of each bound user
+	logins := []string{"tsuru2_myapp.tsuru.io", "tsuru_myapp.tsuru.io"}
+	if err := c.revokeBindingGrants(context.Background(), logins, BindModeReadOnly, "tsuru-counter", "mybucket"); err != nil {
+		t.Errorf("Error revoking grants: %v", err)
+	}
+
+	want := []string{
+		"sudo riak-admin security revoke 'riak_kv.get,riak_kv.index,riak_kv.list_keys' on 'tsuru-counter' 'mybucket' from 'tsuru2_myapp.tsuru.io'",
+		"sudo riak-admin security revoke 'riak_kv.get,riak_kv.index,riak_kv.list_keys' on 'tsuru-counter' 'mybucket' from 'tsuru_myapp.tsuru.io'",
+	}
+	if got := admin.Commands(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected commands %#v;\ngot: %#v", want, got)
+	}
+}
+
+func TestRiakGrantedBuckets(t *testing.T) {
+	grants := map[string]string{
+		// Bound before the bindings were registered
+		"tsuru_myapp.tsuru.io": `
+Dedicated permissions (user/tsuru_myapp.tsuru.io)
+
++-------------+----------+----------------------------------------+
+|    type     |  bucket  |                 grants                 |
++-------------+----------+----------------------------------------+
+|tsuru-counter|instance-b|riak_kv.get, riak_kv.put, riak_kv.delete|
+|             |          |, riak_kv.index                         |
++-------------+----------+----------------------------------------+
+`,
+		"tsuru2_myapp.tsuru.io": `
+Dedicated permissions (user/tsuru2_myapp.tsuru.io)
+
++-------------+----------+----------------------------------------+
+|    type     |  bucket  |                 grants                 |
++-------------+----------+----------------------------------------+
+|tsuru-counter|instance-b|riak_kv.get, riak_kv.put, riak_kv.delete|
+|             |          |, riak_kv.index                         |
++-------------+----------+----------------------------------------+
+`,
+	}
+	c := &Riak{Admin: NewMemoryExecutor(func(cmd string) ([]byte, error) {
+		for login, out := range grants {
+			if cmd == adminCmd(printGrantsCmd, login) {
+				return []byte(out), nil
+			}
+		}
+		return []byte{}, nil
+	})}
+
+	got, err := c.grantedBuckets(context.Background(), []string{"tsuru_myapp.tsuru.io", "tsuru2_myapp.tsuru.io"})
+	if want := []string{"tsuru-counter.instance-b"}; err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected granted buckets %v; got: %v, %v", want, got, err)
+	}
+
+	got, err = c.grantedBuckets(context.Background(), []string{"tsuru_otherapp.tsuru.io"})
+	if err != nil || len(got) != 0 {
+		t.Errorf("Expected no granted buckets; got: %v, %v", got, err)
+	}
+}
+
+func TestRiakEnsureBucketTypePresentCreatesPlanProps(t *testing.T) {
+	plans := Plans{
+		{
+			Name:     "tsuru-counter",
+			DataType: "counter",
+			Props:    map[string]interface{}{"n_val": 5, "allow_mult": true},
+		},
+		{
+			Name:  "tsuru-kv",
+			Props: map[string]interface{}{"backend": "bitcask_mult", "consistent": true, "write_once": true},
+		},
+	}
+
+	tests := []struct {
+		givenBucketType string
+		givenTypeList   string
+		givenTypeStatus string
+
+		wantCommands []string
+		wantError    bool
+	}{
+		{ // Data type plan
+			givenBucketType: "tsuru-counter",
+			givenTypeList:   "default (active)\n",
+			wantCommands: []string{
+				listBucketTypesCmd,
+				adminCmd(createBucketTypeCmd, "tsuru-counter", `{"props":{"allow_mult":true,"datatype":"counter","n_val":5}}`),
+				adminCmd(activateBucketTypeCmd, "tsuru-counter"),
+			},
+		},
+		{ // Key/value plan, similar names are not the bucket type
+			givenBucketType: "tsuru-kv",
+			givenTypeList:   "default (active)\ntsuru-kvs (active)\n",
+			wantCommands: []string{
+				listBucketTypesCmd,
+				adminCmd(createBucketTypeCmd, "tsuru-kv", `{"props":{"backend":"bitcask_mult","consistent":true,"write_once":true}}`),
+				adminCmd(activateBucketTypeCmd, "tsuru-kv"),
+			},
+		},
+		{ // Already present bucket type is only activated
+			givenBucketType: "tsuru-counter",
+			givenTypeList:   "default (active)\ntsuru-counter (not active)\n",
+			givenTypeStatus: "tsuru-counter is not active\n\nallow_mult: true\ndatatype: counter\n",
+			wantCommands: []string{
+				listBucketTypesCmd,
+				adminCmd(bucketTypeStatusCmd, "tsuru-counter"),
+				adminCmd(activateBucketTypeCmd, "tsuru-counter"),
+			},
+		},
+		{ // Already active bucket type
+			givenBucketType: "tsuru-kv",
+			givenTypeList:   "tsuru-kv (active)\n",
+			givenTypeStatus: "tsuru-kv is active\n\nallow_mult: false\n",
+			wantCommands: []string{
+				listBucketTypesCmd,
+				adminCmd(bucketTypeStatusCmd, "tsuru-kv"),
+			},
+		},
+		{ // Present bucket type of other data type
+			givenBucketType: "tsuru-counter",
+			givenTypeList:   "tsuru-counter (active)\n",
+			givenTypeStatus: "tsuru-counter is active\n\ndatatype: set\n",
+			wantCommands: []string{
+				listBucketTypesCmd,
+				adminCmd(bucketTypeStatusCmd, "tsuru-counter"),
+			},
+			wantError: true,
+		},
+	}
+
+	for _, test := range tests {
+		admin := NewMemoryExecutor(func(cmd string) ([]byte, error) {
+			switch {
+			case strings.Contains(cmd, "bucket-type list"):
+				return []byte(test.givenTypeList), nil
+			case strings.Contains(cmd, "bucket-type status"):
+				return []byte(test.givenTypeStatus), nil
+			}
+			return []byte{}, nil
+		})
+		c := &Riak{Admin: admin, Plans: plans}
+
+		err := c.ensureBucketTypePresent(context.Background(), test.givenBucketType)
+		if test.wantError && err == nil {
+			t.Errorf("Expected error ensuring bucket type '%s'", test.givenBucketType)
+		}
+		if !test.wantError && err != nil {
+			t.Errorf("Error ensuring bucket type: %v", err)
+		}
+
+		if got := admin.Commands(); !reflect.DeepEqual(got, test.wantCommands) {
+			t.Errorf("Expected commands %#v;\ngot: %#v", test.wantCommands, got)
+		}
+	}
+}
+
+func TestRiakEnsureBucketTypePresentUnavailableNode(t *testing.T) {
+	admin := NewMemoryExecutor(func(cmd string) ([]byte, error) {
+		return nil, fmt.Errorf("%w: connection refused", ErrBackendUnavailable)
+	})
+	c := &Riak{Admin: admin, Plans: config.DefaultPlans}
+
+	err := c.ensureBucketTypePresent(context.Background(), BucketTypeCounter)
+	if !errors.Is(err, ErrBackendUnavailable) {
+		t.Errorf("Expected unavailable error; got: %v", err)
+	}
+
+	// Bucket type is not created when the check can't reach the node
+	want := []string{listBucketTypesCmd}
+	if got := admin.Commands(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected commands %#v;\ngot: %#v", want, got)
+	}
+}
+
+func TestRiakWithoutPurgerInstances(t *testing.T) {
+	admin := NewMemoryExecutor(nil)
+	c := &Riak{Admin: admin, Plans: config.DefaultPlans}
+	ctx := context.Background()
+
+	info := &BucketInfo{Name: "myapp", BucketType: BucketTypeCounter}
+	if err := c.CreateBucket(ctx, info); err != ErrPurgerNotStarted {
+		t.Errorf("Expected purger not started error on create; got: %v", err)
+	}
+	if err := c.DeleteBucket(ctx, "myapp", BucketTypeCounter); err != ErrPurgerNotStarted {
+		t.Errorf("Expected purger not started error on delete; got: %v", err)
+	}
+
+	// Nothing is touched
+	if got := admin.Commands(); len(got) != 0 {
+		t.Errorf("Expected no commands; got: %#v", got)
+	}
+}
+
+func TestRiakListKeysRetriedStream(t *testing.T) {
+	var staleFn func(keys []string) error
+	attempts := 0
+	c := &Riak{
+		Retry: NewRetryPolicy(3, time.Millisecond, time.Millisecond, 0),
+		KeysStream: func(ctx context.Context, bucketType, bucketName string, timeout time.Duration, fn func(keys []string) error) error {
+			attempts++
+			if attempts == 1 {
+				// The stream fails after sending some keys
+				staleFn = fn
+				if err := fn([]string{"k1", "k2"}); err != nil {
+					return err
+				}
+				return fmt.Errorf("%w: connection reset", ErrBackendUnavailable)
+			}
+			if err := fn([]string{"k1", "k2"}); err != nil {
+				return err
+			}
+			return fn([]string{"k3"})
+		},
+	}
+
+	count := 0
+	err := c.listKeys(context.Background(), BucketTypeCounter, "myapp", func() { count = 0 }, func(keys []string) error {
+		count += len(keys)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Error listing keys: %v", err)
+	}
+	if attempts != 2 {
+		t.Errorf("Expected 2 attempts; got: %d", attempts)
+	}
+	if count != 3 {
+		t.Errorf("Expected 3 keys; got: %d", count)
+	}
+
+	// The keys of the abandoned attempt are dropped
+	if err := staleFn([]string{"k4"}); err != errStaleListing {
+		t.Errorf("Expected stale listing error; got: %v", err)
+	}
+	if count != 3 {
+		t.Errorf("Expected 3 keys after the stale ones; got: %d", count)
+	}
+}
+
+func TestRiakDecodeBucketInfo(t *testing.T) {
+	createdAt := time.Date(2016, 5, 10, 12, 30, 0, 0, time.UTC)
+	c := &Riak{Plans: config.DefaultPlans}
+
+	tests := []struct {
+		givenObject *riak.Object
+
+		wantInfo *BucketInfo
+	}{
+		{ // Json record
+			givenObject: &riak.Object{
+				ContentType: "application/json",
+				Value:       []byte(`{"name":"mybucket","bucket_type":"tsuru-set","team":"myteam","creator":"me@tsuru.io","created_at":"2016-05-10T12:30:00Z","tags":["prod"]}`),
+			},
+			wantInfo: &BucketInfo{
+				Name:       "mybucket",
+				BucketType: "tsuru-set",
+				DataType:   "set",
+				Team:       "myteam",
+				Creator:    "me@tsuru.io",
+				CreatedAt:  createdAt,
+				Tags:       []string{"prod"},
+			},
+		},
+		{ // Legacy plain text record
+			givenObject: &riak.Object{
+				ContentType:  "text/plain",
+				Value:        []byte("tsuru-counter"),
+				LastModified: createdAt,
+				UserMeta: []*riak.Pair{
+					{Key: []byte(teamMetaKey), Value: []byte("myteam")},
+					{Key: []byte(parametersMetaKey), Value: []byte(`{"n_val":"5"}`)},
+				},
+			},
+			wantInfo: &BucketInfo{
+				Name:       "mybucket",
+				BucketType: "tsuru-counter",
+				DataType:   "counter",
+				Team:       "myteam",
+				CreatedAt:  createdAt,
+				Parameters: map[string]string{"n_val": "5"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		got, err := c.decodeBucketInfo("mybucket", test.givenObject)
+		if err != nil {
+			t.Errorf("Error decoding bucket info: %v", err)
+		}
+		if !reflect.DeepEqual(got, test.wantInfo) {
+			t.Errorf("Expected bucket info %#v;\ngot: %#v", test.wantInfo, got)
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	riak "github.com/basho/riak-go-client"
+
+	"github.com/tsuru/riakapi/utils"
+)
+
+// RiakUserLoginsInfoBucket holds the riak logins of the users rotated with
+// grace, users not present use their name as login
+const RiakUserLoginsInfoBucket = "tsuru-user-logins"
+
+// rotatedUsernamePrefix prefixes the alternate login of the users, the users
+// rotated with grace switch between their name and the alternate login
+const rotatedUsernamePrefix = "tsuru2_"
+
+// UserLogins are the riak users an app user logs in with, the previous login
+// keeps the old password valid until the rotation is confirmed
+type UserLogins struct {
+	Login    string `json:"login"`
+	Previous string `json:"previous,omitempty"`
+}
+
+// all returns the riak users of the logins
+func (l *UserLogins) all() []string {
+	if l.Previous == "" {
+		return []string{l.Login}
+	}
+	return []string{l.Login, l.Previous}
+}
+
+// RotationResult is the result of a password rotation, the instances bound to
+// the app have to be bound again to get the new password
+type RotationResult struct {
+	// User is the riak user the app logs in with
+	User string `json:"user"`
+	// Instances are the instances the app is bound to
+	Instances []string `json:"instances"`
+	// Grace is true when the previous password is valid until confirmed
+	Grace bool `json:"grace"`
+}
+
+// alternateLogin returns the other login of the user
+func alternateLogin(username, login string) string {
+	if login == username {
+		return rotatedUsernamePrefix + utils.UsernameWord(username)
+	}
+	return username
+}
+
+// RotateUserPassword changes the user password, the apps get it when they are
+// bound again. With grace the new password is set to the alternate login of the
+// user (with the same grants) and the previous one is valid until the rotation
+// is confirmed
+func (c *Riak) RotateUserPassword(ctx context.Context, username string, grace bool) (*RotationResult, error) {
+	unlock, err := c.Locker.Lock(ctx, userLockKey(username))
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	oldPass, found, err := c.userPassword(ctx, username)
+	if err != nil {
+		return nil, err
+	} else if !found {
+		return nil, ErrUserNotFound
+	}
+
+	logins, err := c.getUserLogins(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if logins.Previous != "" {
+		return nil, fmt.Errorf("%w: '%s' still valid", ErrRotationPending, logins.Previous)
+	}
+	buckets, err := c.GetUserBuckets(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+
+	pass, err := utils.GenerateRandomPassword()
+	if err != nil {
+		return nil, fmt.Errorf("Could not generate password: %w", err)
+	}
+
+	newLogins := &UserLogins{Login: logins.Login}
+	if grace {
+		newLogins = &UserLogins{Login: alternateLogin(username, logins.Login), Previous: logins.Login}
+		err = c.rotateWithGrace(ctx, username, buckets, logins, newLogins, pass)
+	} else {
+		err = c.rotateLoginPassword(ctx, logins.Login, oldPass, pass, func(ctx context.Context, pass string) error {
+			return c.storeUserPassword(ctx, username, pass)
+		})
+	}
+	if err != nil {
+		logrus.Errorf("Could not rotate user '%s' password: %v", username, err)
+		return nil, err
+	}
+
+	logrus.Infof("User '%s' password rotated (login '%s', grace %t), %d instances to bind again", username, newLogins.Login, grace, len(buckets))
+	return &RotationResult{User: newLogins.Login, Instances: buckets, Grace: grace}, nil
+}
+
+// rotateLoginPassword changes the login password and stores it, the old password
+// is set back if it can't be stored (the binds would get the old one)
+func (c *Riak) rotateLoginPassword(ctx context.Context, login, oldPass, pass string, store func(ctx context.Context, pass string) error) error {
+	return runSteps(ctx,
+		step{
+			name: fmt.Sprintf("user '%s' password change", login),
+			do: func(ctx context.Context) error {
+				_, err := c.admin(ctx, adminCmd(alterUserCmd, login, "password="+pass))
+				return err
+			},
+			undo: func(ctx context.Context) error {
+				_, err := c.admin(ctx, adminCmd(alterUserCmd, login, "password="+oldPass))
+				return err
+			},
+		},
+		step{
+			name: fmt.Sprintf("user '%s' password store", login),
+			do: func(ctx context.Context) error {
+				return store(ctx, pass)
+			},
+		},
+	)
+}
+
+// rotateWithGrace creates the new login with the password and the grants of the
+// user bindings, the previous login is kept
+func (c *Riak) rotateWithGrace(ctx context.Context, username string, buckets []string, logins, newLogins *UserLogins, pass string) error {
+	login := newLogins.Login
+	steps := []step{
+		{
+			name: fmt.Sprintf("user '%s' creation", login),
+			do: func(ctx context.Context) error {
+				// A login left by a failed confirmation
+				present, err := c.securityUserPresent(ctx, login)
+				if err != nil {
+					return err
+				}
+				cmdFmt := createUserCmd
+				if present {
+					cmdFmt = alterUserCmd
+				}
+				_, err = c.admin(ctx, adminCmd(cmdFmt, login, "password="+pass))
+				return err
+			},
+			// Deleting the user deletes its grants and sources too
+			undo: func(ctx context.Context) error {
+				_, err := c.admin(ctx, adminCmd(deleteUserCmd, login))
+				return err
+			},
+		},
+	}
+
+	for _, b := range buckets {
+		bucketName := b
+		steps = append(steps, step{
+			name: fmt.Sprintf("user '%s' grant on '%s'", login, bucketName),
+			do: func(ctx context.Context) error {
+				info, err := c.GetBucketInfo(ctx, bucketName)
+				if err != nil {
+					return err
+				}
+				mode, err := c.getBindingMode(ctx, username, bucketName)
+				if err != nil {
+					return err
+				}
+				_, err = c.admin(ctx, adminCmd(grantUserCmd, mode.Permissions(), info.BucketType, bucketName, login))
+				return err
+			},
+		})
+	}
+
+	return runSteps(ctx, append(steps,
+		step{
+			name: fmt.Sprintf("user '%s' logins store", username),
+			do: func(ctx context.Context) error {
+				return c.saveUserLogins(ctx, username, newLogins)
+			},
+			undo: func(ctx context.Context) error {
+				return c.saveUserLogins(ctx, username, logins)
+			},
+		},
+		// The new login gets the sources of the user
+		step{
+			name: fmt.Sprintf("user '%s' sources", login),
+			do: func(ctx context.Context) error {
+				return c.syncUserSources(ctx, username)
+			},
+		},
+		step{
+			name: fmt.Sprintf("user '%s' password store", username),
+			do: func(ctx context.Context) error {
+				return c.storeUserPassword(ctx, username, pass)
+			},
+		},
+	)...)
+}
+
+// ConfirmUserRotation deletes the previous login of a rotation with grace, the
+// old password is not valid anymore
+func (c *Riak) ConfirmUserRotation(ctx context.Context, username string) error {
+	unlock, err := c.Locker.Lock(ctx, userLockKey(username))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := c.checkUserPresent(ctx, username); err != nil {
+		return err
+	}
+	logins, err := c.getUserLogins(ctx, username)
+	if err != nil {
+		return err
+	}
+	if logins.Previous == "" {
+		return ErrRotationNotPending
+	}
+
+	// Deleted before forgetting it, so a failed confirmation can be retried
+	present, err := c.securityUserPresent(ctx, logins.Previous)
+	if err != nil {
+		return err
+	}
+	if present {
+		if _, err := c.admin(ctx, adminCmd(deleteUserCmd, logins.Previous)); err != nil {
+			logrus.Errorf("Could not confirm user '%s' rotation: %v", username, err)
+			return fmt.Errorf("Could not delete previous login: %w", err)
+		}
+	}
+
+	// The previous login could be used again by the next rotation, its
+	// certificates are revoked
+	buckets, err := c.GetUserBuckets(ctx, username)
+	if err != nil {
+		return err
+	}
+	for _, b := range buckets {
+		previous := func(ic *IssuedCert) bool { return ic.Login == logins.Previous }
+		if err := c.revokeBindingCerts(ctx, username, b, previous); err != nil {
+			logrus.Errorf("Could not confirm user '%s' rotation: %v", username, err)
+			return err
+		}
+	}
+
+	if err := c.saveUserLogins(ctx, username, &UserLogins{Login: logins.Login}); err != nil {
+		logrus.Errorf("Could not confirm user '%s' rotation: %v", username, err)
+		return err
+	}
+	logrus.Infof("User '%s' rotation confirmed, login '%s' deleted", username, logins.Previous)
+	return nil
+}
+
+// getUserLogins returns the logins of the user, its name if not rotated with grace
+func (c *Riak) getUserLogins(ctx context.Context, username string) (*UserLogins, error) {
+	cmd, err := riak.NewFetchValueCommandBuilder().
+		WithBucket(RiakUserLoginsInfoBucket).
+		WithKey(username).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = c.execute(ctx, cmd); err != nil {
+		return nil, err
+	}
+
+	fvc, ok := cmd.(*riak.FetchValueCommand)
+	if !ok {
+		return nil, errors.New("Could not fetch any value")
+	}
+	if len(fvc.Response.Values) == 0 {
+		return &UserLogins{Login: username}, nil
+	}
+
+	logins := &UserLogins{}
+	if err := json.Unmarshal(fvc.Response.Values[0].Value, logins); err != nil {
+		return nil, fmt.Errorf("Could not decode user '%s' logins: %w", username, err)
+	}
+	return logins, nil
+}
+
+// saveUserLogins stores the logins of the user, the users logging in with their
+// name don't need the record
+func (c *Riak) saveUserLogins(ctx context.Context, username string, logins *UserLogins) error {
+	if logins.Login == username && logins.Previous == "" {
+		return c.deleteUserLogins(ctx, username)
+	}
+
+	value, err := json.Marshal(logins)
+	if err != nil {
+		return fmt.Errorf("Could not store user logins: %w", err)
+	}
+	obj := &riak.Object{
+		ContentType:     "application/json",
+		Charset:         "utf-8",
+		ContentEncoding: "utf-8",
+		Value:           value,
+	}
+	cmd, err := riak.NewStoreValueCommandBuilder().
+		WithBucket(RiakUserLoginsInfoBucket).
+		WithKey(username).
+		WithContent(obj).
+		Build()
+	if err != nil {
+		return fmt.Errorf("Could not store user logins: %w", err)
+	}
+
+	if err = c.execute(ctx, cmd); err != nil {
+		return fmt.Errorf("Could not store user logins: %w", err)
+	}
+	logrus.Debugf("User '%s' logins stored: %s", username, strings.Join(logins.all(), ", "))
+	return nil
+}
+
+// deleteUserLogins removes the logins record of the user
+func (c *Riak) deleteUserLogins(ctx context.Context, username string) error {
+	cmd, err := riak.NewDeleteValueCommandBuilder().
+		WithBucket(RiakUserLoginsInfoBucket).
+		WithKey(username).
+		Build()
+	if err != nil {
+		return fmt.Errorf("Could not delete user logins: %w", err)
+	}
+
+	if err = c.execute(ctx, cmd); err != nil {
+		return fmt.Errorf("Could not delete user logins: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestAlternateLogin(t *testing.T) {
+	tests := []struct {
+		givenLogin string
+
+		wantLogin string
+	}{
+		{givenLogin: "tsuru_myapp.tsuru.io", wantLogin: "tsuru2_myapp.tsuru.io"},
+		{givenLogin: "tsuru2_myapp.tsuru.io", wantLogin: "tsuru_myapp.tsuru.io"},
+	}
+
+	for _, test := range tests {
+		got := alternateLogin("tsuru_myapp.tsuru.io", test.givenLogin)
+		if got != test.wantLogin {
+			t.Errorf("Expected alternate login of '%s' '%s'; got: '%s'", test.givenLogin, test.wantLogin, got)
+		}
+		// Switching twice returns the same login
+		if back := alternateLogin("tsuru_myapp.tsuru.io", got); back != test.givenLogin {
+			t.Errorf("Expected alternate login of '%s' '%s'; got: '%s'", got, test.givenLogin, back)
+		}
+	}
+}
+
+func TestUserLoginsAll(t *testing.T) {
+	tests := []struct {
+		givenLogins *UserLogins
+
+		wantAll []string
+	}{
+		{
+			givenLogins: &UserLogins{Login: "tsuru_myapp"},
+			wantAll:     []string{"tsuru_myapp"},
+		},
+		{
+			givenLogins: &UserLogins{Login: "tsuru2_myapp", Previous: "tsuru_myapp"},
+			wantAll:     []string{"tsuru2_myapp", "tsuru_myapp"},
+		},
+	}
+
+	for _, test := range tests {
+		if got := test.givenLogins.all(); !reflect.DeepEqual(got, test.wantAll) {
+			t.Errorf("Expected logins %v; got: %v", test.wantAll, got)
+		}
+	}
+}
+
+func TestRiakRotateLoginPassword(t *testing.T) {
+	tests := []struct {
+		givenStoreErr error
+
+		wantStored   string
+		wantCommands []string
+	}{
+		{
+			wantStored: "new",
+			wantCommands: []string{
+				adminCmd(alterUserCmd, "tsuru_myapp", "password=new"),
+			},
+		},
+		{ // The old password is set back, the stored one is still valid
+			givenStoreErr: errors.New("store failed"),
+			wantCommands: []string{
+				adminCmd(alterUserCmd, "tsuru_myapp", "password=new"),
+				adminCmd(alterUserCmd, "tsuru_myapp", "password=old"),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		admin := NewMemoryExecutor(nil)
+		c := &Riak{Admin: admin}
+
+		stored := ""
+		err := c.rotateLoginPassword(context.Background(), "tsuru_myapp", "old", "new", func(ctx context.Context, pass string) error {
+			if test.givenStoreErr != nil {
+				return test.givenStoreErr
+			}
+			stored = pass
+			return nil
+		})
+		if !errors.Is(err, test.givenStoreErr) {
+			t.Errorf("Expected error %v; got: %v", test.givenStoreErr, err)
+		}
+		if stored != test.wantStored {
+			t.Errorf("Expected stored password '%s'; got: '%s'", test.wantStored, stored)
+		}
+		if got := admin.Commands(); !reflect.DeepEqual(got, test.wantCommands) {
+			t.Errorf("Expected commands %#v;\ngot: %#v", test.wantCommands, got)
+		}
+	}
+}
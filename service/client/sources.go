@@ -0,0 +1,241 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// RiakBindingUnitsInfoBucket holds the unit addresses of each binding, the
+// users can only connect from the units of their apps
+const RiakBindingUnitsInfoBucket = "tsuru-binding-units"
+
+// passwordSource is the riak source of the users authenticated with password
+const passwordSource = "password"
+
+// bindingUnitsKey is the key of the binding on the binding units bucket
+func bindingUnitsKey(username, bucketName string) string {
+	return bindingModeKey(username, bucketName)
+}
+
+// unitSourceCIDR returns the source cidr of a unit address (a single host
+// network), ErrInvalidParameter if it's not an IP address
+func unitSourceCIDR(unitHost string) (string, error) {
+	host := unitHost
+	if h, _, err := net.SplitHostPort(unitHost); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "", fmt.Errorf("%w: unit host '%s' is not an IP address", ErrInvalidParameter, unitHost)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String() + "/32", nil
+	}
+	return ip.String() + "/128", nil
+}
+
+// BindUnit registers the unit address on the binding, the user can connect
+// from the unit instead of the plan allowed networks
+func (c *Riak) BindUnit(ctx context.Context, username, bucketName, unitHost string) error {
+	cidr, err := unitSourceCIDR(unitHost)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := c.Locker.Lock(ctx, bucketLockKey(bucketName), userLockKey(username))
+	if err != nil {
+		logrus.Errorf("Error binding unit: %v", err)
+		return err
+	}
+	defer unlock()
+
+	if _, err := c.GetBucketInfo(ctx, bucketName); err != nil {
+		logrus.Errorf("Error binding unit: %v", err)
+		return err
+	}
+	if _, bound, err := c.boundMode(ctx, username, bucketName); err != nil {
+		logrus.Errorf("Error binding unit: %v", err)
+		return err
+	} else if !bound {
+		return fmt.Errorf("%w: '%s' is not bound to '%s'", ErrUserNotFound, username, bucketName)
+	}
+
+	if err := c.addToRegistryList(ctx, RiakBindingUnitsInfoBucket, bindingUnitsKey(username, bucketName), cidr); err != nil {
+		logrus.Errorf("Error binding unit: %v", err)
+		return err
+	}
+	if err := c.syncUserSources(ctx, username); err != nil {
+		logrus.Errorf("Error binding unit: %v", err)
+		return err
+	}
+
+	logrus.Infof("Unit '%s' of user '%s' bound on '%s'", cidr, username, bucketName)
+	return nil
+}
+
+// UnbindUnit unregisters the unit address of the binding, the user can't
+// connect from the unit unless other binding has it
+func (c *Riak) UnbindUnit(ctx context.Context, username, bucketName, unitHost string) error {
+	cidr, err := unitSourceCIDR(unitHost)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := c.Locker.Lock(ctx, bucketLockKey(bucketName), userLockKey(username))
+	if err != nil {
+		logrus.Errorf("Error unbinding unit: %v", err)
+		return err
+	}
+	defer unlock()
+
+	// The binding keeps its units record even without units, so the user
+	// doesn't get the plan networks back
+	key := bindingUnitsKey(username, bucketName)
+	units, err := c.getRegistryList(ctx, RiakBindingUnitsInfoBucket, key)
+	if err != nil {
+		logrus.Errorf("Error unbinding unit: %v", err)
+		return err
+	}
+	kept := []string{}
+	for _, u := range units {
+		if u != cidr {
+			kept = append(kept, u)
+		}
+	}
+	if err := c.saveRegistryList(ctx, RiakBindingUnitsInfoBucket, key, kept); err != nil {
+		logrus.Errorf("Error unbinding unit: %v", err)
+		return err
+	}
+	if err := c.syncUserSources(ctx, username); err != nil {
+		logrus.Errorf("Error unbinding unit: %v", err)
+		return err
+	}
+
+	logrus.Infof("Unit '%s' of user '%s' unbound from '%s'", cidr, username, bucketName)
+	return nil
+}
+
+// deleteBindingUnits removes the unit addresses of a binding
+func (c *Riak) deleteBindingUnits(ctx context.Context, username, bucketName string) error {
+	return c.storeRegistryList(ctx, RiakBindingUnitsInfoBucket, bindingUnitsKey(username, bucketName), nil)
+}
+
+// userSourceCIDRs returns the networks the user can connect from, the units of
+// each binding or the plan allowed networks if its units were never registered
+// (a binding without units left has no networks)
+func (c *Riak) userSourceCIDRs(ctx context.Context, username string) ([]string, error) {
+	buckets, err := c.GetUserBuckets(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+
+	cidrs := map[string]bool{}
+	for _, b := range buckets {
+		units, registered, err := c.fetchRegistryList(ctx, RiakBindingUnitsInfoBucket, bindingUnitsKey(username, b))
+		if err != nil {
+			return nil, err
+		}
+		if !registered {
+			info, err := c.GetBucketInfo(ctx, b)
+			if errors.Is(err, ErrInstanceNotFound) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			units = c.Plans.AllowedCIDRs(info.BucketType)
+		}
+		for _, u := range units {
+			cidrs[u] = true
+		}
+	}
+
+	res := []string{}
+	for cidr := range cidrs {
+		res = append(res, cidr)
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// syncUserSources sets the sources of all the user logins to the networks it
+// can connect from, a user without bindings has no sources
+func (c *Riak) syncUserSources(ctx context.Context, username string) error {
+	cidrs, err := c.userSourceCIDRs(ctx, username)
+	if err != nil {
+		return fmt.Errorf("Could not get user sources: %w", err)
+	}
+	logins, err := c.getUserLogins(ctx, username)
+	if err != nil {
+		return err
+	}
+	return c.syncLoginSources(ctx, logins.all(), cidrs)
+}
+
+// syncLoginSources adds the missing sources of the logins and deletes the ones
+// not on the cidrs, the sources of other type (password or certificate) are
+// replaced. The new sources are added first so the user can connect meanwhile
+func (c *Riak) syncLoginSources(ctx context.Context, logins, cidrs []string) error {
+	out, err := c.admin(ctx, printSourcesCmd)
+	if err != nil {
+		return fmt.Errorf("Could not get user sources: %w", err)
+	}
+	sources := parsePrintSources(out)
+	sourceType := c.sourceType()
+
+	for _, login := range logins {
+		current, all := []string{}, []string{}
+		for _, s := range sources {
+			switch {
+			case s.hasSource(login, s.CIDR, sourceType):
+				current = append(current, s.CIDR)
+				all = append(all, s.CIDR)
+			case s.hasSource(login, s.CIDR, passwordSource), s.hasSource(login, s.CIDR, certificateSource):
+				all = append(all, s.CIDR)
+			}
+		}
+
+		// Adding the source of a cidr replaces the one of other type
+		add, _ := diffSources(current, cidrs)
+		_, del := diffSources(all, cidrs)
+		for _, cidr := range add {
+			if _, err := c.admin(ctx, adminCmd(grantSourceCmd, login, cidr, sourceType)); err != nil {
+				return fmt.Errorf("Could not add user source: %w", err)
+			}
+			logrus.Debugf("User '%s' source '%s' added", login, cidr)
+		}
+		for _, cidr := range del {
+			if _, err := c.admin(ctx, adminCmd(revokeSourceCmd, login, cidr)); err != nil {
+				return fmt.Errorf("Could not delete user source: %w", err)
+			}
+			logrus.Debugf("User '%s' source '%s' deleted", login, cidr)
+		}
+	}
+	return nil
+}
+
+// diffSources returns the cidrs to add and delete to get the wanted sources
+func diffSources(current, wanted []string) (add, del []string) {
+	has := map[string]bool{}
+	for _, c := range current {
+		has[c] = true
+	}
+	want := map[string]bool{}
+	for _, w := range wanted {
+		want[w] = true
+		if !has[w] {
+			add = append(add, w)
+		}
+	}
+	for _, c := range current {
+		if !want[c] {
+			del = append(del, c)
+		}
+	}
+	return add, del
+}
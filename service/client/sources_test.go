@@ -0,0 +1,48 @@
+package client
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestUnitSourceCIDR(t *testing.T) {
+	tests := []struct {
+		givenUnitHost string
+
+		wantCIDR  string
+		wantError bool
+	}{
+		{givenUnitHost: "10.0.0.5", wantCIDR: "10.0.0.5/32"},
+		{givenUnitHost: "10.0.0.5:8080", wantCIDR: "10.0.0.5/32"},
+		{givenUnitHost: "fd00::5", wantCIDR: "fd00::5/128"},
+		{givenUnitHost: "unit-1.tsuru.io", wantError: true},
+		{givenUnitHost: "10.0.0.5/24", wantError: true},
+	}
+
+	for _, test := range tests {
+		got, err := unitSourceCIDR(test.givenUnitHost)
+		if test.wantError {
+			if !errors.Is(err, ErrInvalidParameter) {
+				t.Errorf("Expected invalid parameter error on '%s'; got: %v", test.givenUnitHost, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Error on '%s': %v", test.givenUnitHost, err)
+		}
+		if got != test.wantCIDR {
+			t.Errorf("Expected cidr '%s'; got: '%s'", test.wantCIDR, got)
+		}
+	}
+}
+
+func TestDiffSources(t *testing.T) {
+	add, del := diffSources([]string{"0.0.0.0/0", "10.0.0.5/32"}, []string{"10.0.0.5/32", "10.0.0.6/32"})
+	if want := []string{"10.0.0.6/32"}; !reflect.DeepEqual(add, want) {
+		t.Errorf("Expected added sources %v; got: %v", want, add)
+	}
+	if want := []string{"0.0.0.0/0"}; !reflect.DeepEqual(del, want) {
+		t.Errorf("Expected deleted sources %v; got: %v", want, del)
+	}
+}
@@ -0,0 +1,374 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// SSH connection defaults
+const (
+	defaultSSHKeepaliveInterval = 30 * time.Second
+	defaultSSHMaxSessions       = 8
+	defaultSSHDialAttempts      = 3
+	defaultSSHDialBackoff       = 500 * time.Millisecond
+	defaultSSHDialTimeout       = 30 * time.Second
+	maxSSHDialBackoff           = 10 * time.Second
+)
+
+// errSSHClosed is returned when the executor is used after closing it
+var errSSHClosed = errors.New("ssh executor closed")
+
+// SSHOptions are the connection settings of the ssh executor, zero values use
+// the defaults
+type SSHOptions struct {
+	// KeepaliveInterval is the time between keepalive requests, they detect
+	// broken connections and avoid idle timeouts
+	KeepaliveInterval time.Duration
+	// MaxSessions is the maximum number of concurrent sessions, should be below
+	// the server MaxSessions (10 on OpenSSH by default)
+	MaxSessions int
+	// DialAttempts is the number of dial attempts before failing
+	DialAttempts int
+	// DialBackoff is the wait after the first failed dial, doubled on each retry
+	DialBackoff time.Duration
+}
+
+// withDefaults returns the options with the defaults set
+func (o SSHOptions) withDefaults() SSHOptions {
+	if o.KeepaliveInterval <= 0 {
+		o.KeepaliveInterval = defaultSSHKeepaliveInterval
+	}
+	if o.MaxSessions <= 0 {
+		o.MaxSessions = defaultSSHMaxSessions
+	}
+	if o.DialAttempts <= 0 {
+		o.DialAttempts = defaultSSHDialAttempts
+	}
+	if o.DialBackoff <= 0 {
+		o.DialBackoff = defaultSSHDialBackoff
+	}
+	return o
+}
+
+// SSHExecutor runs the commands on a remote riak node through ssh, each
+// command on a new session of the same connection. Broken connections are
+// detected (keepalives and failed sessions) and dialed again with backoff
+type SSHExecutor struct {
+	addr   string
+	config *ssh.ClientConfig
+	opts   SSHOptions
+
+	// sessions limits the concurrent sessions
+	sessions chan struct{}
+
+	mutex   sync.Mutex
+	client  *ssh.Client
+	dialing *sshDial
+	closed  bool
+	done    chan struct{}
+}
+
+// sshDial is a connection being dialed, the commands waiting for it share the
+// result
+type sshDial struct {
+	done   chan struct{}
+	client *ssh.Client
+	err    error
+}
+
+// NewSSHExecutor dials the ssh server and creates the executor
+func NewSSHExecutor(addr string, sshConfig *ssh.ClientConfig, opts SSHOptions) (*SSHExecutor, error) {
+	e := NewLazySSHExecutor(addr, sshConfig, opts)
+	if _, err := e.getClient(context.Background()); err != nil {
+		e.Close()
+		return nil, err
+	}
+	return e, nil
+}
+
+// NewLazySSHExecutor creates the executor without dialing, the connection is
+// made on the first command. Useful for nodes that could be down on startup
+func NewLazySSHExecutor(addr string, sshConfig *ssh.ClientConfig, opts SSHOptions) *SSHExecutor {
+	opts = opts.withDefaults()
+	e := &SSHExecutor{
+		addr:     addr,
+		config:   sshConfig,
+		opts:     opts,
+		sessions: make(chan struct{}, opts.MaxSessions),
+		done:     make(chan struct{}),
+	}
+	go e.keepalive()
+	return e
+}
+
+// Run runs the command on a new ssh session, if the session can't be opened
+// the connection is dialed again and the session retried once. When the context
+// is done the command is killed and the session closed
+func (e *SSHExecutor) Run(ctx context.Context, cmd string) ([]byte, error) {
+	select {
+	case e.sessions <- struct{}{}:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("riak-admin command not run: %w", ctx.Err())
+	}
+	defer func() { <-e.sessions }()
+
+	session, err := e.newSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+
+	logrus.Debugf("Running '%s' through ssh", redactCommand(cmd))
+	if err := session.Start(cmd); err != nil {
+		return nil, fmt.Errorf("%w: could not run command: %v", ErrBackendUnavailable, err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- session.Wait() }()
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		session.Signal(ssh.SIGKILL)
+		session.Close()
+		return nil, fmt.Errorf("riak-admin command not finished: %w", ctx.Err())
+	}
+
+	out := stdout.Bytes()
+	if err != nil {
+		exitErr, ok := err.(*ssh.ExitError)
+		if !ok {
+			// The command could have run, don't retry it
+			return nil, fmt.Errorf("%w: %v", ErrCommandInterrupted, err)
+		}
+		return out, &CommandError{ExitStatus: exitErr.ExitStatus(), Stdout: out, Stderr: stderr.Bytes()}
+	}
+	return out, nil
+}
+
+// newSession opens a session, redialing once if the connection is broken
+func (e *SSHExecutor) newSession(ctx context.Context) (*ssh.Session, error) {
+	var lastErr error
+	for i := 0; i < 2; i++ {
+		client, err := e.getClient(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		session, err := client.NewSession()
+		if err == nil {
+			return session, nil
+		}
+		lastErr = err
+		logrus.Warningf("Could not open ssh session on '%s', reconnecting: %v", e.addr, err)
+		e.reset(client)
+	}
+	return nil, fmt.Errorf("%w: could not open ssh session: %v", ErrBackendUnavailable, lastErr)
+}
+
+// getClient returns the current connection, dialing if there isn't one. Only
+// one dial is in flight, the commands wait for it until their context is done
+func (e *SSHExecutor) getClient(ctx context.Context) (*ssh.Client, error) {
+	e.mutex.Lock()
+	if e.closed {
+		e.mutex.Unlock()
+		return nil, fmt.Errorf("%w: %v", ErrBackendUnavailable, errSSHClosed)
+	}
+	if client := e.client; client != nil {
+		e.mutex.Unlock()
+		return client, nil
+	}
+	d := e.dialing
+	if d == nil {
+		d = &sshDial{done: make(chan struct{})}
+		e.dialing = d
+		go e.connect(d)
+	}
+	e.mutex.Unlock()
+
+	select {
+	case <-d.done:
+		return d.client, d.err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("ssh connection to '%s' not made: %w", e.addr, ctx.Err())
+	}
+}
+
+// connect dials the shared connection. The dial is not bound to the context of
+// the command that started it (it would fail the other waiting commands), it's
+// stopped when the executor is closed
+func (e *SSHExecutor) connect(d *sshDial) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-e.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	client, err := e.dial(ctx)
+
+	e.mutex.Lock()
+	e.dialing = nil
+	if e.closed {
+		if client != nil {
+			client.Close()
+		}
+		client, err = nil, fmt.Errorf("%w: %v", ErrBackendUnavailable, errSSHClosed)
+	}
+	if err == nil {
+		e.client = client
+
+		// Forget the connection as soon as it's closed
+		go func() {
+			err := client.Wait()
+			logrus.Warningf("SSH connection to '%s' closed: %v", e.addr, err)
+			e.reset(client)
+		}()
+	}
+	d.client, d.err = client, err
+	e.mutex.Unlock()
+	close(d.done)
+}
+
+// dial connects to the ssh server retrying with exponential backoff
+func (e *SSHExecutor) dial(ctx context.Context) (*ssh.Client, error) {
+	var err error
+	backoff := e.opts.DialBackoff
+	for attempt := 1; attempt <= e.opts.DialAttempts; attempt++ {
+		var client *ssh.Client
+		if client, err = e.dialOnce(ctx); err == nil {
+			logrus.Infof("SSH connection to '%s' ready", e.addr)
+			return client, nil
+		}
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("ssh connection to '%s' not made: %w", e.addr, ctx.Err())
+		}
+		logrus.Warningf("Could not connect with ssh to '%s' (attempt %d/%d): %v", e.addr, attempt, e.opts.DialAttempts, err)
+
+		if attempt < e.opts.DialAttempts {
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return nil, fmt.Errorf("ssh connection to '%s' not made: %w", e.addr, ctx.Err())
+			}
+			if backoff *= 2; backoff > maxSSHDialBackoff {
+				backoff = maxSSHDialBackoff
+			}
+		}
+	}
+	return nil, fmt.Errorf("%w: %v", ErrBackendUnavailable, err)
+}
+
+// dialOnce connects to the ssh server, the connection and the handshake are
+// bounded by the ssh config timeout (or the default one)
+func (e *SSHExecutor) dialOnce(ctx context.Context) (*ssh.Client, error) {
+	timeout := e.config.Timeout
+	if timeout <= 0 {
+		timeout = defaultSSHDialTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	d := net.Dialer{}
+	conn, err := d.DialContext(ctx, "tcp", e.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, e.addr, e.config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// reset forgets the connection if it's still the current one, so the next
+// command dials again
+func (e *SSHExecutor) reset(client *ssh.Client) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.client == client {
+		e.client = nil
+	}
+	client.Close()
+}
+
+// keepalive sends keepalive requests on the current connection, failed
+// requests mean a broken connection
+func (e *SSHExecutor) keepalive() {
+	ticker := time.NewTicker(e.opts.KeepaliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.done:
+			return
+		case <-ticker.C:
+		}
+
+		e.mutex.Lock()
+		client := e.client
+		e.mutex.Unlock()
+		if client == nil {
+			continue
+		}
+
+		// A hung connection doesn't answer, wait at most an interval
+		errc := make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			errc <- err
+		}()
+
+		select {
+		case err := <-errc:
+			if err != nil {
+				logrus.Warningf("SSH keepalive to '%s' failed: %v", e.addr, err)
+				e.reset(client)
+			}
+		case <-time.After(e.opts.KeepaliveInterval):
+			logrus.Warningf("SSH keepalive to '%s' not answered", e.addr)
+			e.reset(client)
+		case <-e.done:
+			return
+		}
+	}
+}
+
+// Close closes the ssh connection and stops the keepalives
+func (e *SSHExecutor) Close() error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	close(e.done)
+
+	if e.client == nil {
+		return nil
+	}
+	err := e.client.Close()
+	e.client = nil
+	return err
+}
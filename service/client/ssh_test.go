@@ -0,0 +1,436 @@
+package client
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/tsuru/riakapi/config"
+)
+
+// testSSHServer is an in-process ssh server that records the executed commands
+// and answers with the output returned by the handler
+type testSSHServer struct {
+	listener net.Listener
+	config   *ssh.ServerConfig
+	handler  func(cmd string) (stdout string, status uint32)
+
+	mutex       sync.Mutex
+	commands    []string
+	conns       []net.Conn
+	dials       int
+	keepalives  int
+	running     int
+	maxRunning  int
+	ignoreAlive bool
+}
+
+func newTestSSHServer(t *testing.T, handler func(cmd string) (string, uint32)) *testSSHServer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating host key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("Error generating host key: %v", err)
+	}
+	cfg := &ssh.ServerConfig{NoClientAuth: true}
+	cfg.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+
+	s := &testSSHServer{listener: l, config: cfg, handler: handler}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.mutex.Lock()
+			s.conns = append(s.conns, conn)
+			s.dials++
+			s.mutex.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *testSSHServer) serve(conn net.Conn) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		return
+	}
+	go func() {
+		for req := range reqs {
+			if req.Type == "keepalive@openssh.com" {
+				s.mutex.Lock()
+				s.keepalives++
+				ignore := s.ignoreAlive
+				s.mutex.Unlock()
+				if ignore {
+					continue
+				}
+			}
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}()
+
+	for newCh := range chans {
+		if newCh.ChannelType() != "session" {
+			newCh.Reject(ssh.UnknownChannelType, "only sessions")
+			continue
+		}
+		ch, chReqs, err := newCh.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			defer ch.Close()
+			for req := range chReqs {
+				if req.Type != "exec" {
+					req.Reply(false, nil)
+					continue
+				}
+				var payload struct{ Command string }
+				ssh.Unmarshal(req.Payload, &payload)
+				req.Reply(true, nil)
+
+				s.mutex.Lock()
+				s.commands = append(s.commands, payload.Command)
+				s.running++
+				if s.running > s.maxRunning {
+					s.maxRunning = s.running
+				}
+				s.mutex.Unlock()
+
+				out, status := s.handler(payload.Command)
+
+				s.mutex.Lock()
+				s.running--
+				s.mutex.Unlock()
+
+				io.WriteString(ch, out)
+				ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+				return
+			}
+		}()
+	}
+}
+
+func (s *testSSHServer) clientConfig() *ssh.ClientConfig {
+	return &ssh.ClientConfig{
+		User:            "test",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+}
+
+func (s *testSSHServer) executor(t *testing.T, opts SSHOptions) *SSHExecutor {
+	e, err := NewSSHExecutor(s.listener.Addr().String(), s.clientConfig(), opts)
+	if err != nil {
+		t.Fatalf("Error connecting to test ssh server: %v", err)
+	}
+	return e
+}
+
+func (s *testSSHServer) Commands() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string{}, s.commands...)
+}
+
+// DropConnections closes all the server side connections (like a node restart)
+func (s *testSSHServer) DropConnections() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+	s.conns = nil
+}
+
+func (s *testSSHServer) stats() (dials, keepalives, maxRunning int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.dials, s.keepalives, s.maxRunning
+}
+
+func (s *testSSHServer) Close() {
+	s.listener.Close()
+	s.DropConnections()
+}
+
+func TestSSHExecutorRun(t *testing.T) {
+	srv := newTestSSHServer(t, func(cmd string) (string, uint32) {
+		if cmd == "false" {
+			return "", 1
+		}
+		return "output of " + cmd, 0
+	})
+	defer srv.Close()
+	e := srv.executor(t, SSHOptions{})
+
+	out, err := e.Run(context.Background(), "riak-admin status")
+	if err != nil {
+		t.Errorf("Error running command: %v", err)
+	}
+	if string(out) != "output of riak-admin status" {
+		t.Errorf("Expected command output; got: %s", out)
+	}
+
+	// Failed commands are not unavailable errors
+	if _, err := e.Run(context.Background(), "false"); err == nil || errors.Is(err, ErrBackendUnavailable) {
+		t.Errorf("Expected command error; got: %v", err)
+	}
+
+	want := []string{"riak-admin status", "false"}
+	if got := srv.Commands(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected commands %#v;\ngot: %#v", want, got)
+	}
+
+	// Closed executor
+	e.Close()
+	if _, err := e.Run(context.Background(), "riak-admin status"); !errors.Is(err, ErrBackendUnavailable) {
+		t.Errorf("Expected unavailable error; got: %v", err)
+	}
+}
+
+func TestSSHExecutorReconnects(t *testing.T) {
+	srv := newTestSSHServer(t, func(cmd string) (string, uint32) { return "ok", 0 })
+	defer srv.Close()
+	e := srv.executor(t, SSHOptions{DialBackoff: time.Millisecond})
+	defer e.Close()
+
+	if _, err := e.Run(context.Background(), "riak-admin status"); err != nil {
+		t.Fatalf("Error running command: %v", err)
+	}
+
+	// Node restart, the next command dials again
+	srv.DropConnections()
+	if out, err := e.Run(context.Background(), "riak-admin status"); err != nil || string(out) != "ok" {
+		t.Errorf("Expected command run after reconnecting; got: %s, %v", out, err)
+	}
+
+	if dials, _, _ := srv.stats(); dials != 2 {
+		t.Errorf("Expected 2 connections; got: %d", dials)
+	}
+}
+
+func TestSSHExecutorDialFailure(t *testing.T) {
+	// Reserve a port and close it so nobody is listening
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	start := time.Now()
+	_, err = NewSSHExecutor(addr, &ssh.ClientConfig{HostKeyCallback: ssh.InsecureIgnoreHostKey()}, SSHOptions{
+		DialAttempts: 3,
+		DialBackoff:  10 * time.Millisecond,
+	})
+	if !errors.Is(err, ErrBackendUnavailable) {
+		t.Errorf("Expected unavailable error; got: %v", err)
+	}
+
+	// Backoff of 10ms and 20ms between the attempts
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("Expected dial backoff; took: %v", elapsed)
+	}
+}
+
+func TestSSHExecutorSharedDial(t *testing.T) {
+	// The server accepts the connections but never answers the handshake
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer l.Close()
+	var mutex sync.Mutex
+	conns := []net.Conn{}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mutex.Lock()
+			conns = append(conns, conn)
+			mutex.Unlock()
+		}
+	}()
+	e := NewLazySSHExecutor(l.Addr().String(), &ssh.ClientConfig{HostKeyCallback: ssh.InsecureIgnoreHostKey()}, SSHOptions{DialAttempts: 1})
+
+	// The commands waiting for the hung dial give up on their own timeout
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			if _, err := e.Run(ctx, "riak-admin status"); !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("Expected deadline error; got: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the commands abandoned on timeout; took: %v", elapsed)
+	}
+
+	mutex.Lock()
+	dials := len(conns)
+	mutex.Unlock()
+	if dials != 1 {
+		t.Errorf("Expected 1 dial in flight; got: %d", dials)
+	}
+
+	// Closing doesn't wait for the dial
+	closed := make(chan struct{})
+	go func() {
+		e.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Errorf("Expected executor closed while dialing")
+	}
+
+	mutex.Lock()
+	for _, c := range conns {
+		c.Close()
+	}
+	mutex.Unlock()
+}
+
+func TestSSHExecutorKeepalive(t *testing.T) {
+	srv := newTestSSHServer(t, func(cmd string) (string, uint32) { return "ok", 0 })
+	defer srv.Close()
+	e := srv.executor(t, SSHOptions{KeepaliveInterval: 10 * time.Millisecond, DialBackoff: time.Millisecond})
+	defer e.Close()
+
+	time.Sleep(100 * time.Millisecond)
+	if _, keepalives, _ := srv.stats(); keepalives == 0 {
+		t.Errorf("Expected keepalives sent")
+	}
+
+	// Not answered keepalives drop the connection, the next command dials again
+	srv.mutex.Lock()
+	srv.ignoreAlive = true
+	srv.mutex.Unlock()
+	time.Sleep(100 * time.Millisecond)
+
+	srv.mutex.Lock()
+	srv.ignoreAlive = false
+	srv.mutex.Unlock()
+	if _, err := e.Run(context.Background(), "riak-admin status"); err != nil {
+		t.Errorf("Error running command: %v", err)
+	}
+	if dials, _, _ := srv.stats(); dials < 2 {
+		t.Errorf("Expected the hung connection dialed again; got %d connections", dials)
+	}
+}
+
+func TestSSHExecutorMaxSessions(t *testing.T) {
+	release := make(chan struct{})
+	srv := newTestSSHServer(t, func(cmd string) (string, uint32) {
+		<-release
+		return "ok", 0
+	})
+	defer srv.Close()
+	e := srv.executor(t, SSHOptions{MaxSessions: 2})
+	defer e.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := e.Run(context.Background(), "riak-admin status"); err != nil {
+				t.Errorf("Error running command: %v", err)
+			}
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if _, _, maxRunning := srv.stats(); maxRunning != 2 {
+		t.Errorf("Expected 2 concurrent sessions at most; got: %d", maxRunning)
+	}
+	if got := len(srv.Commands()); got != 6 {
+		t.Errorf("Expected 6 commands run; got: %d", got)
+	}
+}
+
+func TestSSHExecutorCancel(t *testing.T) {
+	release := make(chan struct{})
+	srv := newTestSSHServer(t, func(cmd string) (string, uint32) {
+		<-release
+		return "ok", 0
+	})
+	defer srv.Close()
+	defer close(release)
+	e := srv.executor(t, SSHOptions{})
+	defer e.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := e.Run(ctx, "riak-admin status"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected deadline error; got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected hung command abandoned on timeout; took: %v", elapsed)
+	}
+}
+
+func TestNewAdminExecutorSingleNode(t *testing.T) {
+	srv := newTestSSHServer(t, func(cmd string) (string, uint32) {
+		return "output of " + cmd, 0
+	})
+	defer srv.Close()
+	addr := srv.listener.Addr().(*net.TCPAddr)
+
+	// The only cluster host has a ssh override, the default ssh address is not used
+	cfg := &config.ServiceConfig{
+		RiakAPI: &config.RiakAPI{RiakAPIAdminExecutor: AdminExecutorSSH},
+		SSH: &config.SSH{
+			SSHUser:            "test",
+			SSHHost:            "127.0.0.1",
+			SSHPort:            1,
+			SSHDialAttempts:    1,
+			SSHNodes:           []*config.SSHNode{{Host: "127.0.0.1", Port: addr.Port}},
+			SSHHostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		},
+	}
+	e, err := NewAdminExecutor(cfg)
+	if err != nil {
+		t.Fatalf("Error connecting to the only node: %v", err)
+	}
+	defer e.Close()
+
+	if out, err := e.Run(context.Background(), "riak-admin status"); err != nil || string(out) != "output of riak-admin status" {
+		t.Errorf("Expected command run on the node; got: %s, %v", out, err)
+	}
+}
@@ -0,0 +1,48 @@
+package client
+
+import (
+	"context"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// step is an operation of a multi-step change (instance creation, binding...),
+// undo reverts it when a later step fails. Steps without undo don't leave state
+// behind or are safe to run again when the change is retried
+type step struct {
+	name string
+	do   func(ctx context.Context) error
+	undo func(ctx context.Context) error
+}
+
+// runSteps runs the steps in order, when one fails the already done steps are
+// undone in reverse order so a retry starts from scratch. The failed step error
+// is returned
+func runSteps(ctx context.Context, steps ...step) error {
+	for i, s := range steps {
+		logrus.Debugf("Running %s", s.name)
+		if err := s.do(ctx); err != nil {
+			rollbackSteps(steps[:i])
+			return err
+		}
+	}
+	return nil
+}
+
+// rollbackSteps undoes the done steps in reverse order. The request context
+// could be the cause of the failure, so the undo actions run on a new context
+// (each riak and riak-admin operation has its own timeout)
+func rollbackSteps(steps []step) {
+	ctx := context.Background()
+	for i := len(steps) - 1; i >= 0; i-- {
+		s := steps[i]
+		if s.undo == nil {
+			continue
+		}
+		if err := s.undo(ctx); err != nil {
+			logrus.Errorf("Could not undo %s, manual cleanup needed: %v", s.name, err)
+			continue
+		}
+		logrus.Infof("Undone %s", s.name)
+	}
+}
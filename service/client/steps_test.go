@@ -0,0 +1,95 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestRunSteps(t *testing.T) {
+	tests := []struct {
+		givenFailStep string
+		givenFailUndo string
+		givenCancel   bool
+
+		wantCalls []string
+		wantErr   bool
+	}{
+		{ // All steps done, nothing undone
+			wantCalls: []string{"do a", "do b", "do c"},
+		},
+		{ // Done steps undone on reverse order, the failed one is not undone
+			givenFailStep: "c",
+			wantCalls:     []string{"do a", "do b", "do c", "undo b", "undo a"},
+			wantErr:       true,
+		},
+		{ // First step failed, nothing to undo
+			givenFailStep: "a",
+			wantCalls:     []string{"do a"},
+			wantErr:       true,
+		},
+		{ // Failed undo doesn't stop the rollback
+			givenFailStep: "c",
+			givenFailUndo: "b",
+			wantCalls:     []string{"do a", "do b", "do c", "undo b", "undo a"},
+			wantErr:       true,
+		},
+		{ // Cancelled requests are rolled back too
+			givenFailStep: "c",
+			givenCancel:   true,
+			wantCalls:     []string{"do a", "do b", "do c", "undo b", "undo a"},
+			wantErr:       true,
+		},
+	}
+
+	for _, test := range tests {
+		ctx, cancel := context.WithCancel(context.Background())
+		calls := []string{}
+		newStep := func(name string) step {
+			return step{
+				name: name,
+				do: func(ctx context.Context) error {
+					calls = append(calls, "do "+name)
+					if name == test.givenFailStep {
+						if test.givenCancel {
+							cancel()
+						}
+						return errors.New("step failed")
+					}
+					return nil
+				},
+				undo: func(ctx context.Context) error {
+					if ctx.Err() != nil {
+						t.Errorf("Expected undo with a live context; got: %v", ctx.Err())
+					}
+					calls = append(calls, "undo "+name)
+					if name == test.givenFailUndo {
+						return errors.New("undo failed")
+					}
+					return nil
+				},
+			}
+		}
+
+		err := runSteps(ctx, newStep("a"), newStep("b"), newStep("c"))
+		cancel()
+
+		if test.wantErr != (err != nil) {
+			t.Errorf("Expected error %t; got: %v", test.wantErr, err)
+		}
+		if !reflect.DeepEqual(test.wantCalls, calls) {
+			t.Errorf("Expected calls %#v;\ngot: %#v", test.wantCalls, calls)
+		}
+	}
+
+	// Steps without undo are skipped on rollback
+	calls := []string{}
+	err := runSteps(context.Background(),
+		step{name: "a", do: func(ctx context.Context) error { calls = append(calls, "do a"); return nil }},
+		step{name: "b", do: func(ctx context.Context) error { return errors.New("step failed") }},
+	)
+	if err == nil || !reflect.DeepEqual(calls, []string{"do a"}) {
+		t.Errorf("Expected only the first step run; got: %#v, %v", calls, err)
+	}
+}
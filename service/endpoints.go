@@ -2,12 +2,16 @@ package service
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/gorilla/mux"
 
+	"github.com/tsuru/riakapi/service/client"
 	"github.com/tsuru/riakapi/utils"
 )
 
@@ -22,38 +26,103 @@ const (
 	UserGrantingFailMsg = "Error granting user"
 	// UserRevokingFailMsg message when revoking access to users fails
 	UserRevokingFailMsg = "Error revoking user"
+	// UserDeletionFailMsg message when deleting users fails
+	UserDeletionFailMsg = "Error deleting user"
+	// BucketRemovalFailMsg message when bucket removal fails
+	BucketRemovalFailMsg = "Error removing bucket"
+	// InstanceInfoFailMsg message when retrieving the instance information fails
+	InstanceInfoFailMsg = "Error retrieving instance information"
+	// InvalidRequestMsg message when the request parameters can't be decoded
+	InvalidRequestMsg = "Invalid request"
+	// PlansFailMsg message when retrieving the plans fails
+	PlansFailMsg = "Error retrieving plans"
+	// ListInstancesFailMsg message when listing the instances fails
+	ListInstancesFailMsg = "Error listing instances"
+	// UnitBindingFailMsg message when allowing the unit address fails
+	UnitBindingFailMsg = "Error binding unit"
+	// UnitUnbindingFailMsg message when disallowing the unit address fails
+	UnitUnbindingFailMsg = "Error unbinding unit"
+	// CRLFailMsg message when the certificate revocation list can't be created
+	CRLFailMsg = "Error retrieving certificate revocation list"
+	// CredentialsRotationFailMsg message when rotating the user password fails
+	CredentialsRotationFailMsg = "Error rotating credentials"
+	// RotationConfirmationFailMsg message when confirming the rotation fails
+	RotationConfirmationFailMsg = "Error confirming credentials rotation"
 )
 
+// bindModeParam is the bind parameter that selects the binding mode
+// (`tsuru service-instance-bind -p mode=read-only`)
+const bindModeParam = "mode"
+
 // GetPlans returns a json with the available plans on tsuru. Translated to riak,
 // this are the bucket types
 func (s *RiakService) GetPlans(r *http.Request) (int, interface{}, error) {
 	logrus.Debug("Executing 'GetPlans' endpoint")
 
-	plans, err := s.Client.GetBucketTypes()
+	ctx := r.Context()
+
+	plans, err := s.Client.GetBucketTypes(ctx)
 	if err != nil {
-		return http.StatusInternalServerError, map[string]error{"error": err}, err
+		logrus.Errorf("Could not get the plans: %s", err)
+		return errorResponse(PlansFailMsg, err)
 	}
 
 	return http.StatusOK, &plans, nil
 }
 
+// ListInstances returns the instances records, filtered by the 'team' and
+// 'plan' query parameters. This is not part of the tsuru service API
+func (s *RiakService) ListInstances(r *http.Request) (int, interface{}, error) {
+	logrus.Debug("Executing 'ListInstances' endpoint")
+
+	ctx := r.Context()
+
+	q := r.URL.Query()
+	buckets, err := s.Client.ListBuckets(ctx, q.Get("team"), q.Get("plan"))
+	if err != nil {
+		logrus.Errorf("Could not list the instances: %s", err)
+		return errorResponse(ListInstancesFailMsg, err)
+	}
+
+	return http.StatusOK, buckets, nil
+}
+
 // CreateInstance Creates a new instance on Tsuru, this translates to a new
 // bucket of the desired bucket type on Riak
 func (s *RiakService) CreateInstance(r *http.Request) (int, interface{}, error) {
 	logrus.Debug("Executing 'CreateInstance' endpoint")
 
-	bucketName := r.URL.Query().Get("name")
-	bucketType := r.URL.Query().Get("plan")
+	ctx := r.Context()
+
+	req, err := decodeRequest(r)
+	if err != nil {
+		logrus.Errorf("Could not create the instance: %s", err)
+		return badRequestResponse(InvalidRequestMsg)
+	}
+
+	bucketName := req.Name
+	bucketType := req.Plan
 	if bucketName == "" || bucketType == "" {
 		logrus.Errorf("Could not create the instance: %s", MissingParamsMsg)
-		return http.StatusInternalServerError, MissingParamsMsg, nil
+		return badRequestResponse(MissingParamsMsg)
+	}
+	if err := client.ValidateName(bucketName); err != nil {
+		logrus.Errorf("Could not create the instance: %s", err)
+		return errorResponse(BucketCreationFailMsg, err)
 	}
 
-	err := s.Client.CreateBucket(bucketName, bucketType)
+	err = s.Client.CreateBucket(ctx, &client.BucketInfo{
+		Name:       bucketName,
+		BucketType: bucketType,
+		Team:       req.Team,
+		Creator:    req.User,
+		Parameters: req.Parameters,
+		Tags:       req.Tags,
+	})
 
 	if err != nil {
 		logrus.Errorf("Could not create the instance: %s", err)
-		return http.StatusInternalServerError, BucketCreationFailMsg, nil
+		return errorResponse(BucketCreationFailMsg, err)
 	}
 
 	logrus.Infof("Instace '%s' created", bucketName)
@@ -65,33 +134,55 @@ func (s *RiakService) CreateInstance(r *http.Request) (int, interface{}, error)
 func (s *RiakService) BindInstance(r *http.Request) (int, interface{}, error) {
 	logrus.Debug("Executing 'BindInstance' endpoint")
 
+	ctx := r.Context()
+
+	req, err := decodeRequest(r)
+	if err != nil {
+		logrus.Errorf("Could not bind the instance: %s", err)
+		return badRequestResponse(InvalidRequestMsg)
+	}
+
 	bucketName, _ := mux.Vars(r)["name"]
-	userWord := r.URL.Query().Get("app-host")
+	userWord := req.AppHost
 	if userWord == "" {
 		logrus.Errorf("Could not bind the instance: %s", MissingParamsMsg)
-		return http.StatusInternalServerError, MissingParamsMsg, nil
+		return badRequestResponse(MissingParamsMsg)
+	}
+	username := utils.GenerateUsername(userWord)
+	if err := validateNames(bucketName, username); err != nil {
+		logrus.Errorf("Could not bind the instance: %s", err)
+		return errorResponse(UserGrantingFailMsg, err)
+	}
+
+	// The binding mode is a tsuru bind parameter, read-write by default
+	mode, err := client.ParseBindMode(req.Parameters[bindModeParam])
+	if err != nil {
+		logrus.Errorf("Could not Bind the instance: %s", err)
+		return errorResponse(UserGrantingFailMsg, err)
 	}
 
-	// Create the user and pass (if not present already from previous instances)
-	user, pass, err := s.Client.EnsureUserPresent(userWord)
+	// Create the user and pass (if not present already from previous instances),
+	// the returned user is the riak login of the app
+	user, pass, err := s.Client.EnsureUserPresent(ctx, userWord)
 
 	if err != nil {
 		logrus.Errorf("Could not Bind the instance: %s", err)
-		return http.StatusInternalServerError, UserGrantingFailMsg, nil
+		return errorResponse(UserGrantingFailMsg, err)
 
 	}
 
-	// Grant access on bucket
-	err = s.Client.GrantUserAccess(user, bucketName)
+	// Grant access on bucket, with the client certificate of the binding (if
+	// enabled)
+	cert, certKey, err := s.Client.GrantUserAccess(ctx, username, bucketName, mode)
 	if err != nil {
 		logrus.Errorf("Could not Bind the instance: %s", err)
-		return http.StatusInternalServerError, UserGrantingFailMsg, nil
+		return errorResponse(UserGrantingFailMsg, err)
 	}
 
 	rHosts, err := json.Marshal(s.Cfg.RiakClusterHosts)
 	if err != nil {
 		logrus.Errorf("Could not Bind the instance: %s", err)
-		return http.StatusInternalServerError, UserGrantingFailMsg, nil
+		return errorResponse(UserGrantingFailMsg, err)
 	}
 
 	// The required env vars
@@ -101,8 +192,9 @@ func (s *RiakService) BindInstance(r *http.Request) (int, interface{}, error) {
 		"RIAK_PB_PORT":     strconv.Itoa(s.Cfg.RiakPBPort),
 		"RIAK_USER":        user,
 		"RIAK_PASSWORD":    pass,
-		"RIAK_BUCKET_TYPE": s.Client.GetBucketType(bucketName),
+		"RIAK_BUCKET_TYPE": s.Client.GetBucketType(ctx, bucketName),
 		"RIAK_BUCKET":      bucketName,
+		"RIAK_BIND_MODE":   string(mode),
 	}
 
 	// If there is a certificate then set
@@ -110,6 +202,12 @@ func (s *RiakService) BindInstance(r *http.Request) (int, interface{}, error) {
 		envVars["RIAK_ROOT_CA_CERT"] = s.Cfg.RiakRootCaCert
 	}
 
+	// The apps authenticate with the client certificate instead of the password
+	if cert != "" {
+		envVars["RIAK_CLIENT_CERT"] = cert
+		envVars["RIAK_CLIENT_KEY"] = certKey
+	}
+
 	logrus.Infof("Instace '%s' binded to '%s'", bucketName, userWord)
 	return http.StatusCreated, envVars, nil
 }
@@ -119,59 +217,320 @@ func (s *RiakService) BindInstance(r *http.Request) (int, interface{}, error) {
 func (s *RiakService) UnbindInstance(r *http.Request) (int, interface{}, error) {
 	logrus.Debug("Executing 'UnbindInstance' endpoint")
 
+	ctx := r.Context()
+
+	req, err := decodeRequest(r)
+	if err != nil {
+		logrus.Errorf("Could not unbind the instance: %s", err)
+		return badRequestResponse(InvalidRequestMsg)
+	}
+
 	bucketName, _ := mux.Vars(r)["name"]
-	userWord := r.URL.Query().Get("app-host")
+	userWord := req.AppHost
 	if userWord == "" {
 		logrus.Errorf("Could not unbind the instance: %s", MissingParamsMsg)
-		return http.StatusInternalServerError, MissingParamsMsg, nil
+		return badRequestResponse(MissingParamsMsg)
 	}
-	// Revoke access to the user
 	username := utils.GenerateUsername(userWord)
-	err := s.Client.RevokeUserAccess(username, bucketName)
+	if err := validateNames(bucketName, username); err != nil {
+		logrus.Errorf("Could not unbind the instance: %s", err)
+		return errorResponse(UserRevokingFailMsg, err)
+	}
 
-	// TODO: Delete user
-	// NOTE: Keep track of users instances and delete on last one
+	// Revoke access to the user
+	err = s.Client.RevokeUserAccess(ctx, username, bucketName)
+	if err != nil {
+		logrus.Errorf("Could not unbind the instance: %s", err)
+		return errorResponse(UserRevokingFailMsg, err)
+	}
 
+	// The user is shared between all the instances the app is bound to, delete
+	// it only on the last unbind
+	buckets, err := s.Client.GetUserBuckets(ctx, username)
 	if err != nil {
 		logrus.Errorf("Could not unbind the instance: %s", err)
-		return http.StatusInternalServerError, UserRevokingFailMsg, nil
+		return errorResponse(UserDeletionFailMsg, err)
+	}
+
+	if len(buckets) == 0 {
+		// Users of apps bound before the bindings were registered can still be
+		// granted on other instances, they are kept
+		err := s.Client.DeleteUser(ctx, username)
+		if errors.Is(err, client.ErrUserGranted) {
+			logrus.Infof("User '%s' kept: %s", username, err)
+		} else if err != nil {
+			logrus.Errorf("Could not unbind the instance: %s", err)
+			return errorResponse(UserDeletionFailMsg, err)
+		}
 	}
 
 	logrus.Infof("Instace '%s' unbinded from '%s'", bucketName, userWord)
 	return http.StatusOK, "", nil
 }
 
-// BindInstanceEvent Processes the event from tsuru when an app is binded to a service instance
+// BindInstanceEvent Processes the event from tsuru when an app unit is binded
+// to a service instance, the app user can connect from the unit address
 func (s *RiakService) BindInstanceEvent(r *http.Request) (int, interface{}, error) {
-	logrus.Debug("Executing 'BindInstanceEvent' endpoint (no need to implement)")
+	logrus.Debug("Executing 'BindInstanceEvent' endpoint")
+
+	ctx := r.Context()
+
+	req, err := decodeRequest(r)
+	if err != nil {
+		logrus.Errorf("Could not process the bind event: %s", err)
+		return badRequestResponse(InvalidRequestMsg)
+	}
+
+	bucketName, _ := mux.Vars(r)["name"]
+	if req.AppHost == "" || req.UnitHost == "" {
+		logrus.Errorf("Could not process the bind event: %s", MissingParamsMsg)
+		return badRequestResponse(MissingParamsMsg)
+	}
+	username := utils.GenerateUsername(req.AppHost)
+	if err := validateNames(bucketName, username); err != nil {
+		logrus.Errorf("Could not process the bind event: %s", err)
+		return errorResponse(UnitBindingFailMsg, err)
+	}
+
+	if err := s.Client.BindUnit(ctx, username, bucketName, req.UnitHost); err != nil {
+		logrus.Errorf("Could not process the bind event: %s", err)
+		return errorResponse(UnitBindingFailMsg, err)
+	}
+
+	logrus.Infof("Unit '%s' of app '%s' binded to '%s'", req.UnitHost, req.AppName, bucketName)
 	return http.StatusCreated, "", nil
 }
 
-// UnbindInstanceEvent Processes the event from tsuru when an app is unbinded from a service instance
+// UnbindInstanceEvent Processes the event from tsuru when an app unit is
+// unbinded from a service instance, the unit address is not allowed anymore
 func (s *RiakService) UnbindInstanceEvent(r *http.Request) (int, interface{}, error) {
-	logrus.Debug("Executing 'UnbindInstanceEvent' endpoint (no need to implement)")
+	logrus.Debug("Executing 'UnbindInstanceEvent' endpoint")
+
+	ctx := r.Context()
+
+	req, err := decodeRequest(r)
+	if err != nil {
+		logrus.Errorf("Could not process the unbind event: %s", err)
+		return badRequestResponse(InvalidRequestMsg)
+	}
+
+	bucketName, _ := mux.Vars(r)["name"]
+	if req.AppHost == "" || req.UnitHost == "" {
+		logrus.Errorf("Could not process the unbind event: %s", MissingParamsMsg)
+		return badRequestResponse(MissingParamsMsg)
+	}
+	username := utils.GenerateUsername(req.AppHost)
+	if err := validateNames(bucketName, username); err != nil {
+		logrus.Errorf("Could not process the unbind event: %s", err)
+		return errorResponse(UnitUnbindingFailMsg, err)
+	}
+
+	if err := s.Client.UnbindUnit(ctx, username, bucketName, req.UnitHost); err != nil {
+		logrus.Errorf("Could not process the unbind event: %s", err)
+		return errorResponse(UnitUnbindingFailMsg, err)
+	}
+
+	logrus.Infof("Unit '%s' of app '%s' unbinded from '%s'", req.UnitHost, req.AppName, bucketName)
 	return http.StatusOK, "", nil
 }
 
-// RemoveInstance Remove instance Removes the instance from tsuru. Translated to riak,  delete
-// all the keys from the bucket (causing bucket deletion) -> not a good choice, not deleting bucket
-// Bucket will persist 'forever'
+// RemoveInstance Remove instance Removes the instance from tsuru. Translated to riak,
+// revoke all the access to the bucket and delete all the keys from the bucket
+// (causing bucket deletion), the keys are deleted on background
 func (s *RiakService) RemoveInstance(r *http.Request) (int, interface{}, error) {
 	logrus.Debug("Executing 'RemoveInstance' endpoint")
+
+	ctx := r.Context()
+
+	bucketName, _ := mux.Vars(r)["name"]
+	if err := client.ValidateName(bucketName); err != nil {
+		logrus.Errorf("Could not remove the instance: %s", err)
+		return errorResponse(BucketRemovalFailMsg, err)
+	}
+
+	info, err := s.Client.GetBucketInfo(ctx, bucketName)
+	if err != nil {
+		logrus.Errorf("Could not remove the instance: %s", err)
+		return errorResponse(BucketRemovalFailMsg, err)
+	}
+
+	if err := s.Client.DeleteBucket(ctx, bucketName, info.BucketType); err != nil {
+		logrus.Errorf("Could not remove the instance: %s", err)
+		return errorResponse(BucketRemovalFailMsg, err)
+	}
+
+	logrus.Infof("Instace '%s' removed", bucketName)
 	return http.StatusOK, "", nil
 }
 
+// GetInstanceInfo returns the information of an instance on tsuru as a list
+// of label/value pairs (shown by `tsuru service-instance-info`)
+func (s *RiakService) GetInstanceInfo(r *http.Request) (int, interface{}, error) {
+	logrus.Debug("Executing 'GetInstanceInfo' endpoint")
+
+	ctx := r.Context()
+
+	bucketName, _ := mux.Vars(r)["name"]
+
+	// '/resources/plans' shares the route with the instance info and the router
+	// doesn't guarantee which one matches first
+	if bucketName == "plans" {
+		return s.GetPlans(r)
+	}
+	if err := client.ValidateName(bucketName); err != nil {
+		logrus.Errorf("Could not get the instance info: %s", err)
+		return errorResponse(InstanceInfoFailMsg, err)
+	}
+
+	info, err := s.Client.GetBucketInfo(ctx, bucketName)
+	if err != nil {
+		logrus.Errorf("Could not get the instance info: %s", err)
+		return errorResponse(InstanceInfoFailMsg, err)
+	}
+
+	users, err := s.Client.GetBucketUsers(ctx, bucketName)
+	if err != nil {
+		logrus.Errorf("Could not get the instance info: %s", err)
+		return errorResponse(InstanceInfoFailMsg, err)
+	}
+	apps := make([]string, len(users))
+	for i, u := range users {
+		apps[i] = utils.UsernameWord(u)
+	}
+
+	// Counting keys is expensive, don't fail if we can't
+	keys := "unknown"
+	if count, err := s.Client.CountBucketKeys(ctx, bucketName); err != nil {
+		logrus.Warningf("Could not count instance '%s' keys: %s", bucketName, err)
+	} else {
+		keys = strconv.Itoa(count)
+	}
+
+	var createdAt string
+	if !info.CreatedAt.IsZero() {
+		createdAt = info.CreatedAt.Format(time.RFC3339)
+	}
+
+	dataType := info.DataType
+	if dataType == "" {
+		dataType = "key/value"
+	}
+
+	hosts := make([]string, len(s.Cfg.RiakClusterHosts))
+	for i, h := range s.Cfg.RiakClusterHosts {
+		hosts[i] = h.Host
+	}
+
+	result := []map[string]string{
+		{"label": "Bucket type", "value": info.BucketType},
+		{"label": "Data type", "value": dataType},
+		{"label": "Created at", "value": createdAt},
+		{"label": "Team", "value": info.Team},
+		{"label": "Creator", "value": info.Creator},
+		{"label": "Tags", "value": strings.Join(info.Tags, ", ")},
+		{"label": "Parameters", "value": client.FormatParams(info.Parameters)},
+		{"label": "Bound apps", "value": strings.Join(apps, ", ")},
+		{"label": "Keys (approx.)", "value": keys},
+		{"label": "Cluster hosts", "value": strings.Join(hosts, ", ")},
+	}
+
+	logrus.Infof("Instace '%s' info retrieved", bucketName)
+	return http.StatusOK, result, nil
+}
+
 // CheckInstanceStatus Checks the status of an instance on tsuru. Translated to riak,
 // Checks the status of the bucket
 func (s *RiakService) CheckInstanceStatus(r *http.Request) (int, interface{}, error) {
 	logrus.Debug("Executing 'CheckInstanceStatus' endpoint")
 
+	ctx := r.Context()
+
 	bucketName, _ := mux.Vars(r)["name"]
-	ok, err := s.Client.IsAlive(bucketName)
+	if err := client.ValidateName(bucketName); err != nil {
+		logrus.Errorf("Bucket error: %v", err)
+		return errorResponse(ErrorBucketStatusMsg, err)
+	}
+
+	ok, err := s.Client.IsAlive(ctx, bucketName)
 	logrus.Infof("Instace '%s' status ok: %t", bucketName, ok)
 	if ok {
 		return http.StatusNoContent, nil, nil
 	}
 	logrus.Errorf("Bucket error: %v", err)
-	return http.StatusInternalServerError, ErrorBucketStatusMsg, nil
+	return errorResponse(ErrorBucketStatusMsg, err)
+}
+
+// RotateCredentials changes the password of an app user, the response has the
+// instances that have to be bound again to get the new password. With 'grace'
+// the previous password is valid until the rotation is confirmed. This is not
+// part of the tsuru service API
+func (s *RiakService) RotateCredentials(r *http.Request) (int, interface{}, error) {
+	logrus.Debug("Executing 'RotateCredentials' endpoint")
+
+	ctx := r.Context()
+
+	username := utils.GenerateUsername(mux.Vars(r)["app_host"])
+	if err := client.ValidateName(username); err != nil {
+		logrus.Errorf("Could not rotate the credentials: %s", err)
+		return errorResponse(CredentialsRotationFailMsg, err)
+	}
+
+	req, err := decodeRequest(r)
+	if err != nil {
+		logrus.Errorf("Could not rotate the credentials: %s", err)
+		return badRequestResponse(InvalidRequestMsg)
+	}
+	grace := req.Grace != nil && *req.Grace
+
+	res, err := s.Client.RotateUserPassword(ctx, username, grace)
+	if err != nil {
+		logrus.Errorf("Could not rotate the credentials: %s", err)
+		return errorResponse(CredentialsRotationFailMsg, err)
+	}
+
+	logrus.Infof("User '%s' credentials rotated", username)
+	return http.StatusOK, res, nil
+}
+
+// ConfirmCredentialsRotation invalidates the previous password of an app user
+// rotated with grace. This is not part of the tsuru service API
+func (s *RiakService) ConfirmCredentialsRotation(r *http.Request) (int, interface{}, error) {
+	logrus.Debug("Executing 'ConfirmCredentialsRotation' endpoint")
+
+	ctx := r.Context()
+
+	username := utils.GenerateUsername(mux.Vars(r)["app_host"])
+	if err := client.ValidateName(username); err != nil {
+		logrus.Errorf("Could not confirm the credentials rotation: %s", err)
+		return errorResponse(RotationConfirmationFailMsg, err)
+	}
+
+	if err := s.Client.ConfirmUserRotation(ctx, username); err != nil {
+		logrus.Errorf("Could not confirm the credentials rotation: %s", err)
+		return errorResponse(RotationConfirmationFailMsg, err)
+	}
+
+	logrus.Infof("User '%s' credentials rotation confirmed", username)
+	return http.StatusOK, "", nil
+}
+
+// GetCRL returns the revocation list (DER) of the app client certificates,
+// riak fetches it from the certificates distribution point. This is not part
+// of the tsuru service API
+func (s *RiakService) GetCRL(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug("Executing 'GetCRL' endpoint")
+
+	crl, err := s.Client.CertificateRevocationList(r.Context())
+	if errors.Is(err, client.ErrCertificatesDisabled) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		logrus.Errorf("Could not get the revocation list: %s", err)
+		http.Error(w, CRLFailMsg, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pkix-crl")
+	w.Write(crl)
 }
@@ -0,0 +1,56 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/tsuru/riakapi/service/client"
+)
+
+// ErrorResponse is the body of all the failed requests, tsuru shows it to the user
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// errorStatuses maps the client errors to the response status code
+var errorStatuses = []struct {
+	err  error
+	code int
+	// detailed errors return the whole error message, not only the kind
+	detailed bool
+}{
+	{client.ErrInvalidPlan, http.StatusBadRequest, false},
+	{client.ErrInvalidParameter, http.StatusBadRequest, true},
+	{client.ErrInvalidName, http.StatusBadRequest, true},
+	{client.ErrInstanceExists, http.StatusConflict, false},
+	{client.ErrInstancePurging, http.StatusConflict, false},
+	{client.ErrInstanceNotFound, http.StatusNotFound, false},
+	{client.ErrUserNotFound, http.StatusNotFound, false},
+	{client.ErrRotationPending, http.StatusConflict, true},
+	{client.ErrRotationNotPending, http.StatusConflict, false},
+	{client.ErrBackendUnavailable, http.StatusServiceUnavailable, false},
+	{client.ErrCommandInterrupted, http.StatusServiceUnavailable, false},
+	{context.DeadlineExceeded, http.StatusGatewayTimeout, false},
+}
+
+// errorResponse returns the response of a failed request, the status code
+// depends on the kind of client error and the message is completed with it.
+// Unknown errors are internal errors and their details are not returned
+func errorResponse(msg string, err error) (int, interface{}, error) {
+	for _, e := range errorStatuses {
+		if errors.Is(err, e.err) {
+			if e.detailed {
+				return e.code, &ErrorResponse{Error: fmt.Sprintf("%s: %s", msg, err)}, nil
+			}
+			return e.code, &ErrorResponse{Error: fmt.Sprintf("%s: %s", msg, e.err)}, nil
+		}
+	}
+	return http.StatusInternalServerError, &ErrorResponse{Error: msg}, nil
+}
+
+// badRequestResponse returns the response of a request with wrong parameters
+func badRequestResponse(msg string) (int, interface{}, error) {
+	return http.StatusBadRequest, &ErrorResponse{Error: msg}, nil
+}
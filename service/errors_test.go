@@ -0,0 +1,86 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/tsuru/riakapi/service/client"
+)
+
+func TestErrorResponse(t *testing.T) {
+	tests := []struct {
+		givenMsg string
+		givenErr error
+
+		wantCode int
+		wantBody *ErrorResponse
+	}{
+		{
+			givenMsg: "Error",
+			givenErr: client.ErrInvalidPlan,
+			wantCode: http.StatusBadRequest,
+			wantBody: &ErrorResponse{Error: "Error: invalid plan"},
+		},
+		{
+			givenMsg: "Error",
+			givenErr: client.ErrInstanceExists,
+			wantCode: http.StatusConflict,
+			wantBody: &ErrorResponse{Error: "Error: instance already exists"},
+		},
+		{
+			givenMsg: "Error",
+			givenErr: client.ErrInstancePurging,
+			wantCode: http.StatusConflict,
+			wantBody: &ErrorResponse{Error: "Error: instance with the same name still being removed"},
+		},
+		{
+			givenMsg: "Error",
+			givenErr: client.ErrInstanceNotFound,
+			wantCode: http.StatusNotFound,
+			wantBody: &ErrorResponse{Error: "Error: instance not found"},
+		},
+		{
+			givenMsg: "Error",
+			givenErr: client.ErrUserNotFound,
+			wantCode: http.StatusNotFound,
+			wantBody: &ErrorResponse{Error: "Error: user not found"},
+		},
+		{ // Wrapped errors
+			givenMsg: "Error",
+			givenErr: fmt.Errorf("Could not store: %w", client.ErrBackendUnavailable),
+			wantCode: http.StatusServiceUnavailable,
+			wantBody: &ErrorResponse{Error: "Error: riak unavailable"},
+		},
+		{ // Request timeouts
+			givenMsg: "Error",
+			givenErr: fmt.Errorf("riak-admin command not finished: %w", context.DeadlineExceeded),
+			wantCode: http.StatusGatewayTimeout,
+			wantBody: &ErrorResponse{Error: "Error: context deadline exceeded"},
+		},
+		{ // Internal errors don't show the details
+			givenMsg: "Error",
+			givenErr: errors.New("Process exited with status 1"),
+			wantCode: http.StatusInternalServerError,
+			wantBody: &ErrorResponse{Error: "Error"},
+		},
+	}
+
+	for _, test := range tests {
+		code, body, err := errorResponse(test.givenMsg, test.givenErr)
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+
+		if code != test.wantCode {
+			t.Errorf("Expected code %d; got: %d", test.wantCode, code)
+		}
+
+		if !reflect.DeepEqual(body, test.wantBody) {
+			t.Errorf("Expected body %#v; got: %#v", test.wantBody, body)
+		}
+	}
+}
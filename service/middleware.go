@@ -1,26 +1,79 @@
 package service
 
 import (
+	"context"
+	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
+	"github.com/NYTimes/gizmo/server"
 	"github.com/Sirupsen/logrus"
+
+	"github.com/tsuru/riakapi/config"
 )
 
-// BasicAuthHandler checks if the request is authorized
-func BasicAuthHandler(h http.Handler, username, password string) http.Handler {
+// authRealm is the realm of the basic auth challenge
+const authRealm = "riakapi"
+
+// requestScope returns the credential scope the request needs, blank for the
+// public endpoints (riak fetches the revocation list without credentials)
+func requestScope(r *http.Request) string {
+	switch {
+	case r.URL.Path == "/crl" && r.Method == "GET":
+		return ""
+	case strings.HasPrefix(r.URL.Path, "/users/"):
+		return config.ScopeAdmin
+	case r.URL.Path == "/resources" && r.Method == "GET":
+		return config.ScopeAdmin
+	}
+	return config.ScopeTsuru
+}
+
+// BasicAuthHandler checks the request credentials can access the requested
+// API, the requests without valid credentials are challenged. No credentials
+// disable the authentication
+func BasicAuthHandler(h http.Handler, creds config.Credentials) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if password != "" { // check authentication disabled
-			// Check access
-			if reqUser, reqPass, ok := r.BasicAuth(); ok {
-				// Wrong password and/or user
-				if reqUser != username || reqPass != password {
-					logrus.Error("Not authorized access")
-					http.Error(w, "Login Required", http.StatusUnauthorized)
-					return
-				}
-			}
+		scope := requestScope(r)
+		if len(creds) == 0 || scope == "" { // check authentication disabled
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		reqUser, reqPass, ok := r.BasicAuth()
+		if !ok {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", authRealm))
+			http.Error(w, "Login Required", http.StatusUnauthorized)
+			return
 		}
+		cred := creds.Authenticate(reqUser, reqPass)
+		if cred == nil {
+			logrus.Errorf("Not authorized access of '%s'", reqUser)
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", authRealm))
+			http.Error(w, "Login Required", http.StatusUnauthorized)
+			return
+		}
+		if !cred.HasScope(scope) {
+			logrus.Errorf("Forbidden access of '%s' to %s %s ('%s' scope)", cred.Name, r.Method, r.URL.Path, scope)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
 		// all good
 		h.ServeHTTP(w, r)
 	})
 }
+
+// TimeoutEndpoint sets the timeout on the request context, the riak operations
+// of the request are cancelled when it expires. Zero timeout doesn't set it
+func TimeoutEndpoint(j server.JSONEndpoint, timeout time.Duration) server.JSONEndpoint {
+	if timeout <= 0 {
+		return j
+	}
+	return func(r *http.Request) (int, interface{}, error) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		return j(r.WithContext(ctx))
+	}
+}
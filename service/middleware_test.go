@@ -1,55 +1,155 @@
 package service
 
 import (
+	"context"
 	"encoding/base64"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/tsuru/riakapi/config"
 )
 
 func TestAuthorizationMiddleware(t *testing.T) {
-	authHeader := "Basic " + base64.StdEncoding.EncodeToString([]byte("testuser:testpass"))
+	basic := func(user, pass string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+	}
+	hash, _ := bcrypt.GenerateFromPassword([]byte("testpass"), bcrypt.MinCost)
+	creds := config.Credentials{
+		{Name: "testuser", Hash: string(hash), Scopes: []string{config.ScopeTsuru}},
+		{Name: "testadmin", Hash: string(hash), Scopes: []string{config.ScopeAdmin}},
+	}
 
 	tests := []struct {
-		givenUsername   string
-		givenPassword   string
-		givenAuthHeader string
+		givenCredentials config.Credentials
+		givenMethod      string
+		givenURI         string
+		givenAuthHeader  string
 
-		wantCode int
+		wantCode      int
+		wantChallenge bool
 	}{
 		{
-			givenUsername:   "testuser",
-			givenPassword:   "testpass",
-			givenAuthHeader: authHeader,
-			wantCode:        http.StatusOK,
+			givenCredentials: creds,
+			givenMethod:      "POST",
+			givenURI:         "/resources",
+			givenAuthHeader:  basic("testuser", "testpass"),
+			wantCode:         http.StatusOK,
 		},
 		{
-			givenUsername:   "wronguser",
-			givenPassword:   "testpass",
-			givenAuthHeader: authHeader,
-			wantCode:        http.StatusUnauthorized,
+			givenCredentials: creds,
+			givenMethod:      "POST",
+			givenURI:         "/resources",
+			givenAuthHeader:  basic("wronguser", "testpass"),
+			wantCode:         http.StatusUnauthorized,
+			wantChallenge:    true,
 		},
 		{
-			givenUsername:   "testuser",
-			givenPassword:   "wrongpass",
-			givenAuthHeader: authHeader,
-			wantCode:        http.StatusUnauthorized,
+			givenCredentials: creds,
+			givenMethod:      "POST",
+			givenURI:         "/resources",
+			givenAuthHeader:  basic("testuser", "wrongpass"),
+			wantCode:         http.StatusUnauthorized,
+			wantChallenge:    true,
+		},
+		{ // Missing credentials
+			givenCredentials: creds,
+			givenMethod:      "POST",
+			givenURI:         "/resources",
+			wantCode:         http.StatusUnauthorized,
+			wantChallenge:    true,
+		},
+		{ // Authentication disabled
+			givenCredentials: config.Credentials{},
+			givenMethod:      "POST",
+			givenURI:         "/resources",
+			wantCode:         http.StatusOK,
+		},
+		{ // Public revocation list
+			givenCredentials: creds,
+			givenMethod:      "GET",
+			givenURI:         "/crl",
+			wantCode:         http.StatusOK,
+		},
+		{ // Admin API out of the credential scope
+			givenCredentials: creds,
+			givenMethod:      "POST",
+			givenURI:         "/users/myapp.tsuru.io/credentials",
+			givenAuthHeader:  basic("testuser", "testpass"),
+			wantCode:         http.StatusForbidden,
+		},
+		{
+			givenCredentials: creds,
+			givenMethod:      "GET",
+			givenURI:         "/resources?team=myteam",
+			givenAuthHeader:  basic("testuser", "testpass"),
+			wantCode:         http.StatusForbidden,
+		},
+		{
+			givenCredentials: creds,
+			givenMethod:      "GET",
+			givenURI:         "/resources?team=myteam",
+			givenAuthHeader:  basic("testadmin", "testpass"),
+			wantCode:         http.StatusOK,
+		},
+		{ // Tsuru API out of the credential scope
+			givenCredentials: creds,
+			givenMethod:      "POST",
+			givenURI:         "/resources/testinstance/bind-app",
+			givenAuthHeader:  basic("testadmin", "testpass"),
+			wantCode:         http.StatusForbidden,
 		},
 	}
 
 	for _, test := range tests {
 
-		req, _ := http.NewRequest("GET", "/", nil)
-		req.Header.Add("Authorization", test.givenAuthHeader)
+		req, _ := http.NewRequest(test.givenMethod, test.givenURI, nil)
+		if test.givenAuthHeader != "" {
+			req.Header.Add("Authorization", test.givenAuthHeader)
+		}
 		res := httptest.NewRecorder()
 
 		BasicAuthHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusOK)
-		}), test.givenUsername, test.givenPassword).ServeHTTP(res, req)
+		}), test.givenCredentials).ServeHTTP(res, req)
 
 		if test.wantCode != res.Code {
-			t.Errorf("Expected code wrong, want: %d; got: %d", test.wantCode, res.Code)
+			t.Errorf("%s %s: expected code wrong, want: %d; got: %d", test.givenMethod, test.givenURI, test.wantCode, res.Code)
 		}
+		if got := res.Header().Get("WWW-Authenticate"); (got != "") != test.wantChallenge {
+			t.Errorf("%s %s: expected challenge %t; got: '%s'", test.givenMethod, test.givenURI, test.wantChallenge, got)
+		}
+	}
+
+}
+
+func TestTimeoutEndpoint(t *testing.T) {
+	tests := []struct {
+		givenTimeout time.Duration
+
+		wantDeadline bool
+	}{
+		{givenTimeout: time.Minute, wantDeadline: true},
+		{givenTimeout: 0, wantDeadline: false},
 	}
 
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/", nil)
+		var ctx context.Context
+		TimeoutEndpoint(func(r *http.Request) (int, interface{}, error) {
+			ctx = r.Context()
+			return http.StatusOK, nil, nil
+		}, test.givenTimeout)(req)
+
+		if _, ok := ctx.Deadline(); ok != test.wantDeadline {
+			t.Errorf("Expected deadline %t; got: %t", test.wantDeadline, ok)
+		}
+		// The timeout is released once the endpoint returns
+		if test.wantDeadline && ctx.Err() != context.Canceled {
+			t.Errorf("Expected context cancelled after the endpoint; got: %v", ctx.Err())
+		}
+	}
 }
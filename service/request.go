@@ -0,0 +1,155 @@
+package service
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/tsuru/riakapi/service/client"
+)
+
+const (
+	formContentType = "application/x-www-form-urlencoded"
+	jsonContentType = "application/json"
+
+	// paramsPrefix is the prefix of the instance parameters form fields, tsuru
+	// sends `-p n_val=5` as 'parameters.n_val=5'
+	paramsPrefix = "parameters."
+)
+
+// InstanceRequest holds the parameters tsuru sends on the service API requests
+type InstanceRequest struct {
+	Name        string   `json:"name"`
+	Plan        string   `json:"plan"`
+	Team        string   `json:"team"`
+	User        string   `json:"user"`
+	Description string   `json:"description"`
+	Tags        []string `json:"tags"`
+	AppName     string   `json:"app-name"`
+	AppHost     string   `json:"app-host"`
+	UnitHost    string   `json:"unit-host"`
+
+	// Parameters are the instance creation parameters (bucket properties)
+	Parameters map[string]string `json:"parameters"`
+
+	// Grace keeps the previous password valid on the credentials rotation,
+	// nil when not sent
+	Grace *bool `json:"grace"`
+}
+
+// decodeRequest reads the tsuru parameters from the request. Tsuru sends them
+// as a form encoded body (also on DELETE requests where the standard library
+// doesn't parse the body), JSON bodies and query strings are accepted too. Body
+// parameters have precedence over the query string ones
+func decodeRequest(r *http.Request) (*InstanceRequest, error) {
+	req := &InstanceRequest{}
+	if err := req.fromValues(r.URL.Query()); err != nil {
+		return nil, err
+	}
+
+	if r.Body == nil {
+		return req, nil
+	}
+
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch contentType {
+	case jsonContentType:
+		body := &InstanceRequest{}
+		if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+			return nil, err
+		}
+		req.merge(body)
+	case formContentType:
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		values, err := url.ParseQuery(string(data))
+		if err != nil {
+			return nil, err
+		}
+		body := &InstanceRequest{}
+		if err := body.fromValues(values); err != nil {
+			return nil, err
+		}
+		req.merge(body)
+	}
+	return req, nil
+}
+
+// fromValues fills the request with the form (or query string) values
+func (i *InstanceRequest) fromValues(v url.Values) error {
+	i.Name = v.Get("name")
+	i.Plan = v.Get("plan")
+	i.Team = v.Get("team")
+	i.User = v.Get("user")
+	i.Description = v.Get("description")
+	i.AppName = v.Get("app-name")
+	i.AppHost = v.Get("app-host")
+	i.UnitHost = v.Get("unit-host")
+
+	// Tsuru sends one 'tag' field for each tag
+	i.Tags = append(v["tag"], v["tags"]...)
+
+	for k := range v {
+		if !strings.HasPrefix(k, paramsPrefix) {
+			continue
+		}
+		if i.Parameters == nil {
+			i.Parameters = map[string]string{}
+		}
+		i.Parameters[strings.TrimPrefix(k, paramsPrefix)] = v.Get(k)
+	}
+
+	if g := v.Get("grace"); g != "" {
+		grace, err := strconv.ParseBool(g)
+		if err != nil {
+			return err
+		}
+		i.Grace = &grace
+	}
+	return nil
+}
+
+// merge overrides the request parameters with the present ones of other request
+func (i *InstanceRequest) merge(o *InstanceRequest) {
+	fields := []struct{ dst, src *string }{
+		{&i.Name, &o.Name},
+		{&i.Plan, &o.Plan},
+		{&i.Team, &o.Team},
+		{&i.User, &o.User},
+		{&i.Description, &o.Description},
+		{&i.AppName, &o.AppName},
+		{&i.AppHost, &o.AppHost},
+		{&i.UnitHost, &o.UnitHost},
+	}
+	for _, f := range fields {
+		if *f.src != "" {
+			*f.dst = *f.src
+		}
+	}
+	if len(o.Tags) > 0 {
+		i.Tags = o.Tags
+	}
+	if len(o.Parameters) > 0 {
+		i.Parameters = o.Parameters
+	}
+	if o.Grace != nil {
+		i.Grace = o.Grace
+	}
+}
+
+// validateNames checks the instance and user names of the request are valid
+// riak names, they end up on riak-admin commands
+func validateNames(names ...string) error {
+	for _, n := range names {
+		if err := client.ValidateName(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
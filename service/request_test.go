@@ -0,0 +1,136 @@
+package service
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeRequest(t *testing.T) {
+	grace := true
+	tests := []struct {
+		givenMethod      string
+		givenURI         string
+		givenContentType string
+		givenBody        string
+
+		wantRequest *InstanceRequest
+		wantError   bool
+	}{
+		{ // Tsuru instance creation
+			givenMethod:      "POST",
+			givenURI:         "/resources",
+			givenContentType: "application/x-www-form-urlencoded",
+			givenBody:        "name=mybucket&plan=tsuru-counter&team=myteam&user=me%40tsuru.io&description=my+bucket&tag=prod&tag=web",
+
+			wantRequest: &InstanceRequest{
+				Name:        "mybucket",
+				Plan:        "tsuru-counter",
+				Team:        "myteam",
+				User:        "me@tsuru.io",
+				Description: "my bucket",
+				Tags:        []string{"prod", "web"},
+			},
+		},
+		{ // Tsuru instance creation with parameters
+			givenMethod:      "POST",
+			givenURI:         "/resources",
+			givenContentType: "application/x-www-form-urlencoded",
+			givenBody:        "name=mybucket&plan=tsuru-counter&parameters.n_val=5&parameters.r=quorum",
+
+			wantRequest: &InstanceRequest{
+				Name:       "mybucket",
+				Plan:       "tsuru-counter",
+				Parameters: map[string]string{"n_val": "5", "r": "quorum"},
+			},
+		},
+		{ // Tsuru app binding
+			givenMethod:      "POST",
+			givenURI:         "/resources/mybucket/bind-app",
+			givenContentType: "application/x-www-form-urlencoded",
+			givenBody:        "app-name=myapp&app-host=myapp.tsuru.io",
+
+			wantRequest: &InstanceRequest{AppName: "myapp", AppHost: "myapp.tsuru.io"},
+		},
+		{ // Tsuru app unbinding (DELETE with body)
+			givenMethod:      "DELETE",
+			givenURI:         "/resources/mybucket/bind-app",
+			givenContentType: "application/x-www-form-urlencoded; charset=UTF-8",
+			givenBody:        "app-name=myapp&app-host=myapp.tsuru.io",
+
+			wantRequest: &InstanceRequest{AppName: "myapp", AppHost: "myapp.tsuru.io"},
+		},
+		{ // Tsuru unit binding
+			givenMethod:      "POST",
+			givenURI:         "/resources/mybucket/bind",
+			givenContentType: "application/x-www-form-urlencoded",
+			givenBody:        "app-name=myapp&app-host=myapp.tsuru.io&unit-host=10.10.10.10",
+
+			wantRequest: &InstanceRequest{AppName: "myapp", AppHost: "myapp.tsuru.io", UnitHost: "10.10.10.10"},
+		},
+		{ // Query string
+			givenMethod: "POST",
+			givenURI:    "/resources?name=mybucket&plan=tsuru-set&team=myteam",
+
+			wantRequest: &InstanceRequest{Name: "mybucket", Plan: "tsuru-set", Team: "myteam"},
+		},
+		{ // JSON body has precedence over the query string
+			givenMethod:      "POST",
+			givenURI:         "/resources?name=querybucket&team=myteam",
+			givenContentType: "application/json",
+			givenBody:        `{"name":"mybucket","plan":"tsuru-map","tags":["prod"]}`,
+
+			wantRequest: &InstanceRequest{Name: "mybucket", Plan: "tsuru-map", Team: "myteam", Tags: []string{"prod"}},
+		},
+		{ // Credentials rotation with grace
+			givenMethod:      "POST",
+			givenURI:         "/users/myapp/credentials",
+			givenContentType: "application/json",
+			givenBody:        `{"grace":true}`,
+
+			wantRequest: &InstanceRequest{Grace: &grace},
+		},
+		{ // Credentials rotation with a wrong grace
+			givenMethod: "POST",
+			givenURI:    "/users/myapp/credentials?grace=maybe",
+
+			wantError: true,
+		},
+		{ // Wrong JSON body
+			givenMethod:      "POST",
+			givenURI:         "/resources",
+			givenContentType: "application/json",
+			givenBody:        `{"name":`,
+
+			wantError: true,
+		},
+	}
+
+	for _, test := range tests {
+		r, _ := http.NewRequest(test.givenMethod, test.givenURI, strings.NewReader(test.givenBody))
+		if test.givenContentType != "" {
+			r.Header.Set("Content-Type", test.givenContentType)
+		}
+
+		got, err := decodeRequest(r)
+		if test.wantError {
+			if err == nil {
+				t.Errorf("Expected error decoding %s", test.givenBody)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Error decoding request: %v", err)
+			continue
+		}
+
+		// nil and empty tags are the same for us
+		if len(got.Tags) == 0 {
+			got.Tags = nil
+		}
+		if !reflect.DeepEqual(got, test.wantRequest) {
+			t.Errorf("Expected request %#v;\ngot: %#v", test.wantRequest, got)
+		}
+	}
+}
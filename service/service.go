@@ -2,6 +2,7 @@ package service
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/NYTimes/gizmo/server"
 	"github.com/Sirupsen/logrus"
@@ -38,15 +39,27 @@ func (s *RiakService) Prefix() string {
 
 // Middleware wraps all the requests around thesse middlewares
 func (s *RiakService) Middleware(h http.Handler) http.Handler {
-	h = BasicAuthHandler(h, s.Cfg.RiakAPIUsername, s.Cfg.RiakAPIPassword)
+	h = BasicAuthHandler(h, s.Cfg.Credentials)
 	return h
 }
 
 // JSONMiddleware wraps all the requests around these middlewares
 func (s *RiakService) JSONMiddleware(j server.JSONEndpoint) server.JSONEndpoint {
+	j = TimeoutEndpoint(j, time.Duration(s.Cfg.RiakAPIRequestTimeout)*time.Second)
 	return j
 }
 
+// Endpoints maps the routes with the non JSON endpoints
+func (s *RiakService) Endpoints() map[string]map[string]http.HandlerFunc {
+	return map[string]map[string]http.HandlerFunc{
+
+		"/crl": map[string]http.HandlerFunc{
+			// Returns the revocation list of the app client certificates
+			"GET": s.GetCRL,
+		},
+	}
+}
+
 // JSONEndpoints maps the routes with the endpoints
 func (s *RiakService) JSONEndpoints() map[string]map[string]server.JSONEndpoint {
 	logrus.Debug("Registering endpoints...")
@@ -59,6 +72,8 @@ func (s *RiakService) JSONEndpoints() map[string]map[string]server.JSONEndpoint
 		},
 
 		"/resources": map[string]server.JSONEndpoint{
+			// Lists the service instances (by team or plan)
+			"GET": s.ListInstances,
 			// Creates a service instance
 			"POST": s.CreateInstance,
 		},
@@ -80,6 +95,8 @@ func (s *RiakService) JSONEndpoints() map[string]map[string]server.JSONEndpoint
 		},
 
 		"/resources/{name}": map[string]server.JSONEndpoint{
+			// Returns the instance information
+			"GET": s.GetInstanceInfo,
 			// Removes the instance
 			"DELETE": s.RemoveInstance,
 		},
@@ -88,5 +105,15 @@ func (s *RiakService) JSONEndpoints() map[string]map[string]server.JSONEndpoint
 			// Checks the status of the instance
 			"GET": s.CheckInstanceStatus,
 		},
+
+		"/users/{app_host}/credentials": map[string]server.JSONEndpoint{
+			// Rotates the app user password
+			"POST": s.RotateCredentials,
+		},
+
+		"/users/{app_host}/credentials/confirm": map[string]server.JSONEndpoint{
+			// Invalidates the previous password of a rotation with grace
+			"POST": s.ConfirmCredentialsRotation,
+		},
 	}
 }
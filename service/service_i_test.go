@@ -1,6 +1,7 @@
 package service
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"math/rand"
@@ -33,6 +34,10 @@ var (
 		"SSH_PORT":          os.Getenv("RIAK_PORT_22_TCP_PORT"),
 		"SSH_USER":          "riakapi",
 		"SSH_PASSWORD":      "riakapi",
+		// The test riak container generates its ssh host keys when it's built,
+		// there isn't a known one to pin
+		"SSH_INSECURE_HOST_KEY": "1",
+		"RIAKAPI_PASSWORD_KEYS": "it:cmlha2FwaS1pbnRlZ3JhdGlvbi10ZXN0cy1rZXktMzI=",
 	}
 )
 
@@ -120,7 +125,7 @@ func TestIntegrationInstanceCreationOk(t *testing.T) {
 	}
 
 	// Check correct bucket type
-	if serviceTestClient.GetBucketType(instance) != plan {
+	if serviceTestClient.GetBucketType(context.Background(), instance) != plan {
 		t.Error("Bucket not created correctly")
 	}
 }
@@ -158,6 +163,7 @@ func TestIntegrationInstanceBindingOk(t *testing.T) {
 		"RIAK_PASSWORD":    "",
 		"RIAK_BUCKET_TYPE": plan,
 		"RIAK_BUCKET":      instance,
+		"RIAK_BIND_MODE":   "read-write",
 	}
 	r, _ = http.NewRequest("POST", uri, nil)
 	w = httptest.NewRecorder()
@@ -343,3 +349,50 @@ func TestIntegrationInstanceStatusWrong(t *testing.T) {
 		t.Errorf("Error checking status; expect: %d\ngot: %d", wantCode, w.Code)
 	}
 }
+
+func TestIntegrationInstanceRemovalOk(t *testing.T) {
+	// Prepare
+	serviceTestClient := client.NewRiak(serviceITestCfg)
+	srvr := server.NewSimpleServer(nil)
+	srvr.Register(&RiakService{Cfg: serviceITestCfg, Client: serviceTestClient})
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	instance := fmt.Sprintf("test-instance-%d", rnd.Int())
+	plan := "tsuru-counter"
+	uri := fmt.Sprintf("/resources?name=%s&plan=%s&team=myteam&user=username", instance, plan)
+
+	// Create a new instance
+	r, _ := http.NewRequest("POST", uri, nil)
+	w := httptest.NewRecorder()
+	srvr.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Error("Coudn't prepare the instance for the test")
+	}
+
+	// Remove the instance
+	uri = fmt.Sprintf("/resources/%s", instance)
+	wantCode := http.StatusOK
+
+	r, _ = http.NewRequest("DELETE", uri, nil)
+	w = httptest.NewRecorder()
+	srvr.ServeHTTP(w, r)
+
+	if w.Code != wantCode {
+		t.Errorf("Error removing instance; expect: %d\ngot: %d", wantCode, w.Code)
+	}
+
+	// Instance shouldn't be registered anymore
+	if serviceTestClient.GetBucketType(context.Background(), instance) != "" {
+		t.Error("Bucket not removed correctly")
+	}
+
+	// Removing again should fail
+	wantCode = http.StatusNotFound
+	r, _ = http.NewRequest("DELETE", uri, nil)
+	w = httptest.NewRecorder()
+	srvr.ServeHTTP(w, r)
+
+	if w.Code != wantCode {
+		t.Errorf("Error removing instance; expect: %d\ngot: %d", wantCode, w.Code)
+	}
+}
@@ -1,11 +1,21 @@
 package service
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	gizmoConfig "github.com/NYTimes/gizmo/config"
 	"github.com/NYTimes/gizmo/server"
@@ -33,6 +43,10 @@ var serviceTestCfg = &config.ServiceConfig{
 func TestGetPlans(t *testing.T) {
 
 	serviceTestClient := client.NewDummy()
+	customPlansClient := client.NewDummy()
+	customPlansClient.Plans = client.Plans{
+		{Name: "tsuru-kv", Description: "Key/value replicated 5 times", Props: map[string]interface{}{"n_val": 5}},
+	}
 
 	correctPlans := []interface{}{
 		map[string]interface{}{"name": client.BucketTypeCounter, "description": "Bucket type of counter data type"},
@@ -58,6 +72,17 @@ func TestGetPlans(t *testing.T) {
 			wantCode: http.StatusOK,
 			wantBody: correctPlans,
 		},
+		{
+			givenURI:    "/resources/plans",
+			givenClient: customPlansClient,
+			givenConfig: serviceTestCfg,
+			givenMethod: "GET",
+
+			wantCode: http.StatusOK,
+			wantBody: []interface{}{
+				map[string]interface{}{"name": "tsuru-kv", "description": "Key/value replicated 5 times"},
+			},
+		},
 	}
 
 	for _, test := range tests {
@@ -80,8 +105,7 @@ func TestGetPlans(t *testing.T) {
 			t.Error("unable to JSON decode response body: ", err)
 		}
 
-		// Check len because api returns different order of the slice each time
-		if len(got.([]interface{})) != len(test.wantBody.([]interface{})) {
+		if !reflect.DeepEqual(got, test.wantBody) {
 			t.Errorf("expected response body of\n%#v;\ngot\n%#v", test.wantBody, got)
 		}
 
@@ -109,8 +133,8 @@ func TestInstanceCreation(t *testing.T) {
 			givenMethod:       "POST",
 			givenDummyBuckets: map[string]string{},
 
-			wantCode:         http.StatusInternalServerError,
-			wantBody:         MissingParamsMsg,
+			wantCode:         http.StatusBadRequest,
+			wantBody:         map[string]interface{}{"error": MissingParamsMsg},
 			wantDummyBuckets: map[string]string{},
 		},
 		{
@@ -120,8 +144,8 @@ func TestInstanceCreation(t *testing.T) {
 			givenMethod:       "POST",
 			givenDummyBuckets: map[string]string{},
 
-			wantCode:         http.StatusInternalServerError,
-			wantBody:         BucketCreationFailMsg,
+			wantCode:         http.StatusBadRequest,
+			wantBody:         map[string]interface{}{"error": BucketCreationFailMsg + ": invalid plan"},
 			wantDummyBuckets: map[string]string{},
 		},
 		{
@@ -142,10 +166,54 @@ func TestInstanceCreation(t *testing.T) {
 			givenMethod:       "POST",
 			givenDummyBuckets: map[string]string{"test-bucket": "tsuru-counter"},
 
-			wantCode:         http.StatusInternalServerError,
-			wantBody:         BucketCreationFailMsg,
+			wantCode:         http.StatusConflict,
+			wantBody:         map[string]interface{}{"error": BucketCreationFailMsg + ": instance already exists"},
 			wantDummyBuckets: map[string]string{"test-bucket": "tsuru-counter"},
 		},
+		{ // Allowed parameters
+			givenURI:          "/resources?name=test-bucket&plan=tsuru-counter&team=myteam&parameters.n_val=5&parameters.r=quorum",
+			givenClient:       serviceTestClient,
+			givenConfig:       serviceTestCfg,
+			givenMethod:       "POST",
+			givenDummyBuckets: map[string]string{},
+
+			wantCode:         http.StatusOK,
+			wantBody:         "",
+			wantDummyBuckets: map[string]string{"test-bucket": "tsuru-counter"},
+		},
+		{ // Parameter not allowed on the plan
+			givenURI:          "/resources?name=test-bucket&plan=tsuru-counter&team=myteam&parameters.allow_mult=false",
+			givenClient:       serviceTestClient,
+			givenConfig:       serviceTestCfg,
+			givenMethod:       "POST",
+			givenDummyBuckets: map[string]string{},
+
+			wantCode:         http.StatusBadRequest,
+			wantBody:         map[string]interface{}{"error": BucketCreationFailMsg + ": invalid parameter: 'allow_mult' is not allowed on plan 'tsuru-counter'"},
+			wantDummyBuckets: map[string]string{},
+		},
+		{ // Wrong parameter value
+			givenURI:          "/resources?name=test-bucket&plan=tsuru-counter&team=myteam&parameters.n_val=many",
+			givenClient:       serviceTestClient,
+			givenConfig:       serviceTestCfg,
+			givenMethod:       "POST",
+			givenDummyBuckets: map[string]string{},
+
+			wantCode:         http.StatusBadRequest,
+			wantBody:         map[string]interface{}{"error": BucketCreationFailMsg + ": invalid parameter: n_val 'many' is not a positive number"},
+			wantDummyBuckets: map[string]string{},
+		},
+		{ // Shell injection on the name
+			givenURI:          "/resources?name=test%3Brm+-rf+%2F&plan=tsuru-counter&team=myteam",
+			givenClient:       serviceTestClient,
+			givenConfig:       serviceTestCfg,
+			givenMethod:       "POST",
+			givenDummyBuckets: map[string]string{},
+
+			wantCode:         http.StatusBadRequest,
+			wantBody:         map[string]interface{}{"error": BucketCreationFailMsg + ": invalid name: 'test;rm -rf /' should start with a letter or number and only have letters, numbers, '.', '_' and '-'"},
+			wantDummyBuckets: map[string]string{},
+		},
 	}
 
 	for _, test := range tests {
@@ -173,7 +241,7 @@ func TestInstanceCreation(t *testing.T) {
 		}
 
 		// Check body
-		if got != test.wantBody {
+		if !reflect.DeepEqual(got, test.wantBody) {
 			t.Errorf("expected response body of\n%#v;\ngot\n%#v", test.wantBody, got)
 		}
 
@@ -218,6 +286,7 @@ func TestInstanceBindingOK(t *testing.T) {
 				"RIAK_PASSWORD":    "myapp.tsuru.io",
 				"RIAK_BUCKET_TYPE": "testbuckettype",
 				"RIAK_BUCKET":      "testinstance",
+				"RIAK_BIND_MODE":   "read-write",
 			},
 			wantDummyUsers: map[string]*client.UserProps{
 				"tsuru_myapp.tsuru.io": &client.UserProps{
@@ -250,6 +319,7 @@ func TestInstanceBindingOK(t *testing.T) {
 				"RIAK_PASSWORD":    "myapp.tsuru.io",
 				"RIAK_BUCKET_TYPE": "testbuckettype",
 				"RIAK_BUCKET":      "testinstance",
+				"RIAK_BIND_MODE":   "read-write",
 			},
 			wantDummyUsers: map[string]*client.UserProps{
 				"tsuru_myapp.tsuru.io": &client.UserProps{
@@ -259,6 +329,48 @@ func TestInstanceBindingOK(t *testing.T) {
 				},
 			},
 		},
+		{ // Read only binding
+			givenURI:          "/resources/testinstance/bind-app?app-host=myapp.tsuru.io&parameters.mode=read-only",
+			givenClient:       serviceTestClient,
+			givenConfig:       serviceTestCfg,
+			givenMethod:       "POST",
+			givenDummyUsers:   map[string]*client.UserProps{},
+			givenDummyBuckets: map[string]string{"testinstance": "testbuckettype"},
+
+			wantCode: http.StatusCreated,
+			wantBody: map[string]string{
+				"RIAK_HOSTS":       "null",
+				"RIAK_HTTP_PORT":   "0",
+				"RIAK_PB_PORT":     "0",
+				"RIAK_USER":        "tsuru_myapp.tsuru.io",
+				"RIAK_PASSWORD":    "myapp.tsuru.io",
+				"RIAK_BUCKET_TYPE": "testbuckettype",
+				"RIAK_BUCKET":      "testinstance",
+				"RIAK_BIND_MODE":   "read-only",
+			},
+			wantDummyUsers: map[string]*client.UserProps{
+				"tsuru_myapp.tsuru.io": &client.UserProps{
+					Username:  "tsuru_myapp.tsuru.io",
+					Password:  "myapp.tsuru.io",
+					ACL:       []string{"testinstance"},
+					BindModes: map[string]client.BindMode{"testinstance": client.BindModeReadOnly},
+				},
+			},
+		},
+		{ // Not valid binding mode
+			givenURI:          "/resources/testinstance/bind-app?app-host=myapp.tsuru.io&parameters.mode=delete-only",
+			givenClient:       serviceTestClient,
+			givenConfig:       serviceTestCfg,
+			givenMethod:       "POST",
+			givenDummyUsers:   map[string]*client.UserProps{},
+			givenDummyBuckets: map[string]string{"testinstance": "testbuckettype"},
+
+			wantCode: http.StatusBadRequest,
+			wantBody: map[string]string{
+				"error": UserGrantingFailMsg + ": invalid parameter: 'delete-only' is not a valid bind mode",
+			},
+			wantDummyUsers: map[string]*client.UserProps{},
+		},
 	}
 
 	for _, test := range tests {
@@ -303,6 +415,9 @@ func TestInstanceBindingOK(t *testing.T) {
 			if v.Username != u.Username || v.Password != u.Password || len(v.ACL) != len(u.ACL) {
 				t.Errorf("expected dummy user %v; \ngot: %v", *v, *u)
 			}
+			if v.BindModes != nil && !reflect.DeepEqual(v.BindModes, u.BindModes) {
+				t.Errorf("expected dummy user bind modes %v; \ngot: %v", v.BindModes, u.BindModes)
+			}
 		}
 
 	}
@@ -326,9 +441,27 @@ func TestInstanceBindingWrong(t *testing.T) {
 			givenConfig: serviceTestCfg,
 			givenMethod: "POST",
 
-			wantCode: http.StatusInternalServerError,
+			wantCode: http.StatusBadRequest,
 			wantBody: MissingParamsMsg,
 		},
+		{
+			givenURI:    "/resources/testinstance/bind-app?app-host=myapp%60id%60",
+			givenClient: serviceTestClient,
+			givenConfig: serviceTestCfg,
+			givenMethod: "POST",
+
+			wantCode: http.StatusBadRequest,
+			wantBody: UserGrantingFailMsg + ": invalid name: 'tsuru_myapp`id`' should start with a letter or number and only have letters, numbers, '.', '_' and '-'",
+		},
+		{
+			givenURI:    "/resources/all/bind-app?app-host=myapp.tsuru.io",
+			givenClient: serviceTestClient,
+			givenConfig: serviceTestCfg,
+			givenMethod: "POST",
+
+			wantCode: http.StatusBadRequest,
+			wantBody: UserGrantingFailMsg + ": invalid name: 'all' is a reserved word",
+		},
 	}
 
 	for _, test := range tests {
@@ -344,53 +477,100 @@ func TestInstanceBindingWrong(t *testing.T) {
 			t.Errorf("expected response code of %d; got %d", test.wantCode, w.Code)
 		}
 
-		var got string
+		var got ErrorResponse
 		json.NewDecoder(w.Body).Decode(&got)
 
-		if got != test.wantBody {
-			t.Errorf("Expected body: %s ; got: %s", test.wantBody, got)
+		if got.Error != test.wantBody {
+			t.Errorf("Expected body: %s ; got: %s", test.wantBody, got.Error)
 		}
 	}
 }
 
 func TestInstanceBindingUnbindigEvents(t *testing.T) {
 	serviceTestClient := client.NewDummy()
+	serviceTestClient.Buckets = map[string]string{"testinstance": "tsuru-counter"}
+	serviceTestClient.Users = map[string]*client.UserProps{
+		"tsuru_myapp.tsuru.io": &client.UserProps{Username: "tsuru_myapp.tsuru.io", ACL: []string{"testinstance"}},
+	}
 
 	tests := []struct {
 		givenURI    string
 		givenClient *client.Dummy
 		givenConfig *config.ServiceConfig
 		givenMethod string
+		givenBody   string
 
-		wantCode int
-		wantBody string
+		wantCode    int
+		wantBody    string
+		wantSources []string
 	}{
 		{
 			givenURI:    "/resources/testinstance/bind",
 			givenClient: serviceTestClient,
 			givenConfig: serviceTestCfg,
 			givenMethod: "POST",
+			givenBody:   "app-host=myapp.tsuru.io&unit-host=10.0.0.5",
 
-			wantCode: http.StatusCreated,
-			wantBody: "",
+			wantCode:    http.StatusCreated,
+			wantBody:    "",
+			wantSources: []string{"10.0.0.5/32"},
 		},
 		{
 			givenURI:    "/resources/testinstance/bind",
 			givenClient: serviceTestClient,
 			givenConfig: serviceTestCfg,
 			givenMethod: "DELETE",
+			givenBody:   "app-host=myapp.tsuru.io&unit-host=10.0.0.5",
 
-			wantCode: http.StatusOK,
-			wantBody: "",
+			wantCode:    http.StatusOK,
+			wantBody:    "",
+			wantSources: []string{},
+		},
+		{
+			givenURI:    "/resources/testinstance/bind",
+			givenClient: serviceTestClient,
+			givenConfig: serviceTestCfg,
+			givenMethod: "POST",
+			givenBody:   "app-host=myapp.tsuru.io",
+
+			wantCode:    http.StatusBadRequest,
+			wantBody:    "",
+			wantSources: []string{},
+		},
+		{
+			givenURI:    "/resources/testinstance/bind",
+			givenClient: serviceTestClient,
+			givenConfig: serviceTestCfg,
+			givenMethod: "POST",
+			givenBody:   "app-host=myapp.tsuru.io&unit-host=unit-1",
+
+			wantCode:    http.StatusBadRequest,
+			wantBody:    "",
+			wantSources: []string{},
+		},
+		{
+			givenURI:    "/resources/testinstance/bind",
+			givenClient: serviceTestClient,
+			givenConfig: serviceTestCfg,
+			givenMethod: "POST",
+			givenBody:   "app-host=otherapp.tsuru.io&unit-host=10.0.0.6",
+
+			wantCode:    http.StatusNotFound,
+			wantBody:    "",
+			wantSources: []string{},
 		},
 	}
 
+	// Bound to the instance before the units
+	serviceTestClient.GrantUserAccess(context.Background(), "tsuru_myapp.tsuru.io", "testinstance", client.BindModeReadWrite)
+
 	for _, test := range tests {
 		srvr := server.NewSimpleServer(nil)
 		srvr.Register(&RiakService{Cfg: test.givenConfig, Client: test.givenClient})
 
 		// Create the request
-		r, _ := http.NewRequest(test.givenMethod, test.givenURI, nil)
+		r, _ := http.NewRequest(test.givenMethod, test.givenURI, strings.NewReader(test.givenBody))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 		w := httptest.NewRecorder()
 		srvr.ServeHTTP(w, r)
 
@@ -404,6 +584,10 @@ func TestInstanceBindingUnbindigEvents(t *testing.T) {
 		if got != test.wantBody {
 			t.Errorf("Expected body: %s ; got: %s", test.wantBody, got)
 		}
+
+		if sources := test.givenClient.Users["tsuru_myapp.tsuru.io"].Sources; !reflect.DeepEqual(sources, test.wantSources) {
+			t.Errorf("Expected sources %v; got: %v", test.wantSources, sources)
+		}
 	}
 }
 
@@ -457,11 +641,11 @@ func TestInstanceStatus(t *testing.T) {
 			t.Errorf("expected response code of %d; got %d", test.wantCode, w.Code)
 		}
 
-		var got string
+		var got ErrorResponse
 		json.NewDecoder(w.Body).Decode(&got)
 
-		if got != test.wantBody {
-			t.Errorf("Expected body: %s ; got: %s", test.wantBody, got)
+		if got.Error != test.wantBody {
+			t.Errorf("Expected body: %s ; got: %s", test.wantBody, got.Error)
 		}
 	}
 }
@@ -495,17 +679,47 @@ func TestInstanceUnbinding(t *testing.T) {
 			},
 			givenDummyBuckets: map[string]string{"testinstance": "testbuckettype"},
 
+			wantCode:       http.StatusOK,
+			wantBody:       "",
+			wantDummyUsers: map[string]*client.UserProps{},
+		},
+		{ // User bound to other instances is not deleted
+			givenURI:    "/resources/testinstance/bind-app?app-host=myapp.tsuru.io",
+			givenClient: serviceTestClient,
+			givenConfig: serviceTestCfg,
+			givenMethod: "DELETE",
+			givenDummyUsers: map[string]*client.UserProps{
+				"tsuru_myapp.tsuru.io": &client.UserProps{
+					Username: "tsuru_myapp.tsuru.io",
+					Password: "myapp.tsuru.io",
+					ACL:      []string{"testinstance", "otherinstance"},
+				},
+			},
+			givenDummyBuckets: map[string]string{"testinstance": "testbuckettype", "otherinstance": "testbuckettype"},
+
 			wantCode: http.StatusOK,
 			wantBody: "",
 			wantDummyUsers: map[string]*client.UserProps{
 				"tsuru_myapp.tsuru.io": &client.UserProps{
 					Username: "tsuru_myapp.tsuru.io",
 					Password: "myapp.tsuru.io",
-					ACL:      []string{},
+					ACL:      []string{"otherinstance"},
 				},
 			},
 		},
 		{ // Not a valid user
+			givenURI:          "/resources/testinstance/bind-app?app-host=myapp.tsuru.io",
+			givenClient:       serviceTestClient,
+			givenConfig:       serviceTestCfg,
+			givenMethod:       "DELETE",
+			givenDummyUsers:   map[string]*client.UserProps{},
+			givenDummyBuckets: map[string]string{"testinstance": "testbuckettype"},
+
+			wantCode:       http.StatusNotFound,
+			wantBody:       UserRevokingFailMsg + ": user not found",
+			wantDummyUsers: map[string]*client.UserProps{},
+		},
+		{ // Not a valid instance
 			givenURI:          "/resources/testinstance/bind-app?app-host=myapp.tsuru.io",
 			givenClient:       serviceTestClient,
 			givenConfig:       serviceTestCfg,
@@ -513,8 +727,8 @@ func TestInstanceUnbinding(t *testing.T) {
 			givenDummyUsers:   map[string]*client.UserProps{},
 			givenDummyBuckets: map[string]string{},
 
-			wantCode:       http.StatusInternalServerError,
-			wantBody:       UserRevokingFailMsg,
+			wantCode:       http.StatusNotFound,
+			wantBody:       UserRevokingFailMsg + ": instance not found",
 			wantDummyUsers: map[string]*client.UserProps{},
 		},
 	}
@@ -537,11 +751,11 @@ func TestInstanceUnbinding(t *testing.T) {
 			t.Errorf("expected response code of %d; got %d", test.wantCode, w.Code)
 		}
 
-		var got string
+		var got ErrorResponse
 		json.NewDecoder(w.Body).Decode(&got)
 
-		if got != test.wantBody {
-			t.Errorf("Expected body: %s ; got: %s", test.wantBody, got)
+		if got.Error != test.wantBody {
+			t.Errorf("Expected body: %s ; got: %s", test.wantBody, got.Error)
 		}
 
 		// Check state on dummy client is correct
@@ -562,26 +776,63 @@ func TestInstanceRemoval(t *testing.T) {
 	serviceTestClient := client.NewDummy()
 
 	tests := []struct {
-		givenURI    string
-		givenClient *client.Dummy
-		givenConfig *config.ServiceConfig
-		givenMethod string
+		givenURI          string
+		givenClient       *client.Dummy
+		givenConfig       *config.ServiceConfig
+		givenMethod       string
+		givenDummyUsers   map[string]*client.UserProps
+		givenDummyBuckets map[string]string
 
-		wantCode int
-		wantBody string
+		wantCode         int
+		wantBody         string
+		wantDummyBuckets map[string]string
+		wantDummyACL     []string
 	}{
 		{
 			givenURI:    "/resources/testinstance",
 			givenClient: serviceTestClient,
 			givenConfig: serviceTestCfg,
 			givenMethod: "DELETE",
+			givenDummyUsers: map[string]*client.UserProps{
+				"tsuru_myapp.tsuru.io": &client.UserProps{
+					Username: "tsuru_myapp.tsuru.io",
+					Password: "myapp.tsuru.io",
+					ACL:      []string{"testinstance", "otherinstance"},
+				},
+			},
+			givenDummyBuckets: map[string]string{"testinstance": "tsuru-counter", "otherinstance": "tsuru-counter"},
 
-			wantCode: http.StatusOK,
-			wantBody: "",
+			wantCode:         http.StatusOK,
+			wantBody:         "",
+			wantDummyBuckets: map[string]string{"otherinstance": "tsuru-counter"},
+			wantDummyACL:     []string{"otherinstance"},
+		},
+		{ // Not present instance
+			givenURI:    "/resources/testinstance",
+			givenClient: serviceTestClient,
+			givenConfig: serviceTestCfg,
+			givenMethod: "DELETE",
+			givenDummyUsers: map[string]*client.UserProps{
+				"tsuru_myapp.tsuru.io": &client.UserProps{
+					Username: "tsuru_myapp.tsuru.io",
+					Password: "myapp.tsuru.io",
+					ACL:      []string{"otherinstance"},
+				},
+			},
+			givenDummyBuckets: map[string]string{"otherinstance": "tsuru-counter"},
+
+			wantCode:         http.StatusNotFound,
+			wantBody:         BucketRemovalFailMsg + ": instance not found",
+			wantDummyBuckets: map[string]string{"otherinstance": "tsuru-counter"},
+			wantDummyACL:     []string{"otherinstance"},
 		},
 	}
 
 	for _, test := range tests {
+		// Set our initial state of the database
+		test.givenClient.Users = test.givenDummyUsers
+		test.givenClient.Buckets = test.givenDummyBuckets
+
 		srvr := server.NewSimpleServer(nil)
 		srvr.Register(&RiakService{Cfg: test.givenConfig, Client: test.givenClient})
 
@@ -594,11 +845,565 @@ func TestInstanceRemoval(t *testing.T) {
 			t.Errorf("expected response code of %d; got %d", test.wantCode, w.Code)
 		}
 
-		var got string
+		var got ErrorResponse
 		json.NewDecoder(w.Body).Decode(&got)
 
-		if got != test.wantBody {
-			t.Errorf("Expected body: %s ; got: %s", test.wantBody, got)
+		if got.Error != test.wantBody {
+			t.Errorf("Expected body: %s ; got: %s", test.wantBody, got.Error)
+		}
+
+		// Check state on dummy client is correct
+		if !reflect.DeepEqual(test.wantDummyBuckets, test.givenClient.Buckets) {
+			t.Errorf("expected dummy buckets %v; \ngot: %v", test.wantDummyBuckets, test.givenClient.Buckets)
+		}
+
+		if acl := test.givenClient.Users["tsuru_myapp.tsuru.io"].ACL; !reflect.DeepEqual(test.wantDummyACL, acl) {
+			t.Errorf("expected dummy user ACL %v; \ngot: %v", test.wantDummyACL, acl)
+		}
+	}
+}
+
+func TestInstanceInfo(t *testing.T) {
+	serviceTestClient := client.NewDummy()
+	createdAt := time.Date(2016, 5, 10, 12, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		givenURI              string
+		givenClient           *client.Dummy
+		givenConfig           *config.ServiceConfig
+		givenMethod           string
+		givenDummyUsers       map[string]*client.UserProps
+		givenDummyBuckets     map[string]string
+		givenDummyBucketsInfo map[string]*client.BucketInfo
+		givenDummyBucketsKeys map[string]int
+
+		wantCode int
+		wantBody interface{}
+	}{
+		{
+			givenURI:    "/resources/testinstance",
+			givenClient: serviceTestClient,
+			givenConfig: serviceTestCfg,
+			givenMethod: "GET",
+			givenDummyUsers: map[string]*client.UserProps{
+				"tsuru_myapp.tsuru.io": &client.UserProps{
+					Username: "tsuru_myapp.tsuru.io",
+					ACL:      []string{"testinstance"},
+				},
+				"tsuru_myapp2.tsuru.io": &client.UserProps{
+					Username: "tsuru_myapp2.tsuru.io",
+					ACL:      []string{"testinstance"},
+				},
+				"tsuru_myapp3.tsuru.io": &client.UserProps{
+					Username: "tsuru_myapp3.tsuru.io",
+					ACL:      []string{"otherinstance"},
+				},
+			},
+			givenDummyBuckets: map[string]string{"testinstance": "tsuru-counter"},
+			givenDummyBucketsInfo: map[string]*client.BucketInfo{
+				"testinstance": &client.BucketInfo{
+					Team:       "myteam",
+					Creator:    "me@tsuru.io",
+					CreatedAt:  createdAt,
+					Parameters: map[string]string{"r": "quorum", "n_val": "5"},
+					Tags:       []string{"prod", "web"},
+				},
+			},
+			givenDummyBucketsKeys: map[string]int{"testinstance": 42},
+
+			wantCode: http.StatusOK,
+			wantBody: []interface{}{
+				map[string]interface{}{"label": "Bucket type", "value": "tsuru-counter"},
+				map[string]interface{}{"label": "Data type", "value": "counter"},
+				map[string]interface{}{"label": "Created at", "value": "2016-05-10T12:30:00Z"},
+				map[string]interface{}{"label": "Team", "value": "myteam"},
+				map[string]interface{}{"label": "Creator", "value": "me@tsuru.io"},
+				map[string]interface{}{"label": "Tags", "value": "prod, web"},
+				map[string]interface{}{"label": "Parameters", "value": "n_val=5, r=quorum"},
+				map[string]interface{}{"label": "Bound apps", "value": "myapp.tsuru.io, myapp2.tsuru.io"},
+				map[string]interface{}{"label": "Keys (approx.)", "value": "42"},
+				map[string]interface{}{"label": "Cluster hosts", "value": ""},
+			},
+		},
+		{ // Not present instance
+			givenURI:              "/resources/testinstance",
+			givenClient:           serviceTestClient,
+			givenConfig:           serviceTestCfg,
+			givenMethod:           "GET",
+			givenDummyUsers:       map[string]*client.UserProps{},
+			givenDummyBuckets:     map[string]string{},
+			givenDummyBucketsInfo: map[string]*client.BucketInfo{},
+			givenDummyBucketsKeys: map[string]int{},
+
+			wantCode: http.StatusNotFound,
+			wantBody: map[string]interface{}{"error": InstanceInfoFailMsg + ": instance not found"},
+		},
+	}
+
+	for _, test := range tests {
+		// Set our initial state of the database
+		test.givenClient.Users = test.givenDummyUsers
+		test.givenClient.Buckets = test.givenDummyBuckets
+		test.givenClient.BucketsInfo = test.givenDummyBucketsInfo
+		test.givenClient.BucketsKeys = test.givenDummyBucketsKeys
+
+		srvr := server.NewSimpleServer(nil)
+		srvr.Register(&RiakService{Cfg: test.givenConfig, Client: test.givenClient})
+
+		// Create the request
+		r, _ := http.NewRequest(test.givenMethod, test.givenURI, nil)
+		w := httptest.NewRecorder()
+		srvr.ServeHTTP(w, r)
+
+		if w.Code != test.wantCode {
+			t.Errorf("expected response code of %d; got %d", test.wantCode, w.Code)
+		}
+
+		var got interface{}
+		err := json.NewDecoder(w.Body).Decode(&got)
+		if err != nil {
+			t.Error("unable to JSON decode response body: ", err)
+		}
+
+		if !reflect.DeepEqual(got, test.wantBody) {
+			t.Errorf("expected response body of\n%#v;\ngot\n%#v", test.wantBody, got)
+		}
+	}
+}
+
+func TestTsuruFormRequests(t *testing.T) {
+	serviceTestClient := client.NewDummy()
+	formContentType := "application/x-www-form-urlencoded"
+
+	tests := []struct {
+		givenURI    string
+		givenMethod string
+		givenBody   string
+
+		wantCode int
+	}{
+		{ // Instance creation
+			givenURI:    "/resources",
+			givenMethod: "POST",
+			givenBody:   "name=testinstance&plan=tsuru-counter&team=myteam&user=me%40tsuru.io&description=test&tag=prod",
+
+			wantCode: http.StatusOK,
+		},
+		{ // App binding
+			givenURI:    "/resources/testinstance/bind-app",
+			givenMethod: "POST",
+			givenBody:   "app-name=myapp&app-host=myapp.tsuru.io",
+
+			wantCode: http.StatusCreated,
+		},
+		{ // Unit binding
+			givenURI:    "/resources/testinstance/bind",
+			givenMethod: "POST",
+			givenBody:   "app-name=myapp&app-host=myapp.tsuru.io&unit-host=10.10.10.10",
+
+			wantCode: http.StatusCreated,
+		},
+		{ // Unit unbinding
+			givenURI:    "/resources/testinstance/bind",
+			givenMethod: "DELETE",
+			givenBody:   "app-name=myapp&app-host=myapp.tsuru.io&unit-host=10.10.10.10",
+
+			wantCode: http.StatusOK,
+		},
+		{ // App unbinding
+			givenURI:    "/resources/testinstance/bind-app",
+			givenMethod: "DELETE",
+			givenBody:   "app-name=myapp&app-host=myapp.tsuru.io",
+
+			wantCode: http.StatusOK,
+		},
+	}
+
+	srvr := server.NewSimpleServer(nil)
+	srvr.Register(&RiakService{Cfg: serviceTestCfg, Client: serviceTestClient})
+
+	for _, test := range tests {
+		r, _ := http.NewRequest(test.givenMethod, test.givenURI, strings.NewReader(test.givenBody))
+		r.Header.Set("Content-Type", formContentType)
+		w := httptest.NewRecorder()
+		srvr.ServeHTTP(w, r)
+
+		if w.Code != test.wantCode {
+			t.Errorf("%s %s: expected response code of %d; got %d", test.givenMethod, test.givenURI, test.wantCode, w.Code)
+		}
+	}
+
+	// Check state on dummy client is correct
+	if !reflect.DeepEqual(map[string]string{"testinstance": "tsuru-counter"}, serviceTestClient.Buckets) {
+		t.Errorf("expected dummy buckets with the instance; got: %v", serviceTestClient.Buckets)
+	}
+	if info := serviceTestClient.BucketsInfo["testinstance"]; info == nil || info.Team != "myteam" {
+		t.Errorf("expected instance of team 'myteam'; got: %v", info)
+	}
+	if len(serviceTestClient.Users) != 0 {
+		t.Errorf("expected no dummy users after unbinding; got: %v", serviceTestClient.Users)
+	}
+}
+
+func TestListInstances(t *testing.T) {
+	serviceTestClient := client.NewDummy()
+	serviceTestClient.Buckets = map[string]string{
+		"instance-a": "tsuru-counter",
+		"instance-b": "tsuru-set",
+		"instance-c": "tsuru-counter",
+	}
+	serviceTestClient.BucketsInfo = map[string]*client.BucketInfo{
+		"instance-a": &client.BucketInfo{Team: "team-a", Creator: "me@tsuru.io"},
+		"instance-b": &client.BucketInfo{Team: "team-a", Tags: []string{"prod"}},
+		"instance-c": &client.BucketInfo{Team: "team-b"},
+	}
+	zeroTime := time.Time{}.Format(time.RFC3339)
+
+	tests := []struct {
+		givenURI string
+
+		wantCode int
+		wantBody interface{}
+	}{
+		{
+			givenURI: "/resources?team=team-a",
+
+			wantCode: http.StatusOK,
+			wantBody: []interface{}{
+				map[string]interface{}{"name": "instance-a", "bucket_type": "tsuru-counter", "team": "team-a", "creator": "me@tsuru.io", "created_at": zeroTime},
+				map[string]interface{}{"name": "instance-b", "bucket_type": "tsuru-set", "team": "team-a", "creator": "", "created_at": zeroTime, "tags": []interface{}{"prod"}},
+			},
+		},
+		{
+			givenURI: "/resources?plan=tsuru-counter",
+
+			wantCode: http.StatusOK,
+			wantBody: []interface{}{
+				map[string]interface{}{"name": "instance-a", "bucket_type": "tsuru-counter", "team": "team-a", "creator": "me@tsuru.io", "created_at": zeroTime},
+				map[string]interface{}{"name": "instance-c", "bucket_type": "tsuru-counter", "team": "team-b", "creator": "", "created_at": zeroTime},
+			},
+		},
+		{
+			givenURI: "/resources?team=team-b&plan=tsuru-set",
+
+			wantCode: http.StatusOK,
+			wantBody: []interface{}{},
+		},
+	}
+
+	for _, test := range tests {
+		srvr := server.NewSimpleServer(nil)
+		srvr.Register(&RiakService{Cfg: serviceTestCfg, Client: serviceTestClient})
+
+		r, _ := http.NewRequest("GET", test.givenURI, nil)
+		w := httptest.NewRecorder()
+		srvr.ServeHTTP(w, r)
+
+		if w.Code != test.wantCode {
+			t.Errorf("expected response code of %d; got %d", test.wantCode, w.Code)
+		}
+
+		var got interface{}
+		if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+			t.Error("unable to JSON decode response body: ", err)
+		}
+
+		if !reflect.DeepEqual(got, test.wantBody) {
+			t.Errorf("expected response body of\n%#v;\ngot\n%#v", test.wantBody, got)
+		}
+	}
+}
+
+func TestInstanceCreationRecord(t *testing.T) {
+	serviceTestClient := client.NewDummy()
+	srvr := server.NewSimpleServer(nil)
+	srvr.Register(&RiakService{Cfg: serviceTestCfg, Client: serviceTestClient})
+
+	body := "name=mybucket&plan=tsuru-counter&team=myteam&user=me%40tsuru.io&tag=prod&tag=web&parameters.n_val=5"
+	r, _ := http.NewRequest("POST", "/resources", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	srvr.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected response code of %d; got %d", http.StatusOK, w.Code)
+	}
+
+	got, err := serviceTestClient.GetBucketInfo(context.Background(), "mybucket")
+	if err != nil {
+		t.Fatalf("Error retrieving the instance record: %v", err)
+	}
+	if got.CreatedAt.IsZero() {
+		t.Errorf("Expected creation time on the instance record")
+	}
+	got.CreatedAt = time.Time{}
+
+	want := &client.BucketInfo{
+		Name:       "mybucket",
+		BucketType: "tsuru-counter",
+		DataType:   "counter",
+		Team:       "myteam",
+		Creator:    "me@tsuru.io",
+		Parameters: map[string]string{"n_val": "5"},
+		Tags:       []string{"prod", "web"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected instance record %#v;\ngot: %#v", want, got)
+	}
+}
+
+func TestCredentialsRotation(t *testing.T) {
+	tests := []struct {
+		givenUsers map[string]*client.UserProps
+		givenURI   string
+		givenBody  string
+
+		wantCode         int
+		wantBody         interface{}
+		wantPrevPassword string
+	}{
+		{
+			givenUsers: map[string]*client.UserProps{
+				"tsuru_myapp": &client.UserProps{Username: "tsuru_myapp", Password: "old", ACL: []string{"instance-a", "instance-b"}},
+			},
+			givenURI: "/users/myapp/credentials",
+
+			wantCode: http.StatusOK,
+			wantBody: map[string]interface{}{"user": "tsuru_myapp", "instances": []interface{}{"instance-a", "instance-b"}, "grace": false},
+		},
+		{
+			givenUsers: map[string]*client.UserProps{
+				"tsuru_myapp": &client.UserProps{Username: "tsuru_myapp", Password: "old", ACL: []string{"instance-a"}},
+			},
+			givenURI: "/users/myapp/credentials?grace=true",
+
+			wantCode:         http.StatusOK,
+			wantBody:         map[string]interface{}{"user": "tsuru_myapp", "instances": []interface{}{"instance-a"}, "grace": true},
+			wantPrevPassword: "old",
+		},
+		{ // Grace on a JSON body
+			givenUsers: map[string]*client.UserProps{
+				"tsuru_myapp": &client.UserProps{Username: "tsuru_myapp", Password: "old", ACL: []string{"instance-a"}},
+			},
+			givenURI:  "/users/myapp/credentials",
+			givenBody: `{"grace": true}`,
+
+			wantCode:         http.StatusOK,
+			wantBody:         map[string]interface{}{"user": "tsuru_myapp", "instances": []interface{}{"instance-a"}, "grace": true},
+			wantPrevPassword: "old",
+		},
+		{
+			givenUsers: map[string]*client.UserProps{
+				"tsuru_myapp": &client.UserProps{Username: "tsuru_myapp", Password: "new", PreviousPassword: "old"},
+			},
+			givenURI: "/users/myapp/credentials",
+
+			wantCode:         http.StatusConflict,
+			wantBody:         map[string]interface{}{"error": "Error rotating credentials: password rotation pending confirmation"},
+			wantPrevPassword: "old",
+		},
+		{
+			givenUsers: map[string]*client.UserProps{},
+			givenURI:   "/users/myapp/credentials",
+
+			wantCode: http.StatusNotFound,
+			wantBody: map[string]interface{}{"error": "Error rotating credentials: user not found"},
+		},
+		{
+			givenUsers: map[string]*client.UserProps{
+				"tsuru_myapp": &client.UserProps{Username: "tsuru_myapp", Password: "old"},
+			},
+			givenURI: "/users/myapp/credentials?grace=maybe",
+
+			wantCode: http.StatusBadRequest,
+			wantBody: map[string]interface{}{"error": InvalidRequestMsg},
+		},
+		{
+			givenUsers: map[string]*client.UserProps{
+				"tsuru_myapp": &client.UserProps{Username: "tsuru_myapp", Password: "new", PreviousPassword: "old"},
+			},
+			givenURI: "/users/myapp/credentials/confirm",
+
+			wantCode: http.StatusOK,
+			wantBody: "",
+		},
+		{
+			givenUsers: map[string]*client.UserProps{
+				"tsuru_myapp": &client.UserProps{Username: "tsuru_myapp", Password: "old"},
+			},
+			givenURI: "/users/myapp/credentials/confirm",
+
+			wantCode: http.StatusConflict,
+			wantBody: map[string]interface{}{"error": "Error confirming credentials rotation: no password rotation pending"},
+		},
+	}
+
+	for _, test := range tests {
+		serviceTestClient := client.NewDummy()
+		serviceTestClient.Users = test.givenUsers
+		srvr := server.NewSimpleServer(nil)
+		srvr.Register(&RiakService{Cfg: serviceTestCfg, Client: serviceTestClient})
+
+		r, _ := http.NewRequest("POST", test.givenURI, strings.NewReader(test.givenBody))
+		if test.givenBody != "" {
+			r.Header.Set("Content-Type", "application/json")
+		}
+		w := httptest.NewRecorder()
+		srvr.ServeHTTP(w, r)
+
+		if w.Code != test.wantCode {
+			t.Errorf("%s: expected response code of %d; got %d", test.givenURI, test.wantCode, w.Code)
+		}
+
+		var got interface{}
+		if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+			t.Error("unable to JSON decode response body: ", err)
+		}
+		if !reflect.DeepEqual(got, test.wantBody) {
+			t.Errorf("%s: expected response body of\n%#v;\ngot\n%#v", test.givenURI, test.wantBody, got)
+		}
+
+		if user, ok := test.givenUsers["tsuru_myapp"]; ok {
+			if user.PreviousPassword != test.wantPrevPassword {
+				t.Errorf("%s: expected previous password '%s'; got '%s'", test.givenURI, test.wantPrevPassword, user.PreviousPassword)
+			}
+			if test.wantCode == http.StatusOK && strings.HasSuffix(test.givenURI, "/credentials") && user.Password == "old" {
+				t.Errorf("%s: expected password changed", test.givenURI)
+			}
+		}
+	}
+}
+
+func TestClientCertificates(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "riakapi test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	issuer, err := client.NewCertIssuer(
+		string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})),
+		time.Hour, "http://riakapi.tsuru.io/crl")
+	if err != nil {
+		t.Fatalf("Error creating the issuer: %v", err)
+	}
+
+	serviceTestClient := client.NewDummy()
+	serviceTestClient.Buckets = map[string]string{"testinstance": "testbuckettype"}
+	srvr := server.NewSimpleServer(nil)
+	srvr.Register(&RiakService{Cfg: serviceTestCfg, Client: serviceTestClient})
+
+	// Disabled until the issuer is set
+	r, _ := http.NewRequest("GET", "/crl", nil)
+	w := httptest.NewRecorder()
+	srvr.ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected response code of %d; got %d", http.StatusNotFound, w.Code)
+	}
+	serviceTestClient.Certs = issuer
+
+	// Binding twice revokes the first certificate
+	serials := []string{}
+	for i := 0; i < 2; i++ {
+		r, _ := http.NewRequest("POST", "/resources/testinstance/bind-app?app-host=myapp.tsuru.io", nil)
+		w := httptest.NewRecorder()
+		srvr.ServeHTTP(w, r)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("expected response code of %d; got %d", http.StatusCreated, w.Code)
+		}
+
+		var got map[string]string
+		if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+			t.Fatal("unable to JSON decode response body: ", err)
 		}
+		block, _ := pem.Decode([]byte(got["RIAK_CLIENT_CERT"]))
+		if block == nil || !strings.Contains(got["RIAK_CLIENT_KEY"], "PRIVATE KEY") {
+			t.Fatalf("expected client certificate and key; got %#v", got)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatalf("unable to parse the client certificate: %v", err)
+		}
+		if cert.Subject.CommonName != "tsuru_myapp.tsuru.io" {
+			t.Errorf("expected certificate of 'tsuru_myapp.tsuru.io'; got '%s'", cert.Subject.CommonName)
+		}
+		serials = append(serials, cert.SerialNumber.Text(16))
+	}
+
+	r, _ = http.NewRequest("GET", "/crl", nil)
+	w = httptest.NewRecorder()
+	srvr.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected response code of %d; got %d", http.StatusOK, w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/pkix-crl" {
+		t.Errorf("expected revocation list content type; got '%s'", ct)
+	}
+	crl, err := x509.ParseRevocationList(w.Body.Bytes())
+	if err != nil {
+		t.Fatalf("unable to parse the revocation list: %v", err)
+	}
+	got := []string{}
+	for _, rc := range crl.RevokedCertificateEntries {
+		got = append(got, rc.SerialNumber.Text(16))
+	}
+	if want := serials[:1]; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected revoked serials %v; got %v", want, got)
+	}
+}
+
+func TestBindInstanceCertificateFailure(t *testing.T) {
+	// The CA key doesn't match the CA certificate, the certificates can't be signed
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "riakapi test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	keyDER, _ := x509.MarshalECPrivateKey(otherKey)
+	issuer, err := client.NewCertIssuer(
+		string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})),
+		time.Hour, "")
+	if err != nil {
+		t.Fatalf("Error creating the issuer: %v", err)
+	}
+
+	serviceTestClient := client.NewDummy()
+	serviceTestClient.Buckets = map[string]string{"testinstance": "testbuckettype"}
+	serviceTestClient.Certs = issuer
+	srvr := server.NewSimpleServer(nil)
+	srvr.Register(&RiakService{Cfg: serviceTestCfg, Client: serviceTestClient})
+
+	r, _ := http.NewRequest("POST", "/resources/testinstance/bind-app?app-host=myapp.tsuru.io", nil)
+	w := httptest.NewRecorder()
+	srvr.ServeHTTP(w, r)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("expected response code of %d; got %d", http.StatusInternalServerError, w.Code)
+	}
+
+	// Nothing is left granted
+	user := serviceTestClient.Users["tsuru_myapp.tsuru.io"]
+	if user == nil {
+		t.Fatalf("expected the app user created")
+	}
+	if len(user.ACL) != 0 || len(user.BindModes) != 0 || len(user.Certs) != 0 {
+		t.Errorf("expected no binding; got ACL %v, modes %v, certificates %v", user.ACL, user.BindModes, user.Certs)
+	}
+	if buckets, _ := serviceTestClient.GetUserBuckets(context.Background(), "tsuru_myapp.tsuru.io"); len(buckets) != 0 {
+		t.Errorf("expected no bound instances; got %v", buckets)
 	}
 }
@@ -1,18 +1,41 @@
 package utils
 
 import (
+	"crypto/rand"
 	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"strings"
 )
 
+const usernamePrefix = "tsuru_"
+
 // GenerateUsername creates a random username based on a word
 func GenerateUsername(word string) string {
-	username := fmt.Sprintf("tsuru_%s", word)
+	username := fmt.Sprintf("%s%s", usernamePrefix, word)
 	return username
 }
 
-// GeneratePassword creates a password based on a word and a hash
+// UsernameWord returns the word used to generate a username
+func UsernameWord(username string) string {
+	return strings.TrimPrefix(username, usernamePrefix)
+}
+
+// passwordLength is the number of random bytes of the generated passwords
+const passwordLength = 32
+
+// GenerateRandomPassword creates a random hex password
+func GenerateRandomPassword() (string, error) {
+	b := make([]byte, passwordLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// GeneratePassword creates a password based on a word and a hash, the users
+// created before the random passwords have these passwords
 func GeneratePassword(word, salt string) string {
 	h := sha1.New()
 	io.WriteString(h, word)